@@ -0,0 +1,402 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// ArchiveMount is the path of the KV version 2 backend where the broker
+// archives the secrets of backends before unmounting them. Each archive is
+// stored at "<mount_path>/<timestamp>".
+const ArchiveMount = "cf/broker-archive"
+
+// ArchiveTransitMount is the path of the transit backend holding ArchiveKey,
+// the key the broker encrypts the secrets of archives with.
+const (
+	ArchiveTransitMount = "cf/broker-transit"
+	ArchiveKey          = "archive"
+)
+
+// DefaultArchiveRetention is how long archives are kept when the broker is not
+// configured otherwise.
+const DefaultArchiveRetention = 30 * 24 * time.Hour
+
+// archiveTimeFormat is the format of the timestamp of archives.
+const archiveTimeFormat = "20060102T150405Z"
+
+// archiveRecord is an archive of the secrets of a KV backend.
+type archiveRecord struct {
+	// Mount is the path the backend was mounted at, and KVVersion its
+	// version.
+	Mount     string
+	KVVersion int
+
+	// OrganizationGUID and SpaceGUID are those of the instance, or of the
+	// shared backend, that was archived, if any, and ApplicationGUID that of
+	// the application whose backend was archived. Only instances of the same
+	// space, or of the same organization for the backend of an organization,
+	// may restore it.
+	OrganizationGUID string `json:",omitempty"`
+	SpaceGUID        string `json:",omitempty"`
+	ApplicationGUID  string `json:",omitempty"`
+
+	// ArchivedAt is when the archive was taken, and ExpiresAt when it is
+	// purged.
+	ArchivedAt time.Time
+	ExpiresAt  time.Time
+
+	// Ciphertext is the data of each secret, keyed by their path in the
+	// backend, encoded as JSON and encrypted with ArchiveKey.
+	Ciphertext string
+}
+
+// expired returns true if the archive is past its retention.
+func (r *archiveRecord) expired() bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
+
+// archiveRetention returns how long archives are kept.
+func (b *Broker) archiveRetention() time.Duration {
+	if b.archiveTTL == 0 {
+		return DefaultArchiveRetention
+	}
+	return b.archiveTTL
+}
+
+// archiveMount copies every secret of the KV backend at the path into an
+// encrypted archive, and returns the path of the archive in ArchiveMount. The
+// organization, space, and application the backend belongs to, if known, are
+// recorded so that it may be restored within them.
+func (b *Broker) archiveMount(path string, mount *api.MountOutput, owner mountOwner) (string, error) {
+	version := mountKVVersion(mount)
+	if version == 0 {
+		return "", b.errorf("cannot archive %s, which is a %s backend", path, mount.Type)
+	}
+
+	mounts := map[string]*api.MountInput{
+		ArchiveMount:        kvMountInput(2),
+		ArchiveTransitMount: {Type: "transit"},
+	}
+	if err := b.idempotentMount(mounts); err != nil {
+		return "", b.wErrorf(err, "failed to create mounts %s", mapToKV(mountTypes(mounts), ", "))
+	}
+
+	secrets := make(map[string]map[string]interface{})
+	b.log.Printf("[DEBUG] reading secrets of %s", path)
+	if err := b.readKV(path, version, "", secrets); err != nil {
+		return "", b.wErrorf(err, "failed to read secrets of %s", path)
+	}
+	ciphertext, err := b.encryptArchive(secrets)
+	if err != nil {
+		return "", b.wErrorf(err, "failed to encrypt secrets of %s", path)
+	}
+
+	now := time.Now().UTC()
+	record := &archiveRecord{
+		Mount:            path,
+		KVVersion:        version,
+		OrganizationGUID: owner.OrganizationGUID,
+		SpaceGUID:        owner.SpaceGUID,
+		ApplicationGUID:  owner.ApplicationGUID,
+		ArchivedAt:       now,
+		ExpiresAt:        now.Add(b.archiveRetention()),
+		Ciphertext:       ciphertext,
+	}
+
+	archivePath := path + "/" + now.Format(archiveTimeFormat)
+	b.log.Printf("[INFO] archiving %d secrets of %s at %s/%s", len(secrets), path, ArchiveMount, archivePath)
+	if _, err := b.vaultClient.Logical().Write(ArchiveMount+"/data/"+archivePath, map[string]interface{}{
+		"data": record,
+	}); err != nil {
+		return "", b.wErrorf(err, "failed to archive secrets of %s", path)
+	}
+
+	// Archiving is as good a time as any to drop the archives nobody can
+	// restore anymore
+	b.purgeArchives()
+	return archivePath, nil
+}
+
+// archiveInstance archives the secrets of the instance's secret backend, if it
+// is mounted. The info of the instance is nil if the broker has no record of
+// it.
+func (b *Broker) archiveInstance(instanceID string, info *instanceInfo) error {
+	path := "cf/" + instanceID + "/" + EngineSecret
+	var owner mountOwner
+	if info != nil {
+		owner.OrganizationGUID = info.OrganizationGUID
+		owner.SpaceGUID = info.SpaceGUID
+	}
+
+	b.mountMutex.Lock()
+	mounts, err := b.vaultClient.Sys().ListMounts()
+	b.mountMutex.Unlock()
+	if err != nil {
+		return b.wErrorf(err, "failed to list mounts to archive %s", path)
+	}
+	for k, m := range mounts {
+		if strings.Trim(k, "/") != path {
+			continue
+		}
+		// The secrets of instances the broker has no record of are still
+		// archived, but cannot be restored into another instance.
+		if _, err := b.archiveMount(path, m, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readKV reads every secret under the directory of the KV backend at the path
+// into secrets, keyed by their path in the backend.
+func (b *Broker) readKV(path string, version int, dir string, secrets map[string]map[string]interface{}) error {
+	listPath, readPath := path+"/", path+"/"
+	if version == 2 {
+		listPath, readPath = path+"/metadata/", path+"/data/"
+	}
+
+	keys, err := b.listDir(listPath + dir)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			if err := b.readKV(path, version, dir+k, secrets); err != nil {
+				return err
+			}
+			continue
+		}
+
+		secret, err := b.vaultClient.Logical().Read(readPath + dir + k)
+		if err != nil {
+			return err
+		}
+		if secret == nil {
+			// The secret was deleted since it was listed, or is a deleted
+			// version.
+			continue
+		}
+		data := secret.Data
+		if version == 2 {
+			data, _ = secret.Data["data"].(map[string]interface{})
+			if data == nil {
+				continue
+			}
+		}
+		secrets[dir+k] = data
+	}
+	return nil
+}
+
+// writeKV writes the secrets, keyed by their path, into the KV backend at the
+// path.
+func (b *Broker) writeKV(path string, version int, secrets map[string]map[string]interface{}) error {
+	for k, data := range secrets {
+		var err error
+		if version == 2 {
+			_, err = b.vaultClient.Logical().Write(path+"/data/"+k, map[string]interface{}{
+				"data": data,
+			})
+		} else {
+			_, err = b.vaultClient.Logical().Write(path+"/"+k, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptArchive encodes the secrets as JSON and encrypts them with
+// ArchiveKey, which transit creates on first use.
+func (b *Broker) encryptArchive(secrets map[string]map[string]interface{}) (string, error) {
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return "", err
+	}
+	secret, err := b.vaultClient.Logical().Write(ArchiveTransitMount+"/encrypt/"+ArchiveKey, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", fmt.Errorf("no ciphertext returned")
+	}
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return "", fmt.Errorf("ciphertext is not a string")
+	}
+	return ciphertext, nil
+}
+
+// decryptArchive decrypts the secrets of an archive.
+func (b *Broker) decryptArchive(ciphertext string) (map[string]map[string]interface{}, error) {
+	secret, err := b.vaultClient.Logical().Write(ArchiveTransitMount+"/decrypt/"+ArchiveKey, map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no plaintext returned")
+	}
+	encoded, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("plaintext is not a string")
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var secrets map[string]map[string]interface{}
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// readArchive reads the archive at the path in ArchiveMount. It returns nil if
+// there is none.
+func (b *Broker) readArchive(archivePath string) (*archiveRecord, error) {
+	secret, err := b.vaultClient.Logical().Read(ArchiveMount + "/data/" + archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	data, ok := secret.Data["data"]
+	if !ok || data == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	record := new(archiveRecord)
+	if err := json.Unmarshal(raw, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// restorableArchive returns the path and record of the latest archive of the
+// secret backend of the given instance, or of the backend of the given
+// organization or space, if it may be restored into a new instance of the
+// organization and space. The archives of the backends of applications are
+// not restored.
+func (b *Broker) restorableArchive(archivedID, organizationGUID, spaceGUID string) (string, *archiveRecord, error) {
+	path := "cf/" + archivedID + "/" + EngineSecret
+	keys, err := b.listDir(ArchiveMount + "/metadata/" + path + "/")
+	if err != nil {
+		return "", nil, b.wErrorf(err, "failed to list archives of %s", path)
+	}
+	var timestamps []string
+	for _, k := range keys {
+		if !strings.HasSuffix(k, "/") {
+			timestamps = append(timestamps, k)
+		}
+	}
+	if len(timestamps) == 0 {
+		return "", nil, errInvalidParameters(fmt.Errorf("%s has no archive to restore", archivedID))
+	}
+	sort.Strings(timestamps)
+
+	archivePath := path + "/" + timestamps[len(timestamps)-1]
+	record, err := b.readArchive(archivePath)
+	if err != nil {
+		return "", nil, b.wErrorf(err, "failed to read archive %s", archivePath)
+	}
+	if record == nil {
+		return "", nil, errInvalidParameters(fmt.Errorf("%s has no archive to restore", archivedID))
+	}
+	owned := record.SpaceGUID != "" && record.SpaceGUID == spaceGUID && record.ApplicationGUID == ""
+	if archivedID == organizationGUID {
+		owned = record.OrganizationGUID == organizationGUID && record.SpaceGUID == ""
+	}
+	switch {
+	case !owned:
+		return "", nil, errInvalidParameters(fmt.Errorf("%s was not in this space", archivedID))
+	case record.expired():
+		return "", nil, errInvalidParameters(fmt.Errorf("the archive of %s expired at %s", archivedID, record.ExpiresAt.Format(time.RFC3339)))
+	}
+	return archivePath, record, nil
+}
+
+// restoreArchive writes the secrets of the latest archive of the given
+// instance into the secret backend of the new instance, or those of the backend
+// of its organization or space back into that backend.
+func (b *Broker) restoreArchive(archivedID, instanceID string, info *instanceInfo) error {
+	archivePath, record, err := b.restorableArchive(archivedID, info.OrganizationGUID, info.SpaceGUID)
+	if err != nil {
+		return err
+	}
+	secrets, err := b.decryptArchive(record.Ciphertext)
+	if err != nil {
+		return b.wErrorf(err, "failed to decrypt archive %s", archivePath)
+	}
+
+	path := "cf/" + instanceID + "/" + EngineSecret
+	version := b.instanceKVVersion(info)
+	if archivedID == info.OrganizationGUID || archivedID == info.SpaceGUID {
+		path = "cf/" + archivedID + "/" + EngineSecret
+		versions, err := b.kvVersions(instanceID, info)
+		if err != nil {
+			return b.wErrorf(err, "failed to determine the KV version of %s", path)
+		}
+		version = versions[path]
+	}
+	b.log.Printf("[INFO] restoring %d secrets of %s/%s into %s", len(secrets), ArchiveMount, archivePath, path)
+	if err := b.writeKV(path, version, secrets); err != nil {
+		return b.wErrorf(err, "failed to restore secrets into %s", path)
+	}
+	return nil
+}
+
+// purgeArchives deletes every archive past its retention. Failures are logged
+// rather than returned, since the archives are purged again later.
+func (b *Broker) purgeArchives() {
+	if err := b.purgeArchiveDir(""); err != nil {
+		b.log.Printf("[WARN] failed to purge expired archives: %s", err)
+	}
+}
+
+// purgeArchiveDir deletes every archive past its retention under the directory
+// of ArchiveMount.
+func (b *Broker) purgeArchiveDir(dir string) error {
+	keys, err := b.listDir(ArchiveMount + "/metadata/" + dir)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") {
+			if err := b.purgeArchiveDir(dir + k); err != nil {
+				return err
+			}
+			continue
+		}
+
+		record, err := b.readArchive(dir + k)
+		if err != nil {
+			return err
+		}
+		if record == nil || !record.expired() {
+			continue
+		}
+		b.log.Printf("[INFO] purging archive %s/%s, which expired at %s", ArchiveMount, dir+k, record.ExpiresAt.Format(time.RFC3339))
+		if _, err := b.vaultClient.Logical().Delete(ArchiveMount + "/metadata/" + dir + k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
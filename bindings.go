@@ -0,0 +1,543 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	// BindingModeToken binds applications by creating a periodic token with
+	// the instance's token role, which the broker renews for as long as the
+	// binding exists.
+	BindingModeToken = "token"
+
+	// BindingModeAppRole binds applications by creating an AppRole for each
+	// binding. Applications log in with its role_id and secret_id and manage
+	// their own tokens, so the broker does not renew anything.
+	BindingModeAppRole = "approle"
+
+	// BindingModeCert binds applications by creating a role in the cert auth
+	// method for each binding, which only accepts the instance identity
+	// certificates Cloud Foundry issues to the bound application's containers.
+	// The credentials do not contain any secret.
+	BindingModeCert = "cert"
+
+	// BindingModeJWT binds applications by creating a role in the JWT auth
+	// method for each binding, which only accepts the identity tokens the
+	// platform issues to the bound application. The credentials do not
+	// contain any secret.
+	BindingModeJWT = "jwt"
+
+	// DefaultAppRolePath, DefaultCertPath, and DefaultJWTPath are the default
+	// paths of the AppRole, cert, and JWT auth methods.
+	DefaultAppRolePath = "approle"
+	DefaultCertPath    = "cert"
+	DefaultJWTPath     = "jwt"
+
+	// RoleTokenTTL and RoleTokenMaxTTL are the TTLs of the tokens issued by
+	// the roles created for bindings that are not token bindings. Applications
+	// log in again once their token reaches its maximum TTL.
+	RoleTokenTTL    = 60 * 60
+	RoleTokenMaxTTL = 24 * 60 * 60
+)
+
+// bindingModes are the modes a plan may bind applications with.
+var bindingModes = map[string]bool{
+	BindingModeToken:   true,
+	BindingModeAppRole: true,
+	BindingModeCert:    true,
+	BindingModeJWT:     true,
+}
+
+// jwtOrganizationClaim, jwtSpaceClaim, and jwtApplicationClaim are the claims
+// of the platform's identity tokens that hold the organization, space, and
+// application GUIDs.
+const (
+	jwtOrganizationClaim = "org_guid"
+	jwtSpaceClaim        = "space_guid"
+	jwtApplicationClaim  = "app_guid"
+)
+
+// ErrInstanceHasBindings is returned when deprovisioning an instance that is
+// still bound, if the broker is configured to refuse it.
+var ErrInstanceHasBindings = brokerapi.NewFailureResponse(
+	errors.New("instance still has bindings"), http.StatusUnprocessableEntity, "instance-has-bindings")
+
+// instanceBindings returns the IDs of the bindings of the instance that have a
+// record.
+func (b *Broker) instanceBindings(instanceID string) ([]string, error) {
+	keys, err := b.listState(instanceID + "/")
+	if err != nil {
+		return nil, b.wErrorf(err, "failed to list bindings of instance %s", instanceID)
+	}
+	return uniqueKeys(keys), nil
+}
+
+// bindingMode returns the mode applications are bound with under the plan.
+func (p *Plan) bindingMode() string {
+	if p.BindingMode == "" {
+		return BindingModeToken
+	}
+	return p.BindingMode
+}
+
+// mode returns the mode the binding was created with. Bindings created before
+// the broker supported binding modes are token bindings.
+func (i *bindingInfo) mode() string {
+	if i.Mode == "" {
+		return BindingModeToken
+	}
+	return i.Mode
+}
+
+// bindToken creates the token of the binding with the instance's token role,
+// ensuring the role exists, and records it in the binding info.
+func (b *Broker) bindToken(instanceID, bindingID string, info *bindingInfo, params *bindingParameters) error {
+	if err := b.putTokenRole(instanceID); err != nil {
+		return err
+	}
+	policyName := "cf-" + instanceID
+	renewable := true
+	b.log.Printf("[DEBUG] creating token with role %s", policyName)
+	secret, err := b.vaultClient.Auth().Token().CreateWithRole(&api.TokenCreateRequest{
+		Policies:       append([]string{policyName}, params.Policies...),
+		Metadata:       map[string]string{"cf-instance-id": instanceID, "cf-binding-id": bindingID},
+		DisplayName:    "cf-bind-" + bindingID,
+		Renewable:      &renewable,
+		Period:         params.Period,
+		ExplicitMaxTTL: params.ExplicitMaxTTL,
+		NumUses:        params.NumUses,
+	}, policyName)
+	if err != nil {
+		return b.wErrorf(err, "failed to create token with role %s", policyName)
+	}
+	if secret.Auth == nil {
+		return b.errorf("secret with role %s has no auth", policyName)
+	}
+	info.ClientToken = secret.Auth.ClientToken
+	info.Accessor = secret.Auth.Accessor
+	info.NumUses = params.NumUses
+	return nil
+}
+
+// bindAppRole creates the AppRole for the binding, granting the instance's
+// policy, and records the credentials applications log in with in the binding
+// info. The role and auth path are recorded too, so the role can be deleted
+// when the binding is.
+func (b *Broker) bindAppRole(instanceID, bindingID string, info *bindingInfo, params *bindingParameters) error {
+	authPath := b.appRolePath
+	if authPath == "" {
+		authPath = DefaultAppRolePath
+	}
+	role := "cf-" + bindingID
+	rolePath := "auth/" + authPath + "/role/" + role
+
+	data := roleTokenData(instanceID, params)
+	data["secret_id_num_uses"] = b.appRoleSecretIDNumUses
+	b.log.Printf("[DEBUG] creating AppRole %s", rolePath)
+	if _, err := b.vaultClient.Logical().Write(rolePath, data); err != nil {
+		return b.wErrorf(err, "failed to create AppRole %s", rolePath)
+	}
+	info.AuthPath = authPath
+	info.Role = role
+
+	secret, err := b.vaultClient.Logical().Read(rolePath + "/role-id")
+	if err != nil {
+		return b.wErrorf(err, "failed to read role ID of AppRole %s", rolePath)
+	}
+	if secret == nil || secret.Data["role_id"] == nil {
+		return b.errorf("AppRole %s has no role ID", rolePath)
+	}
+	info.RoleID, _ = secret.Data["role_id"].(string)
+	return b.createSecretID(instanceID, bindingID, info)
+}
+
+// createSecretID creates a secret ID for the AppRole of the binding, and
+// records it and its accessor in the binding info.
+func (b *Broker) createSecretID(instanceID, bindingID string, info *bindingInfo) error {
+	rolePath := info.rolePath()
+	metadata, err := json.Marshal(map[string]string{"cf-instance-id": instanceID, "cf-binding-id": bindingID})
+	if err != nil {
+		return b.wErrorf(err, "failed to encode secret ID metadata")
+	}
+	b.log.Printf("[DEBUG] creating secret ID for AppRole %s", rolePath)
+	secret, err := b.vaultClient.Logical().Write(rolePath+"/secret-id", map[string]interface{}{
+		"metadata": string(metadata),
+	})
+	if err != nil {
+		return b.wErrorf(err, "failed to create secret ID for AppRole %s", rolePath)
+	}
+	if secret == nil || secret.Data["secret_id"] == nil {
+		return b.errorf("AppRole %s returned no secret ID", rolePath)
+	}
+	info.secretID, _ = secret.Data["secret_id"].(string)
+	info.SecretIDAccessor, _ = secret.Data["secret_id_accessor"].(string)
+	return nil
+}
+
+// destroySecretID destroys the secret ID of the AppRole of the binding with the
+// accessor.
+func (b *Broker) destroySecretID(info *bindingInfo, accessor string) error {
+	rolePath := info.rolePath()
+	b.log.Printf("[DEBUG] destroying secret ID %s of AppRole %s", accessor, rolePath)
+	if _, err := b.vaultClient.Logical().Write(rolePath+"/secret-id-accessor/destroy", map[string]interface{}{
+		"secret_id_accessor": accessor,
+	}); err != nil {
+		return b.wErrorf(err, "failed to destroy secret ID %s of AppRole %s", accessor, rolePath)
+	}
+	return nil
+}
+
+// bindCert creates the cert auth role for the binding, granting the instance's
+// policy to the containers of the bound application.
+//
+// Instance identity certificates have an organizational unit for each of the
+// organization, space, and application GUIDs of the container, and a role
+// accepts certificates with any of its allowed organizational units, so the
+// role only allows the application's.
+func (b *Broker) bindCert(instanceID, bindingID string, info *bindingInfo, params *bindingParameters) error {
+	if info.Application == "" {
+		return b.error(brokerapi.ErrAppGuidNotProvided)
+	}
+	if b.certCA == "" {
+		return b.errorf("no instance identity CA is configured for cert bindings")
+	}
+	authPath := b.certPath
+	if authPath == "" {
+		authPath = DefaultCertPath
+	}
+	role := "cf-" + bindingID
+	rolePath := "auth/" + authPath + "/certs/" + role
+
+	data := roleTokenData(instanceID, params)
+	data["certificate"] = b.certCA
+	data["allowed_organizational_units"] = []string{"app:" + info.Application}
+	b.log.Printf("[DEBUG] creating cert role %s", rolePath)
+	if _, err := b.vaultClient.Logical().Write(rolePath, data); err != nil {
+		return b.wErrorf(err, "failed to create cert role %s", rolePath)
+	}
+	info.AuthPath = authPath
+	info.Role = role
+	return nil
+}
+
+// bindJWT creates the JWT auth role for the binding, granting the instance's
+// policy to the identity tokens of the bound application.
+func (b *Broker) bindJWT(instanceID, bindingID string, info *bindingInfo, params *bindingParameters) error {
+	if info.Application == "" {
+		return b.error(brokerapi.ErrAppGuidNotProvided)
+	}
+	authPath := b.jwtPath
+	if authPath == "" {
+		authPath = DefaultJWTPath
+	}
+	userClaim := b.jwtUserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	role := "cf-" + bindingID
+	rolePath := "auth/" + authPath + "/role/" + role
+
+	data := roleTokenData(instanceID, params)
+	data["role_type"] = "jwt"
+	data["user_claim"] = userClaim
+	data["bound_claims"] = map[string]interface{}{
+		jwtOrganizationClaim: info.Organization,
+		jwtSpaceClaim:        info.Space,
+		jwtApplicationClaim:  info.Application,
+	}
+	if len(b.jwtBoundAudiences) > 0 {
+		data["bound_audiences"] = b.jwtBoundAudiences
+	}
+	b.log.Printf("[DEBUG] creating JWT role %s", rolePath)
+	if _, err := b.vaultClient.Logical().Write(rolePath, data); err != nil {
+		return b.wErrorf(err, "failed to create JWT role %s", rolePath)
+	}
+	info.AuthPath = authPath
+	info.Role = role
+	return nil
+}
+
+// auth returns the auth section of the credentials of the binding, which
+// applications use to authenticate to Vault, before any wrapping.
+func (i *bindingInfo) auth() map[string]interface{} {
+	var auth map[string]interface{}
+	switch i.mode() {
+	case BindingModeAppRole:
+		auth = map[string]interface{}{
+			"method":    BindingModeAppRole,
+			"auth_path": i.AuthPath,
+			"role":      i.Role,
+			"role_id":   i.RoleID,
+		}
+		if i.secretID != "" {
+			auth["secret_id"] = i.secretID
+		}
+	case BindingModeCert, BindingModeJWT:
+		auth = map[string]interface{}{
+			"method":    i.mode(),
+			"auth_path": i.AuthPath,
+			"role":      i.Role,
+		}
+	default:
+		auth = map[string]interface{}{
+			"accessor": i.Accessor,
+			"token":    i.ClientToken,
+		}
+	}
+	return auth
+}
+
+// params returns the parameters the binding was created with.
+func (i *bindingInfo) params() *bindingParameters {
+	if i.Parameters == nil {
+		return &bindingParameters{}
+	}
+	return i.Parameters
+}
+
+// existingBinding returns the record of the binding if it exists, or nil. A
+// binding of the same ID that exists for another instance is an
+// ErrBindingAlreadyExists.
+func (b *Broker) existingBinding(instanceID, bindingID string) (*bindingInfo, error) {
+	path := instanceID + "/" + bindingID
+	info := new(bindingInfo)
+	ok, err := b.readState(path, recordKindBinding, info)
+	if err != nil {
+		return nil, b.wErrorf(err, "failed to read binding info for %s", path)
+	}
+	if ok {
+		return info, nil
+	}
+
+	b.bindLock.Lock()
+	_, ok = b.binds[bindingID]
+	b.bindLock.Unlock()
+	if ok {
+		return nil, b.error(brokerapi.ErrBindingAlreadyExists)
+	}
+	return nil, nil
+}
+
+// existingCredentials returns the credentials of an existing binding, for a
+// request that repeats the one that created it. The secret of a binding whose
+// credentials were response-wrapped is wrapped again, since the platform never
+// received the first wrapping token.
+//
+// The secret ID of an AppRole binding is not stored, and may have been used
+// already, so a new one is created, and the one it replaces destroyed.
+func (b *Broker) existingCredentials(ctx context.Context, instanceID string, instance *instanceInfo, info *bindingInfo, params *bindingParameters) (brokerapi.Binding, error) {
+	var binding brokerapi.Binding
+	if info.mode() == BindingModeAppRole {
+		if err := b.replaceSecretID(instanceID, info); err != nil {
+			return binding, err
+		}
+	}
+	auth := info.auth()
+	info.secretID = ""
+	if info.Wrapped {
+		if err := b.wrapCredentials(ctx, auth, params.WrapTTL); err != nil {
+			return binding, err
+		}
+	}
+	credentials, err := b.bindingCredentials(instanceID, instance, info, auth)
+	if err != nil {
+		return binding, err
+	}
+	binding.Credentials = credentials
+	return binding, nil
+}
+
+// replaceSecretID creates a new secret ID for the AppRole binding, stores the
+// binding with its accessor, and then destroys the secret ID it replaces.
+// Bindings stored before the broker recorded the accessors of secret IDs
+// cannot have theirs destroyed.
+func (b *Broker) replaceSecretID(instanceID string, info *bindingInfo) error {
+	previous := info.SecretIDAccessor
+	if err := b.createSecretID(instanceID, info.Binding, info); err != nil {
+		return err
+	}
+	path := instanceID + "/" + info.Binding
+	if err := b.writeState(path, recordKindBinding, info); err != nil {
+		if err := b.destroySecretID(info, info.SecretIDAccessor); err != nil {
+			b.log.Printf("[WARN] failed to destroy the new secret ID of binding %s: %s", path, err)
+		}
+		return b.wErrorf(err, "failed to commit binding %s", path)
+	}
+	if previous == "" {
+		b.log.Printf("[WARN] binding %s has no secret ID accessor, its previous secret ID is not destroyed", path)
+		return nil
+	}
+	if err := b.destroySecretID(info, previous); err != nil {
+		b.log.Printf("[WARN] failed to destroy the previous secret ID of binding %s: %s", path, err)
+	}
+	return nil
+}
+
+// bindingCredentials returns the credentials of an existing binding with the
+// given auth section. The backends and KV versions are derived from the
+// current state of the instance, so they reflect any change to its plan since
+// it was bound.
+func (b *Broker) bindingCredentials(instanceID string, instance *instanceInfo, info *bindingInfo, auth map[string]interface{}) (map[string]interface{}, error) {
+	versions, err := b.kvVersions(instanceID, instance)
+	if err != nil {
+		return nil, b.wErrorf(err, "failed to determine KV versions for %s", instanceID)
+	}
+
+	// Bindings without an application were given the backends of the
+	// instance's last bound application.
+	application := info.Application
+	if application == "" {
+		application = instance.ApplicationGUID
+	}
+	return b.credentials(instanceID, instance, application, auth, versions), nil
+}
+
+// credentials returns the credentials of a binding of the instance to the
+// given application, with the given auth section.
+func (b *Broker) credentials(instanceID string, instance *instanceInfo, application string, auth map[string]interface{}, versions map[string]int) map[string]interface{} {
+	genericBackends := []string{}
+	transitBackends := []string{}
+	if instance.hasEngine(EngineSecret) {
+		genericBackends = append(genericBackends, "cf/"+instanceID+"/secret")
+		if application != "" {
+			genericBackends = append(genericBackends, "cf/"+application+"/secret")
+		}
+	}
+	if instance.hasEngine(EngineTransit) {
+		transitBackends = append(transitBackends, "cf/"+instanceID+"/transit")
+		if application != "" {
+			transitBackends = append(transitBackends, "cf/"+application+"/transit")
+		}
+	}
+	return map[string]interface{}{
+		"address": b.vaultAdvertiseAddr,
+		"auth":    auth,
+		"backends": map[string]interface{}{
+			"generic": genericBackends,
+			"transit": transitBackends,
+		},
+		"backends_shared": map[string]interface{}{
+			"organization": "cf/" + instance.OrganizationGUID + "/secret",
+			"space":        "cf/" + instance.SpaceGUID + "/secret",
+			"application":  "cf/" + application + "/secret",
+		},
+		"kv_versions": versions,
+	}
+}
+
+// roleTokenData returns the fields of an auth method role that configure the
+// tokens it issues to a binding with the given parameters.
+func roleTokenData(instanceID string, params *bindingParameters) map[string]interface{} {
+	data := map[string]interface{}{
+		"token_policies": append([]string{"cf-" + instanceID}, params.Policies...),
+		"token_ttl":      RoleTokenTTL,
+		"token_max_ttl":  RoleTokenMaxTTL,
+	}
+	if params.Period != "" {
+		data["token_period"] = params.Period
+	}
+	if params.ExplicitMaxTTL != "" {
+		data["token_explicit_max_ttl"] = params.ExplicitMaxTTL
+	}
+	if params.NumUses != 0 {
+		data["token_num_uses"] = params.NumUses
+	}
+	return data
+}
+
+// renewable returns true if the broker renews the token of the binding. Only
+// token bindings have a token, and tokens limited in uses are not renewed,
+// since each renewal would use them.
+func (i *bindingInfo) renewable() bool {
+	return i.mode() == BindingModeToken && i.NumUses == 0
+}
+
+// credentialSecrets are the keys of the secrets in the auth section of the
+// credentials, which are response-wrapped when a binding asks for it.
+var credentialSecrets = []string{"token", "secret_id"}
+
+// wrapCredentials replaces the secret in the auth section of the credentials
+// with a single-use token that wraps it for the given TTL. Unwrapping the token
+// returns the secret under its original key.
+func (b *Broker) wrapCredentials(ctx context.Context, auth map[string]interface{}, ttl string) error {
+	for _, k := range credentialSecrets {
+		secret, ok := auth[k]
+		if !ok {
+			continue
+		}
+
+		b.log.Printf("[DEBUG] wrapping %s for %s", k, ttl)
+		r := b.vaultClient.NewRequest(http.MethodPut, "/v1/sys/wrapping/wrap")
+		r.WrapTTL = ttl
+		if err := r.SetJSONBody(map[string]interface{}{k: secret}); err != nil {
+			return b.wErrorf(err, "failed to encode %s", k)
+		}
+		resp, err := b.vaultClient.RawRequestWithContext(ctx, r)
+		if resp != nil {
+			defer resp.Body.Close()
+		}
+		if err != nil {
+			return b.wErrorf(err, "failed to wrap %s", k)
+		}
+		wrapped, err := api.ParseSecret(resp.Body)
+		if err != nil {
+			return b.wErrorf(err, "failed to decode wrapped %s", k)
+		}
+		if wrapped == nil || wrapped.WrapInfo == nil {
+			return b.errorf("wrapping %s returned no wrapping token", k)
+		}
+
+		delete(auth, k)
+		auth["wrapping_token"] = wrapped.WrapInfo.Token
+		auth["wrap_ttl"] = wrapped.WrapInfo.TTL
+		return nil
+	}
+	return b.errorf("credentials have no secret to wrap")
+}
+
+// rolePath returns the path of the role created for the binding, if it is not
+// a token binding.
+func (i *bindingInfo) rolePath() string {
+	switch i.mode() {
+	case BindingModeCert:
+		return "auth/" + i.AuthPath + "/certs/" + i.Role
+	default:
+		return "auth/" + i.AuthPath + "/role/" + i.Role
+	}
+}
+
+// revokeBinding revokes the access the binding grants: the token of token
+// bindings, or the role created for other bindings. Access that was already
+// revoked is not an error.
+func (b *Broker) revokeBinding(info *bindingInfo) error {
+	switch info.mode() {
+	case BindingModeAppRole, BindingModeCert, BindingModeJWT:
+		rolePath := info.rolePath()
+		b.log.Printf("[DEBUG] deleting %s role %s", info.mode(), rolePath)
+		if _, err := b.vaultClient.Logical().Delete(rolePath); err != nil {
+			return b.wErrorf(err, "failed to delete %s role %s", info.mode(), rolePath)
+		}
+	default:
+		a := info.Accessor
+		b.log.Printf("[DEBUG] revoking accessor %s", a)
+		if err := b.vaultClient.Auth().Token().RevokeAccessor(a); err != nil {
+			if strings.Contains(err.Error(), "invalid accessor") {
+				// The token has already been revoked or has expired.
+				b.log.Printf("[WARN] token has already been revoked or has expired")
+				return nil
+			}
+			return b.wErrorf(err, "failed to revoke accessor %s", a)
+		}
+	}
+	return nil
+}
@@ -9,7 +9,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
+	"net/http"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -22,8 +23,7 @@ import (
 
 const (
 	// VaultPeriodicTTL is the token role periodic TTL.
-	VaultPeriodicTTL        = 5 * 24 * 60 * 60
-	RenewLimitChannelBuffer = 10
+	VaultPeriodicTTL = 5 * 24 * 60 * 60
 )
 
 // Ensure we implement the broker API
@@ -36,13 +36,82 @@ type bindingInfo struct {
 	Binding      string
 	ClientToken  string
 	Accessor     string
-	stopCh       chan struct{}
+
+	// Mode is the binding mode the binding was created with. AuthPath and
+	// Role are the path of the auth method and the role created for bindings
+	// that are not token bindings.
+	Mode     string `json:",omitempty"`
+	AuthPath string `json:",omitempty"`
+	Role     string `json:",omitempty"`
+
+	// NumUses is the number of uses the token of a token binding was created
+	// with, or 0 for unlimited.
+	NumUses int `json:",omitempty"`
+
+	// RoleID is the role ID of AppRole bindings, and SecretIDAccessor the
+	// accessor of the secret ID created for them. The secret ID itself,
+	// secretID, is only kept until the credentials are returned, and never
+	// stored.
+	RoleID           string `json:",omitempty"`
+	SecretIDAccessor string `json:",omitempty"`
+	secretID         string
+
+	// Wrapped is true if the secret of the credentials was response-wrapped.
+	Wrapped bool `json:",omitempty"`
+
+	// Parameters are the parameters the binding was created with. They are
+	// nil for bindings created before the broker recorded them.
+	Parameters *bindingParameters `json:",omitempty"`
+
+	// Instance is the ID of the instance of the binding. Records created
+	// before the broker recorded it have it filled in when they are restored.
+	Instance string `json:",omitempty"`
+
+	// Health is the health of the binding's token, once renewing it failed.
+	Health *bindingHealth `json:",omitempty"`
 }
 
 type instanceInfo struct {
 	OrganizationGUID string
 	SpaceGUID        string
 	ApplicationGUID  string
+
+	// PlanID is the plan the instance was provisioned under, and Engines the
+	// engines that were mounted for it. Both are empty for instances
+	// provisioned before the broker supported multiple plans.
+	PlanID  string
+	Engines []string
+
+	// Parameters are the parameters the instance was provisioned with, or nil
+	// if none were given.
+	Parameters *instanceParameters `json:",omitempty"`
+
+	// LastOperation is the last asynchronous operation on the instance, or
+	// nil if the instance was provisioned synchronously.
+	LastOperation *operationInfo `json:",omitempty"`
+
+	// operation is the type of the synchronous operation in progress on the
+	// instance, if any. Unlike LastOperation, it is only kept in the cache.
+	operation string
+}
+
+// engines returns the engines mounted for the instance. Instances provisioned
+// before the broker supported multiple plans have every engine mounted.
+func (i *instanceInfo) engines() []string {
+	if len(i.Engines) == 0 {
+		return []string{EngineSecret, EngineTransit}
+	}
+	return i.Engines
+}
+
+// hasEngine returns true if the given engine is mounted for the instance.
+func (i *instanceInfo) hasEngine(engine string) bool {
+	for _, e := range i.engines() {
+		if e == engine {
+			return true
+		}
+	}
+	return false
 }
 
 type Broker struct {
@@ -55,11 +124,12 @@ type Broker struct {
 	serviceDescription string
 	serviceTags        []string
 
-	// plan-specific customization
-	planName         string
-	planDescription  string
-	planMetadataName string
-	planBullets      []string
+	// plans is the catalog of plans offered by the broker. Instances record
+	// the ID of the plan they were provisioned under.
+	plans []*Plan
+
+	// planUpdatable toggles whether instances may change plans.
+	planUpdatable bool
 
 	// metadata about the broker
 	displayName         string
@@ -73,9 +143,54 @@ type Broker struct {
 	// clients.
 	vaultAdvertiseAddr string
 
+	// kvVersion is the version of the KV secrets engine mounted for new secret
+	// backends, unless an instance asks for another version for its own.
+	kvVersion int
+
+	// appRolePath is the path of the AppRole auth method AppRole bindings are
+	// created in, and appRoleSecretIDNumUses the number of times their
+	// secret ID may be used, or 0 for unlimited.
+	appRolePath            string
+	appRoleSecretIDNumUses int
+
+	// certPath is the path of the cert auth method cert bindings are created
+	// in, and certCA the PEM-encoded CA certificate that issues the instance
+	// identity certificates of application containers.
+	certPath string
+	certCA   string
+
+	// jwtPath is the path of the JWT auth method JWT bindings are created
+	// in. jwtUserClaim and jwtBoundAudiences are the user claim and audiences
+	// of their roles.
+	jwtPath           string
+	jwtUserClaim      string
+	jwtBoundAudiences []string
+
+	// bindingPolicies are the policies bindings may request for their tokens
+	// in addition to the instance's policy.
+	bindingPolicies []string
+
+	// refuseDeprovisionWithBindings refuses to deprovision instances that are
+	// still bound, instead of revoking their bindings.
+	refuseDeprovisionWithBindings bool
+
+	// sharedMountCleanup is how the shared backends of organizations, spaces,
+	// and applications are cleaned up once nothing references them.
+	sharedMountCleanup string
+
+	// archiveInstances archives the secrets of an instance's secret backend
+	// before deprovisioning unmounts it, and archiveTTL is how long archives
+	// are kept before they are purged.
+	archiveInstances bool
+	archiveTTL       time.Duration
+
 	// vaultRenewToken toggles whether the broker should renew the supplied token.
 	vaultRenewToken bool
 
+	// logins, if set, logs the broker in to Vault again before its token
+	// expires, instead of renewing the supplied token.
+	logins *loginManager
+
 	// mountMutex is used to protect updates to the mount table
 	mountMutex sync.Mutex
 
@@ -88,14 +203,33 @@ type Broker struct {
 	instances     map[string]*instanceInfo
 	instancesLock sync.Mutex
 
+	// releasing are the shared backends being cleaned up, which may not be
+	// mounted again until they are. It is guarded by referencesLock, which
+	// also guards the records of the references to shared backends. It is
+	// acquired after instancesLock when both are held.
+	releasing      map[string]bool
+	referencesLock sync.Mutex
+
 	// stopLock, stopped, and stopCh are used to control the stopping behavior of
 	// the broker.
 	stopLock sync.Mutex
 	running  bool
 	stopCh   chan struct{}
 
-	// semaphore to limit concurrency during startup
-	sem chan struct{}
+	// startLock guards started and renewals, which the broker's health is
+	// served from while it starts, with stopLock held.
+	startLock sync.Mutex
+	started   bool
+
+	// renewals renews the tokens of bindings with renewalWorkers workers.
+	// recoverTokens replaces the tokens that expired or were revoked.
+	renewals       *renewalManager
+	renewalWorkers int
+	recoverTokens  bool
+
+	// requireClientCerts rejects the requests to the Open Service Broker API
+	// that were not made with a verified client certificate.
+	requireClientCerts bool
 }
 
 // Start is used to start the broker
@@ -114,11 +248,22 @@ func (b *Broker) Start() error {
 	// Create the stop channel
 	b.stopCh = make(chan struct{})
 
-	// Create the semaphore channel for rate limiting during restoreBind
-	b.sem = make(chan struct{}, RenewLimitChannelBuffer)
-
-	// Start background renewal
-	if b.vaultRenewToken {
+	// Start renewing the tokens of bindings
+	renewals := newRenewalManager(b.log, b.vaultClient, b.renewalWorkers)
+	renewals.failed = b.bindingTokenFailed
+	renewals.start(b.stopCh)
+	b.startLock.Lock()
+	b.renewals = renewals
+	b.startLock.Unlock()
+
+	// Start background renewal, or logins. Whatever the broker logs in with
+	// owns the renewal of its token.
+	if b.logins != nil {
+		if b.vaultRenewToken {
+			b.log.Printf("[INFO] not renewing the broker's token, it is replaced by logging in with %s", b.logins.method)
+		}
+		go b.logins.run(b.stopCh)
+	} else if b.vaultRenewToken {
 		go b.renewVaultToken()
 	}
 
@@ -132,48 +277,78 @@ func (b *Broker) Start() error {
 		b.instances = make(map[string]*instanceInfo)
 	}
 
-	// Ensure the generic secret backend at cf/broker is mounted.
-	mounts := map[string]string{
-		"cf/broker": "generic",
+	// Ensure the KV version 2 state backend is mounted.
+	mounts := map[string]*api.MountInput{
+		StateMount: kvMountInput(2),
 	}
-	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
+	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mountTypes(mounts), ", "))
 	if err := b.idempotentMount(mounts); err != nil {
 		return errors.Wrap(err, "failed to create mounts")
 	}
+	if err := b.waitForState(); err != nil {
+		return err
+	}
+
+	// Move the records of previous versions of the broker into the state
+	// backend.
+	if err := b.migrateLegacyState(); err != nil {
+		return errors.Wrap(err, "failed to migrate legacy state")
+	}
 
 	// Restore timers
 	b.log.Printf("[DEBUG] restoring bindings")
-	instances, err := b.listDir("cf/broker/")
+	keys, err := b.listState("")
 	if err != nil {
 		return errors.Wrap(err, "failed to list instances")
 	}
+	var instances []string
+	for _, k := range uniqueKeys(keys) {
+		if k != mountReferencesDir {
+			instances = append(instances, k)
+		}
+	}
 	for _, inst := range instances {
-		inst = strings.Trim(inst, "/")
-
 		if err := b.restoreInstance(inst); err != nil {
 			return errors.Wrapf(err, "failed to restore instance data for %q", inst)
 		}
 
-		binds, err := b.listDir("cf/broker/" + inst + "/")
+		binds, err := b.listState(inst + "/")
 		if err != nil {
 			return errors.Wrapf(err, "failed to list binds for instance %q", inst)
 		}
 
-		for _, bind := range binds {
-			bind = strings.Trim(bind, "/")
+		for _, bind := range uniqueKeys(binds) {
 			if err := b.restoreBind(inst, bind); err != nil {
 				return errors.Wrapf(err, "failed to restore bind %q", bind)
 			}
 		}
 	}
 
+	// Reference the shared backends of the restored instances and bindings,
+	// which brokers that did not track their references never recorded.
+	// References are only added here, so that none is lost.
+	if err := b.referenceRestoredMounts(); err != nil {
+		return errors.Wrap(err, "failed to reference shared mounts")
+	}
+
 	// Log our restore status
 	b.bindLock.Lock()
 	b.log.Printf("[INFO] restored %d binds and %d instances",
 		len(b.binds), len(instances))
 	b.bindLock.Unlock()
 
+	// Resume any operations interrupted by the last shutdown
+	b.resumeOperations()
+
+	// Purge the archives that expired while the broker was not running
+	if b.archiveInstances || b.sharedMountCleanup == SharedMountCleanupArchive {
+		b.purgeArchives()
+	}
+
 	b.running = true
+	b.startLock.Lock()
+	b.started = true
+	b.startLock.Unlock()
 
 	return nil
 }
@@ -182,24 +357,16 @@ func (b *Broker) Start() error {
 func (b *Broker) restoreInstance(instanceID string) error {
 	b.log.Printf("[INFO] restoring info for instance %s", instanceID)
 
-	path := "cf/broker/" + instanceID
-
-	secret, err := b.vaultClient.Logical().Read(path)
+	info := new(instanceInfo)
+	ok, err := b.restoreState(instanceID, recordKindInstance, info)
 	if err != nil {
-		return errors.Wrapf(err, "failed to read instance info at %q", path)
+		return errors.Wrapf(err, "failed to read instance info for %q", instanceID)
 	}
-	if secret == nil || len(secret.Data) == 0 {
-		b.log.Printf("[INFO] restoreInstance %s has no secret data", path)
+	if !ok {
+		b.log.Printf("[INFO] restoreInstance %s has no record", instanceID)
 		return nil
 	}
 
-	// Decode the binding info
-	b.log.Printf("[DEBUG] decoding bind data from %s", path)
-	info, err := decodeInstanceInfo(secret.Data)
-	if err != nil {
-		return errors.Wrapf(err, "failed to decode instance info for %s", path)
-	}
-
 	// Store the info
 	b.instancesLock.Lock()
 	b.instances[instanceID] = info
@@ -242,27 +409,24 @@ func (b *Broker) restoreBind(instanceID, bindingID string) error {
 		instanceID, bindingID)
 
 	// Read from Vault
-	path := "cf/broker/" + instanceID + "/" + bindingID
-	b.log.Printf("[DEBUG] reading bind from %s", path)
-	secret, err := b.vaultClient.Logical().Read(path)
+	path := instanceID + "/" + bindingID
+	info := new(bindingInfo)
+	ok, err := b.restoreState(path, recordKindBinding, info)
 	if err != nil {
 		return errors.Wrapf(err, "failed to read bind info at %q", path)
 	}
-	if secret == nil || len(secret.Data) == 0 {
-		b.log.Printf("[INFO] restoreBind %s has no secret data", path)
+	if !ok {
+		b.log.Printf("[INFO] restoreBind %s has no record", path)
 		return nil
 	}
-
-	// Decode the binding info
-	b.log.Printf("[DEBUG] decoding bind data from %s", path)
-	info, err := decodeBindingInfo(secret.Data)
-	if err != nil {
-		return errors.Wrapf(err, "failed to decode binding info for %s", path)
+	if info.Instance == "" {
+		info.Instance = instanceID
 	}
 
-	// Start a renewer for this token
-	info.stopCh = make(chan struct{})
-	go b.renewAuth(info.ClientToken, info.Accessor, info.stopCh)
+	// Queue the token for renewal
+	if info.renewable() {
+		b.renewals.add(info.ClientToken, info.Accessor)
+	}
 
 	// Store the info
 	b.bindLock.Lock()
@@ -286,11 +450,18 @@ func (b *Broker) Stop() error {
 	// Close the stop channel and mark as stopped
 	close(b.stopCh)
 	b.running = false
+	b.startLock.Lock()
+	b.started = false
+	b.startLock.Unlock()
 	return nil
 }
 
 func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 	b.log.Printf("[INFO] listing services")
+	plans := make([]brokerapi.ServicePlan, len(b.plans))
+	for i, p := range b.plans {
+		plans[i] = p.ServicePlan()
+	}
 	return []brokerapi.Service{
 		{
 			ID:            b.serviceID,
@@ -298,19 +469,8 @@ func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 			Description:   b.serviceDescription,
 			Tags:          b.serviceTags,
 			Bindable:      true,
-			PlanUpdatable: false,
-			Plans: []brokerapi.ServicePlan{
-				{
-					ID:          fmt.Sprintf("%s.%s", b.serviceID, b.planName),
-					Name:        b.planName,
-					Description: b.planDescription,
-					Free:        brokerapi.FreeValue(true),
-					Metadata: &brokerapi.ServicePlanMetadata{
-						DisplayName: b.planMetadataName,
-						Bullets:     b.planBullets,
-					},
-				},
-			},
+			PlanUpdatable: b.planUpdatable && len(b.plans) > 1,
+			Plans:         plans,
 			Metadata: &brokerapi.ServiceMetadata{
 				DisplayName:         b.displayName,
 				ImageUrl:            b.imageUrl,
@@ -323,118 +483,426 @@ func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 	}
 }
 
+// plan returns the plan with the given ID. An empty ID selects the first
+// plan in the catalog.
+func (b *Broker) plan(planID string) (*Plan, error) {
+	if len(b.plans) == 0 {
+		return nil, errors.New("no plans are configured")
+	}
+	if planID == "" {
+		return b.plans[0], nil
+	}
+	for _, p := range b.plans {
+		if p.ID == planID {
+			return p, nil
+		}
+	}
+	return nil, brokerapi.NewFailureResponse(
+		fmt.Errorf("unknown plan %q", planID), http.StatusBadRequest, "unknown-plan")
+}
+
 // Provision is used to setup a new instance of Vault tenant. For each
 // tenant we create a new Vault policy called "cf-instanceID". This is
 // granted access to the service, space, and org contexts. We then create
 // a token role called "cf-instanceID" which is periodic. Lastly, we mount
-// the backends for the instance, and optionally for the space and org if
-// they do not exist yet.
+// the backends of the instance's plan, and optionally for the space and org
+// if they do not exist yet. When the platform allows it, this work is done in
+// the background and its progress is reported by LastOperation.
 func (b *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, async bool) (brokerapi.ProvisionedServiceSpec, error) {
+	spec, _, err := b.provision(ctx, instanceID, details, async)
+	return spec, err
+}
+
+// provision provisions the instance, unless it already exists. It returns true
+// if the instance was already provisioned with the same attributes, which
+// makes retrying a request safe, and an ErrInstanceAlreadyExists if it was
+// provisioned with different ones. Instances whose provisioning failed are
+// provisioned again.
+func (b *Broker) provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, async bool) (brokerapi.ProvisionedServiceSpec, bool, error) {
 	b.log.Printf("[INFO] provisioning instance %s in %s/%s",
 		instanceID, details.OrganizationGUID, details.SpaceGUID)
 
 	// Create the spec to return
 	var spec brokerapi.ProvisionedServiceSpec
 
+	plan, err := b.plan(details.PlanID)
+	if err != nil {
+		return spec, false, b.error(err)
+	}
+
+	params, err := parseInstanceParameters(plan, details.RawParameters)
+	if err != nil {
+		return spec, false, b.error(err)
+	}
+
+	// Check the archive to restore before accepting the request, so that the
+	// platform learns of a bad one right away
+	var restoreErr error
+	if params != nil && params.Restore != "" {
+		_, _, restoreErr = b.restorableArchive(params.Restore, details.OrganizationGUID, details.SpaceGUID)
+	}
+
+	// Claim the instance in the same hold as the checks, so that no other
+	// operation on it starts until this one completes
+	b.instancesLock.Lock()
+	existing, ok := b.instances[instanceID]
+	exists := ok && !existing.provisionFailed()
+	same := exists && b.sameInstance(existing, plan, details, params)
+	op := ""
+	if exists {
+		op = existing.operationInProgress()
+	}
+	switch {
+	case !exists:
+	case !same:
+		b.instancesLock.Unlock()
+		return spec, false, b.error(brokerapi.ErrInstanceAlreadyExists)
+	case op == OperationProvision && async:
+		// The platform retried before the operation completed.
+		b.instancesLock.Unlock()
+		spec.IsAsync = true
+		spec.OperationData = OperationProvision
+		return spec, false, nil
+	case op != "":
+		b.instancesLock.Unlock()
+		return spec, false, b.error(ErrConcurrentOperation)
+	default:
+		b.instancesLock.Unlock()
+		b.log.Printf("[INFO] instance %s already exists with the same attributes", instanceID)
+		return spec, true, nil
+	}
+	if restoreErr != nil {
+		b.instancesLock.Unlock()
+		return spec, false, b.error(restoreErr)
+	}
+	if b.releasingAny(instanceSharedMounts(&instanceInfo{
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+	})) {
+		b.instancesLock.Unlock()
+		return spec, false, b.error(ErrConcurrentOperation)
+	}
+
 	info := &instanceInfo{
 		OrganizationGUID: details.OrganizationGUID,
 		SpaceGUID:        details.SpaceGUID,
+		PlanID:           plan.ID,
+		Engines:          params.engines(plan),
+		Parameters:       params,
+	}
+
+	if async {
+		err := b.startOperation(instanceID, info, &operationInfo{Type: OperationProvision})
+		b.instancesLock.Unlock()
+		if err != nil {
+			return spec, false, err
+		}
+		spec.IsAsync = true
+		spec.OperationData = OperationProvision
+		return spec, false, nil
 	}
 
+	info.operation = OperationProvision
+	b.instances[instanceID] = info
+	b.instancesLock.Unlock()
+
+	err = b.provisionInstance(instanceID, info)
+	b.endOperation(instanceID, info, existing, err)
+	if err != nil {
+		return spec, false, err
+	}
+
+	// Done
+	return spec, false, nil
+}
+
+// sameInstance returns true if the existing instance was provisioned with the
+// given plan, organization, space, and parameters. It must be called with
+// instancesLock held.
+func (b *Broker) sameInstance(existing *instanceInfo, plan *Plan, details brokerapi.ProvisionDetails, params *instanceParameters) bool {
+	existingPlan, err := b.plan(existing.PlanID)
+	if err != nil {
+		return false
+	}
+	return existingPlan.ID == plan.ID &&
+		existing.OrganizationGUID == details.OrganizationGUID &&
+		existing.SpaceGUID == details.SpaceGUID &&
+		existing.Parameters.equal(params)
+}
+
+// provisionInstance mounts the backends of the instance and creates its
+// policy and token role, then stores the instance. Each step is idempotent.
+func (b *Broker) provisionInstance(instanceID string, info *instanceInfo) error {
 	// Determine the mounts we need
 	// Note that in the Bind method we also add application-level mounts,
 	// but we don't here because we haven't received an application GUID yet
-	mounts := map[string]string{
-		"/cf/" + info.OrganizationGUID + "/secret": "generic",
-		"/cf/" + info.SpaceGUID + "/secret":        "generic",
-		"/cf/" + instanceID + "/secret":            "generic",
-		"/cf/" + instanceID + "/transit":           "transit",
+	mounts := make(map[string]*api.MountInput)
+	for _, e := range info.engines() {
+		mounts["/cf/"+instanceID+"/"+e] = info.Parameters.mountInput(e, b.defaultKVVersion())
+	}
+	mounts["/cf/"+info.OrganizationGUID+"/secret"] = kvMountInput(b.defaultKVVersion())
+	mounts["/cf/"+info.SpaceGUID+"/secret"] = kvMountInput(b.defaultKVVersion())
+
+	// Reference the shared backends before mounting them, so that they are
+	// not cleaned up from under the instance
+	if err := b.acquireMounts(instanceID, instanceSharedMounts(info)); err != nil {
+		return err
 	}
 
 	// Mount the backends
-	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
+	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mountTypes(mounts), ", "))
 	if err := b.idempotentMount(mounts); err != nil {
-		return spec, b.wErrorf(err, "failed to create mounts %s", mapToKV(mounts, ", "))
+		return b.wErrorf(err, "failed to create mounts %s", mapToKV(mountTypes(mounts), ", "))
 	}
 
-	// Generate instance info
-	payload, err := json.Marshal(info)
-	if err != nil {
-		return spec, b.wErrorf(err, "failed to encode instance json")
+	// Restore the secrets of the archived instance the instance replaces
+	if info.Parameters != nil && info.Parameters.Restore != "" {
+		if err := b.restoreArchive(info.Parameters.Restore, instanceID, info); err != nil {
+			return err
+		}
 	}
 
-	// Store the token and metadata in the generic secret backend
-	instancePath := "cf/broker/" + instanceID
-	b.log.Printf("[DEBUG] storing instance metadata at %s", instancePath)
-	if _, err := b.vaultClient.Logical().Write(instancePath, map[string]interface{}{
-		"json": string(payload),
-	}); err != nil {
-		return spec, b.wErrorf(err, "failed to commit instance %s", instancePath)
+	// Create the policy and token role
+	if err := b.putPolicy(instanceID, info); err != nil {
+		return err
+	}
+	if err := b.putTokenRole(instanceID); err != nil {
+		return err
+	}
+
+	// Store and save the instance
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+	return b.storeInstance(instanceID, info)
+}
+
+// storeInstance stores the instance info in the state backend and saves it to
+// the cache. It must be called with instancesLock held.
+func (b *Broker) storeInstance(instanceID string, info *instanceInfo) error {
+	if err := b.writeState(instanceID, recordKindInstance, info); err != nil {
+		return b.wErrorf(err, "failed to commit instance %s", instanceID)
 	}
 
 	// Save the instance
 	b.log.Printf("[DEBUG] saving instance %s to cache", instanceID)
-	b.instancesLock.Lock()
 	b.instances[instanceID] = info
-	b.instancesLock.Unlock()
+	return nil
+}
 
-	// Done
-	return spec, nil
+// putPolicy generates and writes the "cf-instanceID" policy.
+func (b *Broker) putPolicy(instanceID string, info *instanceInfo) error {
+	// Determine the KV versions of the secret backends
+	versions, err := b.kvVersions(instanceID, info)
+	if err != nil {
+		return b.wErrorf(err, "failed to determine KV versions for %s", instanceID)
+	}
+
+	// Generate the new policy
+	var buf bytes.Buffer
+	b.log.Printf("[DEBUG] generating policy for %s", instanceID)
+	templateInfo := &ServicePolicyTemplateInput{
+		InstanceID:           instanceID,
+		SpaceID:              info.SpaceGUID,
+		OrgID:                info.OrganizationGUID,
+		ApplicationID:        info.ApplicationGUID,
+		Engines:              info.engines(),
+		InstanceKVVersion:    versions["cf/"+instanceID+"/secret"],
+		SpaceKVVersion:       versions["cf/"+info.SpaceGUID+"/secret"],
+		OrgKVVersion:         versions["cf/"+info.OrganizationGUID+"/secret"],
+		ApplicationKVVersion: versions["cf/"+info.ApplicationGUID+"/secret"],
+	}
+	if err := GeneratePolicy(&buf, templateInfo); err != nil {
+		return b.wErrorf(err, "failed to generate policy for %s", instanceID)
+	}
+
+	// Create the new policy
+	policyName := "cf-" + instanceID
+	b.log.Printf("[DEBUG] creating new policy %s", policyName)
+	if err := b.vaultClient.Sys().PutPolicy(policyName, buf.String()); err != nil {
+		return b.wErrorf(err, "failed to create policy %s", policyName)
+	}
+	return nil
+}
+
+// putTokenRole writes the periodic "cf-instanceID" token role. Its tokens may
+// only have the instance's policy and the policies bindings are allowed to
+// request.
+func (b *Broker) putTokenRole(instanceID string) error {
+	policyName := "cf-" + instanceID
+	tokenRolePath := "/auth/token/roles/cf-" + instanceID
+	tokenData := map[string]interface{}{
+		"allowed_policies": append([]string{policyName}, b.bindingPolicies...),
+		"period":           VaultPeriodicTTL,
+		"renewable":        true,
+	}
+	b.log.Printf("[DEBUG] creating new token role for %s", tokenRolePath)
+	if _, err := b.vaultClient.Logical().Write(tokenRolePath, tokenData); err != nil {
+		return b.wErrorf(err, "failed to create token role for %s", tokenRolePath)
+	}
+	return nil
 }
 
 // Deprovision is used to remove a tenant of Vault. We use this to
 // remove all the backends of the tenant, delete the token role, and policy.
+// When the platform allows it, this work is done in the background and its
+// progress is reported by LastOperation.
 func (b *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, async bool) (brokerapi.DeprovisionServiceSpec, error) {
 	b.log.Printf("[INFO] deprovisioning %s", instanceID)
 
 	// Create the spec to return
 	var spec brokerapi.DeprovisionServiceSpec
 
+	// Claim the instance in the same hold as the checks, so that no other
+	// operation on it starts until this one completes
 	b.instancesLock.Lock()
-	defer b.instancesLock.Unlock()
+	instance, ok := b.instances[instanceID]
+	if ok && instance.inProgress() {
+		b.instancesLock.Unlock()
+		return spec, b.error(ErrConcurrentOperation)
+	}
+
+	// Refuse to delete an instance that is still bound if configured to,
+	// rather than revoking its bindings
+	if b.refuseDeprovisionWithBindings {
+		bindings, err := b.instanceBindings(instanceID)
+		if err != nil {
+			b.instancesLock.Unlock()
+			return spec, err
+		}
+		if len(bindings) > 0 {
+			b.instancesLock.Unlock()
+			return spec, b.error(ErrInstanceHasBindings)
+		}
+	}
+
+	// Determine the engines mounted for the instance. If the broker does not
+	// know about the instance, fall back to the plan it was requested under,
+	// or to every engine if that plan is no longer in the catalog.
+	engines := (&instanceInfo{}).engines()
+	if ok {
+		engines = instance.engines()
+	} else if plan, err := b.plan(details.PlanID); err == nil {
+		engines = plan.Engines
+	}
+
+	// There is no state to report progress with for unknown instances, so
+	// they are always cleaned up synchronously.
+	if async && ok {
+		err := b.startOperation(instanceID, instance, &operationInfo{Type: OperationDeprovision})
+		b.instancesLock.Unlock()
+		if err != nil {
+			return spec, err
+		}
+		spec.IsAsync = true
+		spec.OperationData = OperationDeprovision
+		return spec, nil
+	}
+
+	if ok {
+		instance.operation = OperationDeprovision
+	}
+	b.instancesLock.Unlock()
+
+	err := b.deprovisionInstance(instanceID, engines)
+	if ok {
+		b.endOperation(instanceID, instance, instance, err)
+	}
+	if err != nil {
+		return spec, err
+	}
+
+	// Done!
+	return spec, nil
+}
+
+// deprovisionInstance revokes the bindings of the instance, unmounts the given
+// engines of the instance, and deletes its token role, policy, and info. Each
+// step is idempotent.
+func (b *Broker) deprovisionInstance(instanceID string, engines []string) error {
+	// The operation in progress on the instance keeps it from changing, so
+	// the lock is only held to read its info, and to remove it once its
+	// backends are gone.
+	b.instancesLock.Lock()
+	info := b.instances[instanceID]
+	b.instancesLock.Unlock()
+
+	// Revoke the bindings the platform did not unbind first
+	bindings, err := b.instanceBindings(instanceID)
+	if err != nil {
+		return err
+	}
+	for _, bindingID := range bindings {
+		b.log.Printf("[DEBUG] unbinding binding %s of instance %s", bindingID, instanceID)
+		if err := b.unbind(instanceID, bindingID); err != nil {
+			return err
+		}
+	}
+
+	// Archive the secrets of the instance before they are destroyed
+	for _, e := range engines {
+		if e != EngineSecret || !b.archiveInstances {
+			continue
+		}
+		if err := b.archiveInstance(instanceID, info); err != nil {
+			return err
+		}
+	}
 
 	// Unmount the backends
-	mounts := []string{
-		"/cf/" + instanceID + "/secret",
-		"/cf/" + instanceID + "/transit",
+	mounts := make([]string, len(engines))
+	for i, e := range engines {
+		mounts[i] = "/cf/" + instanceID + "/" + e
 	}
 	b.log.Printf("[DEBUG] removing mounts %s", strings.Join(mounts, ", "))
 	if err := b.idempotentUnmount(mounts); err != nil {
-		return spec, b.wErrorf(err, "failed to remove mounts")
+		return b.wErrorf(err, "failed to remove mounts")
 	}
 
 	// Delete the token role
 	path := "/auth/token/roles/cf-" + instanceID
 	b.log.Printf("[DEBUG] deleting token role %s", path)
 	if _, err := b.vaultClient.Logical().Delete(path); err != nil {
-		return spec, b.wErrorf(err, "failed to delete token role %s", path)
+		return b.wErrorf(err, "failed to delete token role %s", path)
 	}
 
 	// Delete the token policy
 	policyName := "cf-" + instanceID
 	b.log.Printf("[DEBUG] deleting policy %s", policyName)
 	if err := b.vaultClient.Sys().DeletePolicy(policyName); err != nil {
-		return spec, b.wErrorf(err, "failed to delete policy %s", policyName)
+		return b.wErrorf(err, "failed to delete policy %s", policyName)
 	}
 
 	// Delete the instance info
-	instancePath := "cf/broker/" + instanceID
-	b.log.Printf("[DEBUG] deleting instance info at %s", instancePath)
-	if _, err := b.vaultClient.Logical().Delete(instancePath); err != nil {
-		return spec, b.wErrorf(err, "failed to delete instance info at %s", instancePath)
+	if err := b.deleteState(instanceID); err != nil {
+		return b.wErrorf(err, "failed to delete instance info for %s", instanceID)
 	}
 
 	// Delete the instance from the map
 	b.log.Printf("[DEBUG] removing instance %s from cache", instanceID)
+	b.instancesLock.Lock()
 	delete(b.instances, instanceID)
+	b.instancesLock.Unlock()
 
-	// Done!
-	return spec, nil
+	// Release the shared backends of the instance, which are cleaned up if
+	// nothing references them anymore
+	if info != nil {
+		b.releaseMounts(instanceID, instanceSharedMounts(info))
+	}
+	return nil
 }
 
 // Bind is used to attach a tenant of Vault to an application in CloudFoundry.
 // This should create a credential that is used to authorize against Vault.
 func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	binding, _, err := b.bind(ctx, instanceID, bindingID, details)
+	return binding, err
+}
+
+// bind binds the instance, unless the binding already exists. It returns true
+// if the binding was already created with the same attributes, along with its
+// credentials, which makes retrying a request safe, and an
+// ErrBindingAlreadyExists if it was created with different ones.
+func (b *Broker) bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, bool, error) {
 	b.log.Printf("[INFO] binding service %s to instance %s",
 		bindingID, instanceID)
 
@@ -448,72 +916,79 @@ func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details
 
 	instance, ok := b.instances[instanceID]
 	if !ok {
-		return binding, b.errorf("no instance exists with ID %s", instanceID)
+		return binding, false, b.error(brokerapi.ErrInstanceDoesNotExist)
+	}
+	if instance.inProgress() {
+		return binding, false, b.error(ErrConcurrentOperation)
+	}
+	if instance.provisionFailed() {
+		return binding, false, b.errorf("instance %s is unusable after its last %s operation failed", instanceID, OperationProvision)
+	}
+	plan, err := b.plan(instance.PlanID)
+	if err != nil {
+		return binding, false, b.error(err)
+	}
+	params, err := parseBindingParameters(plan, details.RawParameters, b.bindingPolicies)
+	if err != nil {
+		return binding, false, b.error(err)
+	}
+
+	// Respond with an existing binding rather than creating another token or
+	// role for it
+	path := instanceID + "/" + bindingID
+	existing, err := b.existingBinding(instanceID, bindingID)
+	if err != nil {
+		return binding, false, err
+	}
+	if existing != nil {
+		if existing.Application != details.AppGUID || !reflect.DeepEqual(existing.params(), params) {
+			return binding, false, b.error(brokerapi.ErrBindingAlreadyExists)
+		}
+		b.log.Printf("[INFO] binding %s already exists with the same attributes", path)
+		binding, err := b.existingCredentials(ctx, instanceID, instance, existing, params)
+		return binding, true, err
 	}
 
+	created := false
 	if details.AppGUID != "" {
+		// Reference the application-level backends before mounting them, so
+		// that they are not cleaned up from under the binding. The reference
+		// is released again if the binding is not created.
+		shared := applicationMounts(details.AppGUID, instance.OrganizationGUID, instance.SpaceGUID)
+		if err := b.acquireMounts(path, shared); err != nil {
+			return binding, false, err
+		}
+		defer func() {
+			if !created {
+				b.releaseMounts(path, shared)
+			}
+		}()
+
 		// The details.AppGUID isn't _required_ to be provided per the Open Service Broker API spec
 		instance.ApplicationGUID = details.AppGUID
 
-		// Ensure we have application-level mounts
-		mounts := map[string]string{
-			"/cf/" + instance.ApplicationGUID + "/secret":  "generic",
-			"/cf/" + instance.ApplicationGUID + "/transit": "transit",
+		// Ensure we have application-level mounts for the instance's engines
+		mounts := make(map[string]*api.MountInput)
+		for _, e := range instance.engines() {
+			mounts["/cf/"+instance.ApplicationGUID+"/"+e] = b.appMountInput(e)
 		}
 
 		// Mount the application-level backends
-		b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
+		b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mountTypes(mounts), ", "))
 		if err := b.idempotentMount(mounts); err != nil {
-			return binding, b.wErrorf(err, "failed to create mounts %s", mapToKV(mounts, ", "))
+			return binding, false, b.wErrorf(err, "failed to create mounts %s", mapToKV(mountTypes(mounts), ", "))
 		}
 	}
 
-	// Generate the new policy
-	var buf bytes.Buffer
-	b.log.Printf("[DEBUG] generating policy for %s", instanceID)
-	templateInfo := &ServicePolicyTemplateInput{
-		InstanceID:    instanceID,
-		SpaceID:       instance.SpaceGUID,
-		OrgID:         instance.OrganizationGUID,
-		ApplicationID: instance.ApplicationGUID,
-	}
-	if err := GeneratePolicy(&buf, templateInfo); err != nil {
-		return binding, b.wErrorf(err, "failed to generate policy for %s", instanceID)
-	}
-
-	// Create the new policy
-	policyName := "cf-" + instanceID
-	b.log.Printf("[DEBUG] creating new policy %s", policyName)
-	if err := b.vaultClient.Sys().PutPolicy(policyName, buf.String()); err != nil {
-		return binding, b.wErrorf(err, "failed to create policy %s", policyName)
+	// Regenerate the policy to grant access to the application's backends
+	if err := b.putPolicy(instanceID, instance); err != nil {
+		return binding, false, err
 	}
 
-	// Create the new token role
-	tokenRolePath := "/auth/token/roles/cf-" + instanceID
-	tokenData := map[string]interface{}{
-		"allowed_policies": policyName,
-		"period":           VaultPeriodicTTL,
-		"renewable":        true,
-	}
-	b.log.Printf("[DEBUG] creating new token role for %s", tokenRolePath)
-	if _, err := b.vaultClient.Logical().Write(tokenRolePath, tokenData); err != nil {
-		return binding, b.wErrorf(err, "failed to create token role for %s", tokenRolePath)
-	}
-
-	// Create the token
-	renewable := true
-	b.log.Printf("[DEBUG] creating token with role %s", policyName)
-	secret, err := b.vaultClient.Auth().Token().CreateWithRole(&api.TokenCreateRequest{
-		Policies:    []string{policyName},
-		Metadata:    map[string]string{"cf-instance-id": instanceID, "cf-binding-id": bindingID},
-		DisplayName: "cf-bind-" + bindingID,
-		Renewable:   &renewable,
-	}, policyName)
+	// Determine the KV versions to report in the credentials
+	versions, err := b.kvVersions(instanceID, instance)
 	if err != nil {
-		return binding, b.wErrorf(err, "failed to create token with role %s", policyName)
-	}
-	if secret.Auth == nil {
-		return binding, b.errorf("secret with role %s has no auth", policyName)
+		return binding, false, b.wErrorf(err, "failed to determine KV versions for %s", instanceID)
 	}
 
 	// Create a binding info object
@@ -522,30 +997,57 @@ func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details
 		Space:        instance.SpaceGUID,
 		Application:  details.AppGUID,
 		Binding:      bindingID,
-		ClientToken:  secret.Auth.ClientToken,
-		Accessor:     secret.Auth.Accessor,
+		Mode:         plan.bindingMode(),
+		Parameters:   params,
+		Instance:     instanceID,
 	}
-	data, err := json.Marshal(info)
-	if err != nil {
-		return binding, b.wErrorf(err, "failed to encode binding json")
+
+	// Grant access according to the plan's binding mode
+	switch info.Mode {
+	case BindingModeAppRole:
+		if err := b.bindAppRole(instanceID, bindingID, info, params); err != nil {
+			return binding, false, err
+		}
+	case BindingModeCert:
+		if err := b.bindCert(instanceID, bindingID, info, params); err != nil {
+			return binding, false, err
+		}
+	case BindingModeJWT:
+		if err := b.bindJWT(instanceID, bindingID, info, params); err != nil {
+			return binding, false, err
+		}
+	default:
+		if err := b.bindToken(instanceID, bindingID, info, params); err != nil {
+			return binding, false, err
+		}
+	}
+
+	// Wrap the secret of the credentials if asked to
+	auth := info.auth()
+	info.secretID = ""
+	if params.WrapTTL != "" {
+		if err := b.wrapCredentials(ctx, auth, params.WrapTTL); err != nil {
+			if err := b.revokeBinding(info); err != nil {
+				b.log.Printf("[WARN] failed to revoke binding %s: %s", path, err)
+			}
+			return binding, false, err
+		}
+		info.Wrapped = true
 	}
 
-	// Store the token and metadata in the generic secret backend
-	path := "cf/broker/" + instanceID + "/" + bindingID
-	b.log.Printf("[DEBUG] storing binding metadata at %s", path)
-	if _, err := b.vaultClient.Logical().Write(path, map[string]interface{}{
-		"json": string(data),
-	}); err != nil {
-		a := secret.Auth.Accessor
-		if err := b.vaultClient.Auth().Token().RevokeAccessor(a); err != nil {
-			b.log.Printf("[WARN] failed to revoke accessor %s", a)
+	// Store the binding info in the state backend
+	if err := b.writeState(path, recordKindBinding, info); err != nil {
+		if err := b.revokeBinding(info); err != nil {
+			b.log.Printf("[WARN] failed to revoke binding %s: %s", path, err)
 		}
-		return binding, errors.Wrapf(err, "failed to commit binding %s", path)
+		return binding, false, errors.Wrapf(err, "failed to commit binding %s", path)
 	}
+	created = true
 
-	// Setup Renew timer
-	info.stopCh = make(chan struct{})
-	go b.renewAuth(info.ClientToken, info.Accessor, info.stopCh)
+	// Queue the token for renewal
+	if info.renewable() {
+		b.renewals.add(info.ClientToken, info.Accessor)
+	}
 
 	// Store the info
 	b.log.Printf("[DEBUG] saving bind %s to cache", bindingID)
@@ -554,29 +1056,8 @@ func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details
 	b.binds[bindingID] = info
 
 	// Save the credentials
-	genericBackends := []string{"cf/" + instanceID + "/secret"}
-	transitBackends := []string{"cf/" + instanceID + "/transit"}
-	if instance.ApplicationGUID != "" {
-		genericBackends = append(genericBackends, "cf/"+instance.ApplicationGUID+"/secret")
-		transitBackends = append(transitBackends, "cf/"+instance.ApplicationGUID+"/transit")
-	}
-	binding.Credentials = map[string]interface{}{
-		"address": b.vaultAdvertiseAddr,
-		"auth": map[string]interface{}{
-			"accessor": secret.Auth.Accessor,
-			"token":    secret.Auth.ClientToken,
-		},
-		"backends": map[string]interface{}{
-			"generic": genericBackends,
-			"transit": transitBackends,
-		},
-		"backends_shared": map[string]interface{}{
-			"organization": "cf/" + instance.OrganizationGUID + "/secret",
-			"space":        "cf/" + instance.SpaceGUID + "/secret",
-			"application":  "cf/" + instance.ApplicationGUID + "/secret",
-		},
-	}
-	return binding, nil
+	binding.Credentials = b.credentials(instanceID, instance, instance.ApplicationGUID, auth, versions)
+	return binding, false, nil
 }
 
 // Unbind is used to detach an applicaiton from a tenant in Vault.
@@ -584,77 +1065,297 @@ func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, detai
 	b.log.Printf("[INFO] unbinding service %s for instance %s",
 		bindingID, instanceID)
 
-	// Read the binding info
-	path := "cf/broker/" + instanceID + "/" + bindingID
-	b.log.Printf("[DEBUG] reading %s", path)
-	secret, err := b.vaultClient.Logical().Read(path)
+	return b.unbind(instanceID, bindingID)
+}
+
+// unbind revokes the binding and deletes its info, then releases the shared
+// backends of its application. It must be called without instancesLock held.
+func (b *Broker) unbind(instanceID, bindingID string) error {
+	path := instanceID + "/" + bindingID
+	info, err := b.removeBinding(instanceID, bindingID)
 	if err != nil {
-		return b.wErrorf(err, "failed to read binding info for %s", path)
+		return err
 	}
-	if secret == nil || len(secret.Data) == 0 {
-		// The secret was already deleted previously, nothing further to do.
-		b.log.Printf("[WARN] secret appears to have been deleted previously, unbinding")
-		return b.deleteBinding(bindingID, path)
+
+	// Release the shared backends of the application, which are cleaned up
+	// if nothing references them anymore
+	if info != nil && info.Application != "" {
+		b.releaseMounts(path, applicationMounts(info.Application, info.Organization, info.Space))
 	}
+	return nil
+}
 
-	// Decode the binding info
-	b.log.Printf("[DEBUG] decoding binding info for %s", path)
-	info, err := decodeBindingInfo(secret.Data)
+// removeBinding revokes the binding and deletes its info, which it returns, or
+// nil if the binding had no info. The lock is held throughout, so that the
+// token of the binding is not replaced while it is revoked, which would leave
+// the new token behind.
+func (b *Broker) removeBinding(instanceID, bindingID string) (*bindingInfo, error) {
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	// Read the binding info
+	path := instanceID + "/" + bindingID
+	info := new(bindingInfo)
+	ok, err := b.readState(path, recordKindBinding, info)
 	if err != nil {
-		return b.wErrorf(err, "failed to decode binding info for %s", path)
+		return nil, b.wErrorf(err, "failed to read binding info for %s", path)
+	}
+	if !ok {
+		// The record was already deleted previously, nothing further to do.
+		b.log.Printf("[WARN] binding record appears to have been deleted previously, unbinding")
+		return nil, b.deleteBinding(bindingID, path)
 	}
 
-	// Revoke the token
-	a := info.Accessor
-	b.log.Printf("[DEBUG] revoking accessor %s for path %s", a, path)
-	if err := b.vaultClient.Auth().Token().RevokeAccessor(a); err != nil {
-		if strings.Contains(err.Error(), "invalid accessor") {
-			// The token has already been revoked or has expired.
-			b.log.Printf("[WARN] token has already been revoked or has expired, unbinding")
-			return b.deleteBinding(bindingID, path)
-		}
-		return b.wErrorf(err, "failed to revoke accessor %s", a)
+	// Revoke the token or role
+	b.log.Printf("[DEBUG] revoking %s binding %s", info.mode(), path)
+	if err := b.revokeBinding(info); err != nil {
+		return nil, err
 	}
-	return b.deleteBinding(bindingID, path)
+	return info, b.deleteBinding(bindingID, path)
 }
 
 func (b *Broker) deleteBinding(bindingID, path string) error {
 	// Delete the binding info
-	b.log.Printf("[DEBUG] deleting binding info at %s", path)
-	if _, err := b.vaultClient.Logical().Delete(path); err != nil {
+	if err := b.deleteState(path); err != nil {
 		return b.wErrorf(err, "failed to delete binding info at %s", path)
 	}
 
-	// Delete the bind if it exists, stopping any renewers
+	// Delete the bind if it exists, stopping the renewal of its token
 	b.log.Printf("[DEBUG] removing binding %s from cache", bindingID)
 	b.bindLock.Lock()
 	existing, ok := b.binds[bindingID]
 	if ok {
 		delete(b.binds, bindingID)
-		if existing.stopCh != nil {
-			close(existing.stopCh)
+		if existing.renewable() {
+			b.renewals.stop(existing.Accessor)
 		}
 	}
 	b.bindLock.Unlock()
 	return nil
 }
 
-// Not implemented, only used for multiple plans
+// Update is used to move an instance to another plan, or to tune its mounts.
+// The engines of the new plan are mounted, and the policy and token role are
+// regenerated. Engines the new plan drops stay mounted, unless the
+// unmount_dropped parameter asks for them to be unmounted. When the platform
+// allows it, this work is done in the background and its progress is reported
+// by LastOperation.
 func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, async bool) (brokerapi.UpdateServiceSpec, error) {
 	b.log.Printf("[INFO] updating service for instance %s", instanceID)
-	return brokerapi.UpdateServiceSpec{}, nil
+
+	// Create the spec to return
+	var spec brokerapi.UpdateServiceSpec
+
+	// Claim the instance in the same hold as the checks, so that no other
+	// operation on it starts until this one completes, and the update applies
+	// to its current info
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	if !ok {
+		b.instancesLock.Unlock()
+		return spec, b.error(brokerapi.ErrInstanceDoesNotExist)
+	}
+	if instance.inProgress() {
+		b.instancesLock.Unlock()
+		return spec, b.error(ErrConcurrentOperation)
+	}
+	updated, op, err := b.planUpdate(instanceID, instance, details)
+	if err != nil || updated == nil {
+		b.instancesLock.Unlock()
+		return spec, err
+	}
+
+	if async {
+		err := b.startOperation(instanceID, updated, op)
+		b.instancesLock.Unlock()
+		if err != nil {
+			return spec, err
+		}
+		spec.IsAsync = true
+		spec.OperationData = OperationUpdate
+		return spec, nil
+	}
+
+	instance.operation = OperationUpdate
+	updated.operation = OperationUpdate
+	b.instancesLock.Unlock()
+
+	err = b.updateInstance(instanceID, updated, op.Unmount, op.Tune)
+	b.endOperation(instanceID, updated, instance, err)
+	if err != nil {
+		return spec, err
+	}
+
+	// Done
+	return spec, nil
+}
+
+// planUpdate returns the updated info of the instance and the update operation
+// that applies it, or nil if the instance needs no update. It must be called
+// with instancesLock held.
+func (b *Broker) planUpdate(instanceID string, instance *instanceInfo, details brokerapi.UpdateDetails) (*instanceInfo, *operationInfo, error) {
+	updated := *instance
+
+	// Instances provisioned before the broker supported multiple plans are
+	// on the first plan.
+	current, err := b.plan(updated.PlanID)
+	if err != nil {
+		return nil, nil, b.error(err)
+	}
+	plan := current
+	if details.PlanID != "" && details.PlanID != current.ID {
+		if !b.planUpdatable {
+			return nil, nil, b.error(brokerapi.ErrPlanChangeNotSupported)
+		}
+		if plan, err = b.plan(details.PlanID); err != nil {
+			return nil, nil, b.error(err)
+		}
+	}
+
+	params, err := parseUpdateParameters(plan, details.RawParameters)
+	if err != nil {
+		return nil, nil, b.error(err)
+	}
+	tuned, tune := params.tune(updated.Parameters)
+	if tune {
+		if err := tuned.validateTuning(); err != nil {
+			return nil, nil, b.error(errInvalidParameters(err))
+		}
+	}
+
+	// Determine the engines to mount for the new plan, and those to unmount.
+	// Engines kept from previous plans are unmounted by a later update that
+	// asks for it, even if it keeps the plan.
+	engines := updated.Parameters.engines(plan)
+	var unmount []string
+	for _, e := range updated.engines() {
+		if plan.HasEngine(e) {
+			continue
+		}
+		if params.UnmountDropped {
+			unmount = append(unmount, e)
+		} else {
+			b.log.Printf("[DEBUG] keeping engine %s of instance %s mounted", e, instanceID)
+			engines = append(engines, e)
+		}
+	}
+	if plan == current && len(unmount) == 0 && !tune {
+		b.log.Printf("[DEBUG] instance %s is already on plan %s", instanceID, plan.Name)
+		return nil, nil, nil
+	}
+	updated.PlanID = plan.ID
+	updated.Engines = engines
+	updated.Parameters = tuned
+
+	return &updated, &operationInfo{
+		Type:    OperationUpdate,
+		Unmount: unmount,
+		Tune:    tune,
+	}, nil
+}
+
+// updateInstance mounts the backends of the instance, unmounts the given
+// engines, tunes its mounts to its parameters if asked to, and regenerates its
+// policy and token role, then stores the instance. Each step is idempotent.
+func (b *Broker) updateInstance(instanceID string, info *instanceInfo, unmount []string, tune bool) error {
+	mounts := make(map[string]*api.MountInput)
+	for _, e := range info.engines() {
+		mounts["/cf/"+instanceID+"/"+e] = info.Parameters.mountInput(e, b.defaultKVVersion())
+		if info.ApplicationGUID != "" {
+			mounts["/cf/"+info.ApplicationGUID+"/"+e] = b.appMountInput(e)
+		}
+	}
+
+	// Mount the backends
+	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mountTypes(mounts), ", "))
+	if err := b.idempotentMount(mounts); err != nil {
+		return b.wErrorf(err, "failed to create mounts %s", mapToKV(mountTypes(mounts), ", "))
+	}
+
+	// Tune the backends that were already mounted
+	if tune {
+		config := info.Parameters.tuneData()
+		for _, e := range info.engines() {
+			path := "cf/" + instanceID + "/" + e
+			b.log.Printf("[DEBUG] tuning mount %s", path)
+			if _, err := b.vaultClient.Logical().Write("sys/mounts/"+path+"/tune", config); err != nil {
+				return b.wErrorf(err, "failed to tune mount %s", path)
+			}
+		}
+	}
+
+	// Unmount the dropped backends
+	if len(unmount) > 0 {
+		paths := make([]string, len(unmount))
+		for i, e := range unmount {
+			paths[i] = "/cf/" + instanceID + "/" + e
+		}
+		b.log.Printf("[DEBUG] removing mounts %s", strings.Join(paths, ", "))
+		if err := b.idempotentUnmount(paths); err != nil {
+			return b.wErrorf(err, "failed to remove mounts")
+		}
+	}
+
+	// Regenerate the policy and token role
+	if err := b.putPolicy(instanceID, info); err != nil {
+		return err
+	}
+	if err := b.putTokenRole(instanceID); err != nil {
+		return err
+	}
+
+	// Store and save the instance
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+	return b.storeInstance(instanceID, info)
 }
 
-// Not implemented, only used for async
+// LastOperation reports the state of the last asynchronous operation on the
+// instance. Once an instance is deprovisioned it no longer exists, which is
+// how the platform learns a deprovision operation completed.
 func (b *Broker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
 	b.log.Printf("[INFO] returning last operation for instance %s", instanceID)
-	return brokerapi.LastOperation{}, nil
+
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	instance, ok := b.instances[instanceID]
+	if !ok {
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	// Synchronous operations are reported while they are in progress, and
+	// instances provisioned synchronously have succeeded.
+	if instance.operation != "" {
+		return brokerapi.LastOperation{
+			State:       brokerapi.InProgress,
+			Description: instance.operation + " in progress",
+		}, nil
+	}
+	op := instance.LastOperation
+	if op == nil {
+		return brokerapi.LastOperation{State: brokerapi.Succeeded}, nil
+	}
+	return brokerapi.LastOperation{
+		State:       op.State,
+		Description: op.Description,
+	}, nil
+}
+
+// appMountInput returns the input used to mount the given engine at
+// "cf/<app_id>/<engine>", which is shared by every instance bound to the
+// application.
+func (b *Broker) appMountInput(engine string) *api.MountInput {
+	if engine == EngineSecret {
+		return kvMountInput(b.defaultKVVersion())
+	}
+	return &api.MountInput{Type: planEngineTypes[engine]}
 }
 
 // idempotentMount takes a list of mounts and their desired paths and mounts the
-// backend at that path. The key is the path and the value is the type of
-// backend to mount.
-func (b *Broker) idempotentMount(m map[string]string) error {
+// backend at that path. The key is the path and the value is the input used to
+// mount the backend.
+func (b *Broker) idempotentMount(m map[string]*api.MountInput) error {
 	b.mountMutex.Lock()
 	defer b.mountMutex.Unlock()
 	result, err := b.vaultClient.Sys().ListMounts()
@@ -674,9 +1375,7 @@ func (b *Broker) idempotentMount(m map[string]string) error {
 		if _, ok := mounts[k]; ok {
 			continue
 		}
-		if err := b.vaultClient.Sys().Mount(k, &api.MountInput{
-			Type: v,
-		}); err != nil {
+		if err := b.vaultClient.Sys().Mount(k, v); err != nil {
 			return err
 		}
 	}
@@ -712,25 +1411,17 @@ func (b *Broker) idempotentUnmount(l []string) error {
 	return nil
 }
 
-// renewAuth renews the given token. It is designed to be called as a goroutine
-// and will log any errors it encounters.
-func (b *Broker) renewAuth(token, accessor string, stopCh <-chan struct{}) {
-	// Sleep for a random number of milliseconds. This helps prevent a thundering
-	// herd in the event a broker is restarted with a lot of bindings.
-	time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-
-	// Wait for slot in semaphore channel
-	b.sem <- struct{}{}
-
+// renewAuth renews the broker's own token until the broker is stopped. It is
+// designed to be called as a goroutine and will log any errors it encounters.
+// The tokens of bindings are renewed by the renewal manager instead.
+func (b *Broker) renewAuth(token, accessor string) {
 	// Use renew-self instead of lookup here because we want the freshest renew
 	// and we can find out if it's renewable or not.
 	secret, err := b.vaultClient.Auth().Token().RenewTokenAsSelf(token, 0)
 	if err != nil {
 		b.log.Printf("[ERR] renew-token (%s): error looking up self: %s", accessor, err)
-		<-b.sem
 		return
 	}
-	<-b.sem
 
 	renewer, err := b.vaultClient.NewRenewer(&api.RenewerInput{
 		Secret: secret,
@@ -757,9 +1448,6 @@ func (b *Broker) renewAuth(token, accessor string, stopCh <-chan struct{}) {
 				remaining = (time.Duration(seconds) * time.Second).String()
 			}
 			b.log.Printf("[INFO] renew-token (%s): successfully renewed token (%s)", accessor, remaining)
-		case <-stopCh:
-			b.log.Printf("[INFO] renew-token (%s): stopping renewer: unbind requested", accessor)
-			return
 		case <-b.stopCh:
 			return
 		}
@@ -788,7 +1476,7 @@ func (b *Broker) renewVaultToken() {
 		b.log.Printf("[ERR] renew-token: renew-self came back with empty auth")
 		return
 	}
-	b.renewAuth(secret.Auth.ClientToken, secret.Auth.Accessor, nil)
+	b.renewAuth(secret.Auth.ClientToken, secret.Auth.Accessor)
 }
 
 func decodeBindingInfo(m map[string]interface{}) (*bindingInfo, error) {
@@ -827,6 +1515,15 @@ func decodeInstanceInfo(m map[string]interface{}) (*instanceInfo, error) {
 	return &info, nil
 }
 
+// mountTypes returns the type of backend for each mount, for logging.
+func mountTypes(m map[string]*api.MountInput) map[string]string {
+	types := make(map[string]string, len(m))
+	for k, v := range m {
+		types[k] = v.Type
+	}
+	return types
+}
+
 func mapToKV(m map[string]string, joiner string) string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
@@ -4,8 +4,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,7 +16,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/pivotal-cf/brokerapi"
@@ -39,81 +46,1335 @@ func TestBroker_Services(t *testing.T) {
 	if len(services) != 1 {
 		t.Fatalf("expected 1 service but received %d", len(services))
 	}
+	plans := services[0].Plans
+	if len(plans) != 2 {
+		t.Fatalf("expected 2 plans but received %d", len(plans))
+	}
+	if plans[1].ID != "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only" {
+		t.Fatalf("expected the kv-only plan but received %+v", plans[1])
+	}
+}
+
+func TestBroker_Provision_Plan(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only",
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requested("POST /v1/sys/mounts/cf/instance-id/secret") {
+		t.Fatal("expected the secret backend to be mounted")
+	}
+	if env.Requested("POST /v1/sys/mounts/cf/instance-id/transit") {
+		t.Fatal("expected the transit backend not to be mounted")
+	}
+	instance := env.Broker.instances[env.InstanceID]
+	if instance.PlanID != details.PlanID {
+		t.Fatalf("expected plan %s but received %s", details.PlanID, instance.PlanID)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID: "app-id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Requested("POST /v1/sys/mounts/cf/app-id/transit") {
+		t.Fatal("expected the application transit backend not to be mounted")
+	}
+	backends := binding.Credentials.(map[string]interface{})["backends"].(map[string]interface{})
+	if transit := backends["transit"].([]string); len(transit) != 0 {
+		t.Fatalf("expected no transit backends but received %v", transit)
+	}
+
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_Provision_UnknownPlan(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           "unknown",
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	_, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response but received %v", err)
+	}
+	if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+		t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestBroker_Provision_Parameters(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		RawParameters: json.RawMessage(`{
+			"kv_version": 2,
+			"default_lease_ttl": "1h",
+			"max_lease_ttl": "24h",
+			"description": "team secrets",
+			"transit": false
+		}`),
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if env.Requested("POST /v1/sys/mounts/cf/instance-id/transit") {
+		t.Fatal("expected the transit backend not to be mounted")
+	}
+
+	body := env.Body("POST /v1/sys/mounts/cf/instance-id/secret")
+	if body["type"] != "kv" {
+		t.Fatalf("expected %q but received %v", "kv", body["type"])
+	}
+	if options, _ := body["options"].(map[string]interface{}); options["version"] != "2" {
+		t.Fatalf("expected version 2 but received %v", body["options"])
+	}
+	if body["description"] != "team secrets" {
+		t.Fatalf("expected %q but received %v", "team secrets", body["description"])
+	}
+	config, _ := body["config"].(map[string]interface{})
+	if config["default_lease_ttl"] != "1h" || config["max_lease_ttl"] != "24h" {
+		t.Fatalf("expected lease TTLs of 1h and 24h but received %v", config)
+	}
+
+	instance := env.Broker.instances[env.InstanceID]
+	if instance.hasEngine(EngineTransit) {
+		t.Fatalf("expected no transit engine but received %v", instance.engines())
+	}
+	if instance.Parameters == nil || instance.Parameters.KVVersion != 2 {
+		t.Fatalf("expected the parameters to be stored but received %+v", instance.Parameters)
+	}
+}
+
+func TestBroker_Provision_InvalidParameters(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	cases := []struct {
+		name   string
+		planID string
+		params string
+	}{
+		{"malformed", "", `{"kv_version":`},
+		{"unknown", "", `{"foo": "bar"}`},
+		{"kv-version", "", `{"kv_version": 3}`},
+		{"ttl", "", `{"default_lease_ttl": "1 hour"}`},
+		{"ttl-order", "", `{"default_lease_ttl": "2h", "max_lease_ttl": "1h"}`},
+		{"transit", "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only", `{"transit": true}`},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			details := brokerapi.ProvisionDetails{
+				PlanID:           tc.planID,
+				SpaceGUID:        env.SpaceGUID,
+				OrganizationGUID: env.OrganizationGUID,
+				RawParameters:    json.RawMessage(tc.params),
+			}
+			_, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+			failure, ok := err.(*brokerapi.FailureResponse)
+			if !ok {
+				t.Fatalf("expected a failure response but received %v", err)
+			}
+			if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+				t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+			}
+		})
+	}
+	if _, ok := env.Broker.instances[env.InstanceID]; ok {
+		t.Fatal("expected no instance to be provisioned")
+	}
+}
+
+func TestBroker_KVVersion2(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+	env.Broker.kvVersion = 2
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []string{
+		"POST /v1/sys/mounts/cf/instance-id/secret",
+		"POST /v1/sys/mounts/cf/space-guid/secret",
+	} {
+		if body := env.Body(req); body["type"] != "kv" {
+			t.Fatalf("expected %s to mount %q but received %v", req, "kv", body["type"])
+		}
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID: "app-id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := env.Body("POST /v1/sys/mounts/cf/app-id/secret"); body["type"] != "kv" {
+		t.Fatalf("expected %q but received %v", "kv", body["type"])
+	}
+
+	// The organization's backend was mounted as version 1 before the broker
+	// switched to version 2, so it keeps the version 1 policy.
+	policy, _ := env.Body("PUT /v1/sys/policies/acl/cf-instance-id")["policy"].(string)
+	for _, path := range []string{
+		`path "cf/instance-id/secret/data/*"`,
+		`path "cf/instance-id/transit/*"`,
+		`path "cf/space-guid/secret/destroy/*"`,
+		`path "cf/app-id/secret/metadata/*"`,
+		`path "cf/organization-guid/*"`,
+	} {
+		if !strings.Contains(policy, path) {
+			t.Fatalf("expected policy to contain %s but received %s", path, policy)
+		}
+	}
+	for _, path := range []string{
+		`path "cf/instance-id/*"`,
+		`path "cf/space-guid/*"`,
+		`path "cf/app-id/*"`,
+		`path "cf/organization-guid/secret/data/*"`,
+	} {
+		if strings.Contains(policy, path) {
+			t.Fatalf("expected policy not to contain %s but received %s", path, policy)
+		}
+	}
+
+	versions := binding.Credentials.(map[string]interface{})["kv_versions"].(map[string]int)
+	expected := map[string]int{
+		"cf/instance-id/secret":       2,
+		"cf/space-guid/secret":        2,
+		"cf/organization-guid/secret": 1,
+		"cf/app-id/secret":            2,
+	}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("expected %v but received %v", expected, versions)
+	}
+}
+
+func TestBroker_Provision_Deprovision(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	provSpec, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(provSpec, brokerapi.ProvisionedServiceSpec{}) {
+		t.Fatalf("%+v differs from %+v", provSpec, brokerapi.ProvisionedServiceSpec{})
+	}
+
+	deProvSpec, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deProvSpec, brokerapi.DeprovisionServiceSpec{}) {
+		t.Fatalf("%+v differs from %+v", deProvSpec, brokerapi.DeprovisionServiceSpec{})
+	}
+}
+
+func TestBroker_Deprovision_Bindings(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{AppGUID: "app-id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broker may be configured to refuse deleting bound instances.
+	env.Broker.refuseDeprovisionWithBindings = true
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, false); err != ErrInstanceHasBindings {
+		t.Fatalf("expected %v but received %v", ErrInstanceHasBindings, err)
+	}
+	if env.State("instance-id/binding-id") == nil {
+		t.Fatal("expected the binding to be kept")
+	}
+
+	// Otherwise, the bindings are revoked along with the instance.
+	env.Broker.refuseDeprovisionWithBindings = false
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requested("POST /v1/auth/token/revoke-accessor") {
+		t.Fatal("expected the binding's token to be revoked")
+	}
+	if env.State("instance-id/binding-id") != nil {
+		t.Fatal("expected the binding record to be deleted")
+	}
+	if _, ok := env.Broker.binds[env.BindingID]; ok {
+		t.Fatal("expected the binding to be removed from the cache")
+	}
+}
+
+func TestBroker_Deprovision_SharedMounts(t *testing.T) {
+	cases := []struct {
+		name     string
+		cleanup  string
+		shared   bool
+		unmount  bool
+		archived bool
+	}{
+		{"never", SharedMountCleanupNever, false, false, false},
+		{"unmount", SharedMountCleanupUnmount, false, true, false},
+		{"archive", SharedMountCleanupArchive, false, true, true},
+		{"still-referenced", SharedMountCleanupUnmount, true, false, false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			env, closer := defaultEnvironment(t)
+			defer closer()
+
+			env.Broker.sharedMountCleanup = tc.cleanup
+			details := brokerapi.ProvisionDetails{
+				SpaceGUID:        env.SpaceGUID,
+				OrganizationGUID: env.OrganizationGUID,
+			}
+			if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != nil {
+				t.Fatal(err)
+			}
+			if tc.shared {
+				if err := env.Broker.acquireMounts("other-instance-id", instanceSharedMounts(&instanceInfo{
+					SpaceGUID:        "other-space-guid",
+					OrganizationGUID: env.OrganizationGUID,
+				})); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, false); err != nil {
+				t.Fatal(err)
+			}
+			if unmounted := env.Requested("DELETE /v1/sys/mounts/cf/organization-guid/secret"); unmounted != tc.unmount {
+				t.Fatalf("expected unmounting the organization's backend to be %t but was %t", tc.unmount, unmounted)
+			}
+
+			var archive *archiveRecord
+			for _, path := range env.Archives() {
+				if strings.HasPrefix(path, "cf/organization-guid/secret/") {
+					archive = env.Archive(path)
+				}
+			}
+			if (archive != nil) != tc.archived {
+				t.Fatalf("expected archiving the organization's backend to be %t but received %v", tc.archived, archive)
+			}
+			if archive == nil {
+				return
+			}
+			if archive.OrganizationGUID != env.OrganizationGUID || archive.SpaceGUID != "" {
+				t.Fatalf("expected the organization and no space but received %+v", archive)
+			}
+			secrets := map[string]map[string]interface{}{
+				"db":       {"password": "db-password"},
+				"team/api": {"key": "api-key"},
+			}
+			if decrypted := decryptTestArchive(t, archive); !reflect.DeepEqual(decrypted, secrets) {
+				t.Fatalf("expected %v but received %v", secrets, decrypted)
+			}
+		})
+	}
+}
+
+func TestBroker_Deprovision_Archive(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.instanceSecretMounted = true
+	env.Broker.archiveInstances = true
+	env.Broker.archiveTTL = 48 * time.Hour
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The secrets were archived before the backend was unmounted
+	var archived, unmounted int
+	for i, r := range env.Requests() {
+		switch {
+		case strings.HasPrefix(r, "PUT /v1/"+ArchiveMount+"/data/cf/instance-id/secret/"):
+			archived = i
+		case r == "DELETE /v1/sys/mounts/cf/instance-id/secret":
+			unmounted = i
+		}
+	}
+	if archived == 0 || unmounted < archived {
+		t.Fatalf("expected the backend to be archived before it was unmounted but received %v", env.Requests())
+	}
+
+	paths := env.Archives()
+	if len(paths) != 1 || !strings.HasPrefix(paths[0], "cf/instance-id/secret/") {
+		t.Fatalf("expected an archive of the instance but received %v", paths)
+	}
+	archive := env.Archive(paths[0])
+	if archive.SpaceGUID != env.SpaceGUID || archive.OrganizationGUID != env.OrganizationGUID {
+		t.Fatalf("expected the instance's space and organization but received %+v", archive)
+	}
+	if retention := archive.ExpiresAt.Sub(archive.ArchivedAt); retention != 48*time.Hour {
+		t.Fatalf("expected a retention of 48h but received %s", retention)
+	}
+	secrets := map[string]map[string]interface{}{
+		"password": {"value": "instance-password"},
+	}
+	if decrypted := decryptTestArchive(t, archive); !reflect.DeepEqual(decrypted, secrets) {
+		t.Fatalf("expected %v but received %v", secrets, decrypted)
+	}
+
+	// The archive is restored into a new instance of the space
+	details.RawParameters = json.RawMessage(`{"restore": "instance-id"}`)
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != nil {
+		t.Fatal(err)
+	}
+	if body := env.Body("PUT /v1/cf/instance-id/secret/password"); body["value"] != "instance-password" {
+		t.Fatalf("expected the secret to be restored but received %v", body)
+	}
+}
+
+func TestBroker_Provision_Restore(t *testing.T) {
+	now := time.Now().UTC()
+	secrets := map[string]map[string]interface{}{
+		"db": {"password": "db-password"},
+	}
+
+	cases := []struct {
+		name     string
+		restore  string
+		mount    string
+		space    string
+		app      string
+		expires  time.Time
+		err      bool
+		restored string
+	}{
+		{"restored", "old-instance-id", "cf/old-instance-id/secret", "space-guid", "", now.Add(time.Hour), false, "cf/instance-id/secret"},
+		{"expired", "old-instance-id", "cf/old-instance-id/secret", "space-guid", "", now.Add(-time.Hour), true, ""},
+		{"other-space", "old-instance-id", "cf/old-instance-id/secret", "other-space-guid", "", now.Add(time.Hour), true, ""},
+		{"not-archived", "unknown-instance-id", "cf/old-instance-id/secret", "space-guid", "", now.Add(time.Hour), true, ""},
+		{"application", "old-app-id", "cf/old-app-id/secret", "space-guid", "old-app-id", now.Add(time.Hour), true, ""},
+		{"organization", "organization-guid", "cf/organization-guid/secret", "", "", now.Add(time.Hour), false, "cf/organization-guid/secret"},
+		{"other-organization", "organization-guid", "cf/organization-guid/secret", "space-guid", "", now.Add(time.Hour), true, ""},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			env, closer := defaultEnvironment(t)
+			defer closer()
+
+			// An older archive of the backend, and the latest one
+			older, err := json.Marshal(&archiveRecord{
+				Mount:            tc.mount,
+				OrganizationGUID: "organization-guid",
+				SpaceGUID:        tc.space,
+				ApplicationGUID:  tc.app,
+				ExpiresAt:        tc.expires,
+				Ciphertext:       encryptTestArchive(t, map[string]map[string]interface{}{"db": {"password": "old-password"}}),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			latest, err := json.Marshal(&archiveRecord{
+				Mount:            tc.mount,
+				OrganizationGUID: "organization-guid",
+				SpaceGUID:        tc.space,
+				ApplicationGUID:  tc.app,
+				ExpiresAt:        tc.expires,
+				Ciphertext:       encryptTestArchive(t, secrets),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			env.archives[tc.mount+"/20260101T000000Z"] = older
+			env.archives[tc.mount+"/20260102T000000Z"] = latest
+
+			_, err = env.Broker.Provision(env.Context, env.InstanceID, brokerapi.ProvisionDetails{
+				SpaceGUID:        env.SpaceGUID,
+				OrganizationGUID: env.OrganizationGUID,
+				RawParameters:    json.RawMessage(fmt.Sprintf(`{"restore": %q}`, tc.restore)),
+			}, false)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error to be %t but received %v", tc.err, err)
+			}
+			if err != nil {
+				if _, ok := env.Broker.instances[env.InstanceID]; ok {
+					t.Fatal("expected the instance not to be provisioned")
+				}
+				return
+			}
+			if body := env.Body("PUT /v1/" + tc.restored + "/db"); body["password"] != "db-password" {
+				t.Fatalf("expected the latest archive to be restored but received %v", body)
+			}
+		})
+	}
+}
+
+func TestBroker_purgeArchives(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	for path, expires := range map[string]time.Time{
+		"cf/expired-id/secret/20260101T000000Z":  time.Now().Add(-time.Hour),
+		"cf/retained-id/secret/20260101T000000Z": time.Now().Add(time.Hour),
+	} {
+		record, err := json.Marshal(&archiveRecord{ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.archives[path] = record
+	}
+
+	env.Broker.purgeArchives()
+	expected := []string{"cf/retained-id/secret/20260101T000000Z"}
+	if paths := env.Archives(); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected %v but received %v", expected, paths)
+	}
+}
+
+func TestBroker_mountReferences(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Broker.acquireMounts("other-instance-id", instanceSharedMounts(&instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{AppGUID: "app-id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	references := func(mount string) map[string]bool {
+		record := env.State(mountReferencesDir + "/" + mount)
+		if record == nil {
+			return nil
+		}
+		if record.Kind != recordKindMount {
+			t.Fatalf("expected a %s record but received %s", recordKindMount, record.Kind)
+		}
+		var refs mountReferences
+		if err := json.Unmarshal(record.Record, &refs); err != nil {
+			t.Fatal(err)
+		}
+		return refs.References
+	}
+
+	expected := map[string]map[string]bool{
+		"cf/organization-guid/secret": {"instance-id": true, "other-instance-id": true},
+		"cf/space-guid/secret":        {"instance-id": true, "other-instance-id": true},
+		"cf/app-id/secret":            {"instance-id/binding-id": true},
+		"cf/app-id/transit":           {"instance-id/binding-id": true},
+	}
+	for mount, refs := range expected {
+		if received := references(mount); !reflect.DeepEqual(received, refs) {
+			t.Fatalf("expected references %v to %s but received %v", refs, mount, received)
+		}
+	}
+
+	// The references are removed as the instances and bindings are deleted,
+	// along with the record once none are left
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if refs := references("cf/app-id/secret"); refs != nil {
+		t.Fatalf("expected no references to the application's backend but received %v", refs)
+	}
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, false); err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]bool{"other-instance-id": true}
+	if received := references("cf/space-guid/secret"); !reflect.DeepEqual(received, refs) {
+		t.Fatalf("expected references %v to the space's backend but received %v", refs, received)
+	}
+
+	// The references of instances and bindings of brokers that did not track
+	// them are recorded when the broker starts, without losing any
+	env.Broker.instances["legacy-instance-id"] = &instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if err := env.Broker.referenceRestoredMounts(); err != nil {
+		t.Fatal(err)
+	}
+	refs = map[string]bool{"other-instance-id": true, "legacy-instance-id": true}
+	if received := references("cf/space-guid/secret"); !reflect.DeepEqual(received, refs) {
+		t.Fatalf("expected references %v to the space's backend but received %v", refs, received)
+	}
+}
+
+func TestBroker_releaseMounts(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.sharedMountCleanup = SharedMountCleanupUnmount
+	mounts := map[string]mountOwner{
+		"cf/organization-guid/secret": {OrganizationGUID: "organization-guid"},
+	}
+	for _, ref := range []string{"instance-id", "other-instance-id"} {
+		if err := env.Broker.acquireMounts(ref, mounts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The backend is only unmounted once its last reference is released
+	env.Broker.releaseMounts("instance-id", mounts)
+	if env.Requested("DELETE /v1/sys/mounts/cf/organization-guid/secret") {
+		t.Fatal("expected the still referenced backend to be kept")
+	}
+	env.Broker.releaseMounts("other-instance-id", mounts)
+	if !env.Requested("DELETE /v1/sys/mounts/cf/organization-guid/secret") {
+		t.Fatal("expected the backend to be unmounted")
+	}
+	if len(env.Broker.releasing) != 0 {
+		t.Fatalf("expected no backend to be claimed but received %v", env.Broker.releasing)
+	}
+}
+
+func TestBroker_releasing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+
+	// Backends being cleaned up are not mounted again until they are.
+	env.Broker.releasing = map[string]bool{"cf/" + env.SpaceGUID + "/secret": true}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
+	env.Broker.releasing = map[string]bool{"cf/app-id/transit": true}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{AppGUID: "app-id"}); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
+}
+
+func TestBroker_Bind_Unbind(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Seed the broker with the results of provisioning an instance
+	// so binding can succeed.
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID: "app-id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.SyslogDrainURL != "" {
+		t.Fatalf("expected empty SyslogDrainURL but received %s", binding.SyslogDrainURL)
+	}
+	if binding.RouteServiceURL != "" {
+		t.Fatalf("expected empty RouteServiceURL but received %s", binding.RouteServiceURL)
+	}
+	if len(binding.VolumeMounts) != 0 {
+		t.Fatalf("expected no VolumeMounts but received %+v", binding.VolumeMounts)
+	}
+	credMap, ok := binding.Credentials.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a credential map but received %+v", binding.Credentials)
+	}
+	shared, ok := credMap["backends_shared"]
+	if !ok {
+		t.Fatalf("expected backends_shared but they're not in %+v", credMap)
+	}
+	sharedMap, ok := shared.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a backends_shared map but received %+v", shared)
+	}
+	if sharedMap["organization"] != "cf/organization-guid/secret" {
+		t.Fatalf("expected cf/organization-guid/secret but received %s", sharedMap["organization"])
+	}
+	if sharedMap["space"] != "cf/space-guid/secret" {
+		t.Fatalf("expected cf/space-guid/secret but received %s", sharedMap["space"])
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_Bind_Unbind_AppRole(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].BindingMode = BindingModeAppRole
+	env.Broker.appRoleSecretIDNumUses = 3
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID: "app-id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Requested("POST /v1/auth/token/create/cf-instance-id") {
+		t.Fatal("expected no token to be created")
+	}
+	role := env.Body("PUT /v1/auth/approle/role/cf-binding-id")
+	if policies, _ := role["token_policies"].([]interface{}); len(policies) != 1 || policies[0] != "cf-instance-id" {
+		t.Fatalf("expected the role to grant %s but received %v", "cf-instance-id", role["token_policies"])
+	}
+	if role["secret_id_num_uses"] != float64(3) {
+		t.Fatalf("expected %d but received %v", 3, role["secret_id_num_uses"])
+	}
+
+	credMap := binding.Credentials.(map[string]interface{})
+	expected := map[string]interface{}{
+		"method":    BindingModeAppRole,
+		"auth_path": "approle",
+		"role":      "cf-binding-id",
+		"role_id":   "role-id",
+		"secret_id": "secret-id",
+	}
+	if !reflect.DeepEqual(credMap["auth"], expected) {
+		t.Fatalf("expected %v but received %v", expected, credMap["auth"])
+	}
+
+	record := new(bindingInfo)
+	if ok, err := env.Broker.readState("instance-id/binding-id", recordKindBinding, record); !ok || err != nil {
+		t.Fatalf("expected the binding to be stored but received %t, %v", ok, err)
+	}
+	if record.Mode != BindingModeAppRole || record.AuthPath != "approle" || record.Role != "cf-binding-id" {
+		t.Fatalf("unexpected binding record %+v", record)
+	}
+	if record.SecretIDAccessor != "secret-id-accessor" {
+		t.Fatalf("expected %q but received %q", "secret-id-accessor", record.SecretIDAccessor)
+	}
+	if stored := env.State("instance-id/binding-id"); strings.Contains(string(stored.Record), `"secret-id"`) {
+		t.Fatalf("expected the secret ID not to be stored but received %s", stored.Record)
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requested("DELETE /v1/auth/approle/role/cf-binding-id") {
+		t.Fatal("expected the role to be deleted")
+	}
+	if env.Requested("POST /v1/auth/token/revoke-accessor") {
+		t.Fatal("expected no token to be revoked")
+	}
+}
+
+func TestBroker_Bind_AppRole_Retry(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].BindingMode = BindingModeAppRole
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	details := brokerapi.BindDetails{AppGUID: "app-id"}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, details); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry is given a new secret ID, and the first one is destroyed.
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := binding.Credentials.(map[string]interface{})["auth"].(map[string]interface{})
+	if auth["secret_id"] != "secret-id-2" {
+		t.Fatalf("expected %q but received %v", "secret-id-2", auth["secret_id"])
+	}
+	if n := env.Count("PUT /v1/auth/approle/role/cf-binding-id"); n != 1 {
+		t.Fatalf("expected the role to be created once but received %d", n)
+	}
+	destroyed := env.Body("PUT /v1/auth/approle/role/cf-binding-id/secret-id-accessor/destroy")
+	if destroyed["secret_id_accessor"] != "secret-id-accessor" {
+		t.Fatalf("expected %q to be destroyed but received %v", "secret-id-accessor", destroyed)
+	}
+	record := new(bindingInfo)
+	if ok, err := env.Broker.readState("instance-id/binding-id", recordKindBinding, record); !ok || err != nil {
+		t.Fatalf("expected the binding to be stored but received %t, %v", ok, err)
+	}
+	if record.SecretIDAccessor != "secret-id-accessor-2" {
+		t.Fatalf("expected %q but received %q", "secret-id-accessor-2", record.SecretIDAccessor)
+	}
+
+	// The secret ID is not kept, so fetching the binding cannot return it.
+	spec, err := env.Broker.GetBinding(env.Context, env.InstanceID, env.BindingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth = spec.Credentials.(map[string]interface{})["auth"].(map[string]interface{})
+	if _, ok := auth["secret_id"]; ok || auth["role_id"] != "role-id" {
+		t.Fatalf("expected the role ID without a secret ID but received %v", auth)
+	}
+}
+
+func TestBroker_Bind_Unbind_Cert(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].BindingMode = BindingModeCert
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	// Cert roles are constrained to an application.
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != brokerapi.ErrAppGuidNotProvided {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrAppGuidNotProvided, err)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID: "app-id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Requested("POST /v1/auth/token/create/cf-instance-id") {
+		t.Fatal("expected no token to be created")
+	}
+	role := env.Body("PUT /v1/auth/cert/certs/cf-binding-id")
+	if role["certificate"] != "ca" {
+		t.Fatalf("expected %q but received %v", "ca", role["certificate"])
+	}
+	if units, _ := role["allowed_organizational_units"].([]interface{}); len(units) != 1 || units[0] != "app:app-id" {
+		t.Fatalf("expected the role to allow %s but received %v", "app:app-id", role["allowed_organizational_units"])
+	}
+
+	credMap := binding.Credentials.(map[string]interface{})
+	expected := map[string]interface{}{
+		"method":    BindingModeCert,
+		"auth_path": "cert",
+		"role":      "cf-binding-id",
+	}
+	if !reflect.DeepEqual(credMap["auth"], expected) {
+		t.Fatalf("expected %v but received %v", expected, credMap["auth"])
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requested("DELETE /v1/auth/cert/certs/cf-binding-id") {
+		t.Fatal("expected the role to be deleted")
+	}
+}
+
+func TestBroker_Bind_Unbind_JWT(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].BindingMode = BindingModeJWT
+	env.Broker.jwtBoundAudiences = []string{"vault"}
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	// JWT roles are bound to an application.
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != brokerapi.ErrAppGuidNotProvided {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrAppGuidNotProvided, err)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID: "app-id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Requested("POST /v1/auth/token/create/cf-instance-id") {
+		t.Fatal("expected no token to be created")
+	}
+	role := env.Body("PUT /v1/auth/jwt/role/cf-binding-id")
+	claims := map[string]interface{}{
+		"org_guid":   "organization-guid",
+		"space_guid": "space-guid",
+		"app_guid":   "app-id",
+	}
+	if !reflect.DeepEqual(role["bound_claims"], claims) {
+		t.Fatalf("expected %v but received %v", claims, role["bound_claims"])
+	}
+	if audiences, _ := role["bound_audiences"].([]interface{}); len(audiences) != 1 || audiences[0] != "vault" {
+		t.Fatalf("expected %v but received %v", []string{"vault"}, role["bound_audiences"])
+	}
+
+	credMap := binding.Credentials.(map[string]interface{})
+	expected := map[string]interface{}{
+		"method":    BindingModeJWT,
+		"auth_path": "jwt",
+		"role":      "cf-binding-id",
+	}
+	if !reflect.DeepEqual(credMap["auth"], expected) {
+		t.Fatalf("expected %v but received %v", expected, credMap["auth"])
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requested("DELETE /v1/auth/jwt/role/cf-binding-id") {
+		t.Fatal("expected the role to be deleted")
+	}
+	if env.Requested("POST /v1/auth/token/revoke-accessor") {
+		t.Fatal("expected no token to be revoked")
+	}
+}
+
+func TestBroker_Bind_Wrapped(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID:       "app-id",
+		RawParameters: json.RawMessage(`{"wrap_ttl": "5m"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := env.Body("PUT /v1/sys/wrapping/wrap")["token"]; token != "ABCD" {
+		t.Fatalf("expected the token to be wrapped but received %v", token)
+	}
+	auth := binding.Credentials.(map[string]interface{})["auth"].(map[string]interface{})
+	if _, ok := auth["token"]; ok {
+		t.Fatalf("expected no token in %v", auth)
+	}
+	if auth["wrapping_token"] != "wrapping-token" || auth["wrap_ttl"] != 300 {
+		t.Fatalf("expected a wrapping token but received %v", auth)
+	}
+
+	// The broker keeps the token to renew it.
+	record := new(bindingInfo)
+	if ok, err := env.Broker.readState("instance-id/binding-id", recordKindBinding, record); !ok || err != nil {
+		t.Fatalf("expected the binding to be stored but received %t, %v", ok, err)
+	}
+	if record.ClientToken != "ABCD" {
+		t.Fatalf("expected %s but received %s", "ABCD", record.ClientToken)
+	}
+
+	// Bindings without a secret cannot be wrapped.
+	env.Broker.plans[0].BindingMode = BindingModeCert
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, "other-binding-id", brokerapi.BindDetails{
+		AppGUID:       "app-id",
+		RawParameters: json.RawMessage(`{"wrap_ttl": "5m"}`),
+	})
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response but received %v", err)
+	}
+	if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+		t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestBroker_Bind_Parameters(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.bindingPolicies = []string{"reader"}
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	_, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID:       "app-id",
+		RawParameters: json.RawMessage(`{"period": "1h", "explicit_max_ttl": "720h", "num_uses": 10, "policies": ["reader"]}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token role only allows the instance's policy and the allow-list.
+	role := env.Body("PUT /v1/auth/token/roles/cf-instance-id")
+	allowed := []interface{}{"cf-instance-id", "reader"}
+	if !reflect.DeepEqual(role["allowed_policies"], allowed) {
+		t.Fatalf("expected %v but received %v", allowed, role["allowed_policies"])
+	}
+
+	token := env.Body("POST /v1/auth/token/create/cf-instance-id")
+	if !reflect.DeepEqual(token["policies"], allowed) {
+		t.Fatalf("expected %v but received %v", allowed, token["policies"])
+	}
+	if token["period"] != "1h" || token["explicit_max_ttl"] != "720h" || token["num_uses"] != float64(10) {
+		t.Fatalf("unexpected token request %v", token)
+	}
+
+	// Tokens limited in uses are not renewed.
+	record := new(bindingInfo)
+	if ok, err := env.Broker.readState("instance-id/binding-id", recordKindBinding, record); !ok || err != nil {
+		t.Fatalf("expected the binding to be stored but received %t, %v", ok, err)
+	}
+	if record.NumUses != 10 || record.renewable() {
+		t.Fatalf("expected a token with %d uses that is not renewed but received %+v", 10, record)
+	}
+
+	// Policies outside of the allow-list are rejected.
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, "other-binding-id", brokerapi.BindDetails{
+		AppGUID:       "app-id",
+		RawParameters: json.RawMessage(`{"policies": ["admin"]}`),
+	})
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response but received %v", err)
+	}
+	if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+		t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestBroker_Bind_Existing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	details := brokerapi.BindDetails{AppGUID: "app-id"}
+	binding, exists, err := env.Broker.bind(env.Context, env.InstanceID, env.BindingID, details)
+	if err != nil || exists {
+		t.Fatalf("expected the binding to be created but received %t, %v", exists, err)
+	}
+
+	// Retrying the request returns the same credentials without creating
+	// another token.
+	again, exists, err := env.Broker.bind(env.Context, env.InstanceID, env.BindingID, details)
+	if err != nil || !exists {
+		t.Fatalf("expected the binding to exist but received %t, %v", exists, err)
+	}
+	if !reflect.DeepEqual(again.Credentials, binding.Credentials) {
+		t.Fatalf("expected %v but received %v", binding.Credentials, again.Credentials)
+	}
+	created := 0
+	for _, r := range env.Requests() {
+		if r == "POST /v1/auth/token/create/cf-instance-id" {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected 1 token to be created but received %d", created)
+	}
+
+	// Binding with other attributes, or under another instance, conflicts.
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{AppGUID: "other-app-id"})
+	if err != brokerapi.ErrBindingAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrBindingAlreadyExists, err)
+	}
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		AppGUID:       "app-id",
+		RawParameters: json.RawMessage(`{"wrap_ttl": "5m"}`),
+	})
+	if err != brokerapi.ErrBindingAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrBindingAlreadyExists, err)
+	}
+	env.Broker.instances["other-instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+	if _, err := env.Broker.Bind(env.Context, "other-instance-id", env.BindingID, details); err != brokerapi.ErrBindingAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrBindingAlreadyExists, err)
+	}
+
+	// The secret of a wrapped binding is wrapped again.
+	details.RawParameters = json.RawMessage(`{"wrap_ttl": "5m"}`)
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, "wrapped-binding-id", details); err != nil {
+		t.Fatal(err)
+	}
+	again, exists, err = env.Broker.bind(env.Context, env.InstanceID, "wrapped-binding-id", details)
+	if err != nil || !exists {
+		t.Fatalf("expected the binding to exist but received %t, %v", exists, err)
+	}
+	auth := again.Credentials.(map[string]interface{})["auth"].(map[string]interface{})
+	if auth["wrapping_token"] != "wrapping-token" {
+		t.Fatalf("expected a wrapping token but received %v", auth)
+	}
+}
+
+func TestBroker_bindingTokenFailed(t *testing.T) {
+	cases := []struct {
+		name    string
+		recover bool
+		wrapped bool
+		status  string
+		token   string
+	}{
+		{"failed", false, false, BindingHealthFailed, "old-token"},
+		{"recovered", true, false, BindingHealthRecovered, "ABCD"},
+		{"wrapped", true, true, BindingHealthFailed, "old-token"},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			env, closer := defaultEnvironment(t)
+			defer closer()
+
+			env.Broker.recoverTokens = tc.recover
+			env.Broker.instances[env.InstanceID] = &instanceInfo{
+				SpaceGUID:        env.SpaceGUID,
+				OrganizationGUID: env.OrganizationGUID,
+			}
+			info := &bindingInfo{
+				Organization: env.OrganizationGUID,
+				Space:        env.SpaceGUID,
+				Application:  "app-id",
+				Binding:      env.BindingID,
+				ClientToken:  "old-token",
+				Accessor:     "old-accessor",
+				Instance:     env.InstanceID,
+				Wrapped:      tc.wrapped,
+			}
+			if err := env.Broker.writeState("instance-id/binding-id", recordKindBinding, info); err != nil {
+				t.Fatal(err)
+			}
+			env.Broker.binds[env.BindingID] = info
+
+			// Tokens of bindings that no longer exist are ignored
+			env.Broker.bindingTokenFailed("unknown-accessor", errors.New("permission denied"))
+			env.Broker.bindingTokenFailed("old-accessor", errors.New("permission denied"))
+
+			recovered := tc.status == BindingHealthRecovered
+			if created := env.Requested("POST /v1/auth/token/create/cf-instance-id"); created != recovered {
+				t.Fatalf("expected creating a token to be %t but was %t", recovered, created)
+			}
+			binding, err := env.Broker.GetBinding(env.Context, env.InstanceID, env.BindingID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			health := binding.Health
+			if health == nil || health.Status != tc.status || health.Error != "permission denied" || health.NeedsRestage != recovered {
+				t.Fatalf("expected a %s binding but received %+v", tc.status, health)
+			}
+			// The token of a response-wrapped binding is not returned
+			auth := binding.Credentials.(map[string]interface{})["auth"].(map[string]interface{})
+			if token, ok := auth["token"]; ok == tc.wrapped || (ok && token != tc.token) {
+				t.Fatalf("expected %s but received %v", tc.token, token)
+			}
+			if cached := env.Broker.binds[env.BindingID]; cached.ClientToken != tc.token || cached.Health == nil {
+				t.Fatalf("expected the cached binding to be updated but received %+v", cached)
+			}
+		})
+	}
+}
+
+func TestBroker_bindingTokenFailed_Unbind(t *testing.T) {
+	// Whichever of recovering the failed token of a binding and unbinding it
+	// goes first, no token or record of the binding is left behind.
+	for i := 0; i < 20; i++ {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			env, closer := defaultEnvironment(t)
+			defer closer()
+
+			env.Broker.recoverTokens = true
+			env.Broker.renewals = testRenewalManager(nil)
+			env.Broker.instances[env.InstanceID] = &instanceInfo{
+				SpaceGUID:        env.SpaceGUID,
+				OrganizationGUID: env.OrganizationGUID,
+			}
+			info := &bindingInfo{
+				Organization: env.OrganizationGUID,
+				Space:        env.SpaceGUID,
+				Binding:      env.BindingID,
+				ClientToken:  "old-token",
+				Accessor:     "old-accessor",
+				Instance:     env.InstanceID,
+			}
+			if err := env.Broker.writeState("instance-id/binding-id", recordKindBinding, info); err != nil {
+				t.Fatal(err)
+			}
+			env.Broker.binds[env.BindingID] = info
+			env.Broker.renewals.add(info.ClientToken, info.Accessor)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				env.Broker.bindingTokenFailed("old-accessor", errors.New("permission denied"))
+			}()
+			if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if env.State("instance-id/binding-id") != nil {
+				t.Fatal("expected the binding record to be deleted")
+			}
+			if _, ok := env.Broker.binds[env.BindingID]; ok {
+				t.Fatal("expected the binding to be removed from the cache")
+			}
+			if n := len(env.Broker.renewals.tokens); n != 0 {
+				t.Fatalf("expected no token to be renewed but received %d", n)
+			}
+			if env.Requested("POST /v1/auth/token/create/cf-instance-id") && env.Count("POST /v1/auth/token/revoke-accessor") != 1 {
+				t.Fatal("expected the replacement token to be revoked")
+			}
+		})
+	}
 }
 
-func TestBroker_Provision_Deprovision(t *testing.T) {
+func TestBroker_GetInstance(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
 
-	details := brokerapi.ProvisionDetails{
-		SpaceGUID:        env.SpaceGUID,
-		OrganizationGUID: env.OrganizationGUID,
+	if _, err := env.Broker.GetInstance(env.Context, env.InstanceID); err != ErrInstanceNotFound {
+		t.Fatalf("expected %v but received %v", ErrInstanceNotFound, err)
 	}
-	provSpec, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+		PlanID:           env.Broker.plans[1].ID,
+		Parameters:       &instanceParameters{KVVersion: 2},
+	}
+	spec, err := env.Broker.GetInstance(env.Context, env.InstanceID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(provSpec, brokerapi.ProvisionedServiceSpec{}) {
-		t.Fatalf("%+v differs from %+v", provSpec, brokerapi.ProvisionedServiceSpec{})
+	if spec.ServiceID != env.Broker.serviceID || spec.PlanID != env.Broker.plans[1].ID {
+		t.Fatalf("unexpected instance %+v", spec)
+	}
+	if spec.Parameters == nil || spec.Parameters.KVVersion != 2 {
+		t.Fatalf("expected the provision parameters but received %+v", spec.Parameters)
 	}
 
-	deProvSpec, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async)
-	if err != nil {
-		t.Fatal(err)
+	// Instances still being provisioned do not exist yet.
+	env.Broker.instances["instance-id"].LastOperation = &operationInfo{Type: OperationProvision, State: brokerapi.InProgress}
+	if _, err := env.Broker.GetInstance(env.Context, env.InstanceID); err != ErrInstanceNotFound {
+		t.Fatalf("expected %v but received %v", ErrInstanceNotFound, err)
 	}
-	if !reflect.DeepEqual(deProvSpec, brokerapi.DeprovisionServiceSpec{}) {
-		t.Fatalf("%+v differs from %+v", deProvSpec, brokerapi.DeprovisionServiceSpec{})
+	env.Broker.instances["instance-id"].LastOperation.Type = OperationUpdate
+	if _, err := env.Broker.GetInstance(env.Context, env.InstanceID); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
 	}
 }
 
-func TestBroker_Bind_Unbind(t *testing.T) {
+func TestBroker_GetBinding(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
 
-	// Seed the broker with the results of provisioning an instance
-	// so binding can succeed.
 	env.Broker.instances["instance-id"] = &instanceInfo{
 		SpaceGUID:        "space-guid",
 		OrganizationGUID: "organization-guid",
 	}
 
+	if _, err := env.Broker.GetBinding(env.Context, env.InstanceID, env.BindingID); err != ErrBindingNotFound {
+		t.Fatalf("expected %v but received %v", ErrBindingNotFound, err)
+	}
+
+	env.Broker.renewals = testRenewalManager(nil)
 	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
 		AppGUID: "app-id",
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if binding.SyslogDrainURL != "" {
-		t.Fatalf("expected empty SyslogDrainURL but received %s", binding.SyslogDrainURL)
-	}
-	if binding.RouteServiceURL != "" {
-		t.Fatalf("expected empty RouteServiceURL but received %s", binding.RouteServiceURL)
+	fetched, err := env.Broker.GetBinding(env.Context, env.InstanceID, env.BindingID)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(binding.VolumeMounts) != 0 {
-		t.Fatalf("expected no VolumeMounts but received %+v", binding.VolumeMounts)
+	if !reflect.DeepEqual(fetched.Credentials, binding.Credentials) {
+		t.Fatalf("expected %v but received %v", binding.Credentials, fetched.Credentials)
 	}
-	credMap, ok := binding.Credentials.(map[string]interface{})
-	if !ok {
-		t.Fatalf("expected a credential map but received %+v", binding.Credentials)
+
+	// The renewal of the binding's token is returned along with it.
+	if fetched.Renewal == nil || fetched.Renewal.NextRenewal.IsZero() || fetched.Renewal.LastRenewal != nil {
+		t.Fatalf("expected the token's first renewal to be scheduled but received %+v", fetched.Renewal)
 	}
-	shared, ok := credMap["backends_shared"]
-	if !ok {
-		t.Fatalf("expected backends_shared but they're not in %+v", credMap)
+	env.Broker.renewals.lock.Lock()
+	status := &env.Broker.renewals.tokens[env.Broker.binds[env.BindingID].Accessor].status
+	status.LastRenewal = time.Now()
+	status.TTL = time.Hour
+	status.Failures = 1
+	status.LastError = "connection refused"
+	env.Broker.renewals.lock.Unlock()
+	fetched, err = env.Broker.GetBinding(env.Context, env.InstanceID, env.BindingID)
+	if err != nil {
+		t.Fatal(err)
 	}
-	sharedMap, ok := shared.(map[string]interface{})
-	if !ok {
-		t.Fatalf("expected a backends_shared map but received %+v", shared)
+	if fetched.Renewal.LastRenewal == nil || fetched.Renewal.TTL != "1h0m0s" || fetched.Renewal.Failures != 1 || fetched.Renewal.LastError != "connection refused" {
+		t.Fatalf("expected the token's last renewal and failure but received %+v", fetched.Renewal)
 	}
-	if sharedMap["organization"] != "cf/organization-guid/secret" {
-		t.Fatalf("expected cf/organization-guid/secret but received %s", sharedMap["organization"])
+	env.Broker.renewals.stop(env.Broker.binds[env.BindingID].Accessor)
+	fetched, err = env.Broker.GetBinding(env.Context, env.InstanceID, env.BindingID)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if sharedMap["space"] != "cf/space-guid/secret" {
-		t.Fatalf("expected cf/space-guid/secret but received %s", sharedMap["space"])
+	if fetched.Renewal != nil {
+		t.Fatalf("expected no renewal of a token that is no longer renewed but received %+v", fetched.Renewal)
 	}
 
-	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+	// The wrapped secret of a binding is not returned again.
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, "wrapped-binding-id", brokerapi.BindDetails{
+		AppGUID:       "app-id",
+		RawParameters: json.RawMessage(`{"wrap_ttl": "5m"}`),
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
+	fetched, err = env.Broker.GetBinding(env.Context, env.InstanceID, "wrapped-binding-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := fetched.Credentials.(map[string]interface{})["auth"].(map[string]interface{})
+	if _, ok := auth["token"]; ok {
+		t.Fatalf("expected no token in %v", auth)
+	}
+
+	if _, err := env.Broker.GetBinding(env.Context, "other-instance-id", env.BindingID); err != ErrInstanceNotFound {
+		t.Fatalf("expected %v but received %v", ErrInstanceNotFound, err)
+	}
 }
 
 func TestBroker_Bind_Unbind_No_Application_ID(t *testing.T) {
@@ -209,35 +1470,475 @@ func TestBroker_Bind_Unbind_No_Access_Token(t *testing.T) {
 		t.Fatalf("expected cf/space-guid/secret but received %s", sharedMap["space"])
 	}
 
-	if err := env.Broker.Unbind(env.Context, env.InstanceID, "bad-accessor-test", brokerapi.UnbindDetails{}); err != nil {
-		t.Fatal(err)
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, "bad-accessor-test", brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_Update(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	_, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, env.Async)
+	if err != brokerapi.ErrInstanceDoesNotExist {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrInstanceDoesNotExist, err)
+	}
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates that keep the plan change nothing.
+	spec, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, env.Async)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec, brokerapi.UpdateServiceSpec{}) {
+		t.Fatalf("%+v differs from %+v", spec, brokerapi.UpdateServiceSpec{})
+	}
+}
+
+func TestBroker_Update_Plan(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only",
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving to the shared plan mounts its transit backend.
+	update := brokerapi.UpdateDetails{PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.shared"}
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	instance := env.Broker.instances[env.InstanceID]
+	if instance.PlanID != update.PlanID {
+		t.Fatalf("expected %s but received %s", update.PlanID, instance.PlanID)
+	}
+	if engines := strings.Join(instance.engines(), ","); engines != "secret,transit" {
+		t.Fatalf("expected %q but received %q", "secret,transit", engines)
+	}
+	if !env.Requested("PUT /v1/sys/policies/acl/cf-instance-id") {
+		t.Fatal("expected the policy to be regenerated")
+	}
+
+	// Moving back keeps the transit backend unless asked to unmount it.
+	update = brokerapi.UpdateDetails{PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only"}
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	instance = env.Broker.instances[env.InstanceID]
+	if engines := strings.Join(instance.engines(), ","); engines != "secret,transit" {
+		t.Fatalf("expected %q but received %q", "secret,transit", engines)
+	}
+	if env.Requested("DELETE /v1/sys/mounts/cf/instance-id/transit") {
+		t.Fatal("expected the transit backend to stay mounted")
+	}
+
+	update.RawParameters = json.RawMessage(`{"unmount_dropped": true}`)
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	instance = env.Broker.instances[env.InstanceID]
+	if engines := strings.Join(instance.engines(), ","); engines != "secret" {
+		t.Fatalf("expected %q but received %q", "secret", engines)
+	}
+	if !env.Requested("DELETE /v1/sys/mounts/cf/instance-id/transit") {
+		t.Fatal("expected the transit backend to be unmounted")
+	}
+	if record := env.State(env.InstanceID); record == nil {
+		t.Fatal("expected the instance record to be stored")
+	}
+}
+
+func TestBroker_Update_Tune(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		RawParameters:    json.RawMessage(`{"default_lease_ttl": "1h", "description": "team secrets"}`),
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	update := brokerapi.UpdateDetails{
+		RawParameters: json.RawMessage(`{"max_lease_ttl": "48h", "audit_non_hmac_request_keys": ["name"]}`),
+	}
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"secret", "transit"} {
+		body := env.Body("PUT /v1/sys/mounts/cf/instance-id/" + path + "/tune")
+		if body == nil {
+			t.Fatalf("expected the %s backend to be tuned", path)
+		}
+		if body["default_lease_ttl"] != "1h" || body["max_lease_ttl"] != "48h" {
+			t.Fatalf("expected TTLs of %q and %q but received %v", "1h", "48h", body)
+		}
+		if body["description"] != "team secrets" {
+			t.Fatalf("expected %q but received %v", "team secrets", body["description"])
+		}
+		if keys, _ := body["audit_non_hmac_request_keys"].([]interface{}); len(keys) != 1 || keys[0] != "name" {
+			t.Fatalf("expected %v but received %v", []string{"name"}, body["audit_non_hmac_request_keys"])
+		}
+	}
+	if params := env.Broker.instances[env.InstanceID].Parameters; params.MaxLeaseTTL != "48h" {
+		t.Fatalf("expected %q but received %+v", "48h", params)
+	}
+
+	// Parameters given empty are cleared, resetting the backends' defaults.
+	update.RawParameters = json.RawMessage(`{"default_lease_ttl": "", "description": "", "audit_non_hmac_request_keys": []}`)
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	body := env.Body("PUT /v1/sys/mounts/cf/instance-id/secret/tune")
+	if body["default_lease_ttl"] != "system" || body["max_lease_ttl"] != "48h" || body["description"] != "" {
+		t.Fatalf("expected the default lease TTL and description to be reset but received %v", body)
+	}
+	if keys, ok := body["audit_non_hmac_request_keys"].([]interface{}); !ok || len(keys) != 0 {
+		t.Fatalf("expected the request keys to be cleared but received %v", body["audit_non_hmac_request_keys"])
+	}
+	params := env.Broker.instances[env.InstanceID].Parameters
+	if params.DefaultLeaseTTL != "" || params.Description != "" || len(params.AuditNonHMACRequestKeys) != 0 {
+		t.Fatalf("expected the parameters to be cleared but received %+v", params)
+	}
+
+	// Tuning is checked against the parameters it leaves unchanged.
+	update.RawParameters = json.RawMessage(`{"default_lease_ttl": "72h"}`)
+	_, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async)
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response but received %v", err)
+	}
+	if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+		t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestBroker_Update_Async(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only",
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	update := brokerapi.UpdateDetails{PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.shared"}
+	spec, err := env.Broker.Update(env.Context, env.InstanceID, update, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spec.IsAsync || spec.OperationData != OperationUpdate {
+		t.Fatalf("expected an asynchronous update but received %+v", spec)
+	}
+	if lastOperation := waitForOperation(t, env, OperationUpdate); lastOperation.State != brokerapi.Succeeded {
+		t.Fatalf("expected %q but received %+v", brokerapi.Succeeded, lastOperation)
+	}
+
+	// Updated instances can be bound.
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_Update_Errors(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	update := brokerapi.UpdateDetails{
+		PlanID:        "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only",
+		RawParameters: json.RawMessage(`{"transit": false}`),
+	}
+	_, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async)
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response but received %v", err)
+	}
+	if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+		t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+	}
+
+	update.RawParameters = nil
+	env.Broker.planUpdatable = false
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, update, env.Async); err != brokerapi.ErrPlanChangeNotSupported {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrPlanChangeNotSupported, err)
+	}
+}
+
+func TestBroker_LastOperation(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	_, err := env.Broker.LastOperation(env.Context, env.InstanceID, "")
+	if err != brokerapi.ErrInstanceDoesNotExist {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrInstanceDoesNotExist, err)
+	}
+
+	// Instances provisioned synchronously have succeeded.
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	lastOperation, err := env.Broker.LastOperation(env.Context, env.InstanceID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastOperation.State != brokerapi.Succeeded {
+		t.Fatalf("expected %q but received %q", brokerapi.Succeeded, lastOperation.State)
+	}
+}
+
+func TestBroker_Provision_Deprovision_Async(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	provSpec, err := env.Broker.Provision(env.Context, env.InstanceID, details, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !provSpec.IsAsync || provSpec.OperationData != OperationProvision {
+		t.Fatalf("expected an asynchronous provision but received %+v", provSpec)
+	}
+	if lastOperation := waitForOperation(t, env, OperationProvision); lastOperation.State != brokerapi.Succeeded {
+		t.Fatalf("expected %q but received %+v", brokerapi.Succeeded, lastOperation)
+	}
+
+	deProvSpec, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deProvSpec.IsAsync || deProvSpec.OperationData != OperationDeprovision {
+		t.Fatalf("expected an asynchronous deprovision but received %+v", deProvSpec)
+	}
+	waitForOperation(t, env, OperationDeprovision)
+	if _, err := env.Broker.LastOperation(env.Context, env.InstanceID, OperationDeprovision); err != brokerapi.ErrInstanceDoesNotExist {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrInstanceDoesNotExist, err)
+	}
+}
+
+func TestBroker_Provision_Async_Failed(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Mounting the backends of an unknown organization fails.
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: "unknown-organization-guid",
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, true); err != nil {
+		t.Fatal(err)
+	}
+	lastOperation := waitForOperation(t, env, OperationProvision)
+	if lastOperation.State != brokerapi.Failed {
+		t.Fatalf("expected %q but received %+v", brokerapi.Failed, lastOperation)
+	}
+	if lastOperation.Description == "" {
+		t.Fatal("expected a description of the failure")
+	}
+
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err == nil {
+		t.Fatal("expected binding to an instance that failed to provision to fail")
+	}
+}
+
+func TestBroker_Provision_Existing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		RawParameters:    json.RawMessage(`{"kv_version": 2}`),
+	}
+	if _, exists, err := env.Broker.provision(env.Context, env.InstanceID, details, false); err != nil || exists {
+		t.Fatalf("expected the instance to be provisioned but received %t, %v", exists, err)
+	}
+
+	// Retrying the request does nothing.
+	before := len(env.Requests())
+	if _, exists, err := env.Broker.provision(env.Context, env.InstanceID, details, false); err != nil || !exists {
+		t.Fatalf("expected the instance to exist but received %t, %v", exists, err)
+	}
+	if after := len(env.Requests()); after != before {
+		t.Fatalf("expected no request to Vault but received %v", env.Requests()[before:])
+	}
+
+	// Provisioning it with other attributes conflicts.
+	details.RawParameters = json.RawMessage(`{"kv_version": 1}`)
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrInstanceAlreadyExists, err)
+	}
+	details.RawParameters = nil
+	details.PlanID = env.Broker.plans[1].ID
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrInstanceAlreadyExists, err)
+	}
+
+	// Retrying while the instance is being provisioned reports the operation.
+	env.Broker.instances[env.InstanceID].LastOperation = &operationInfo{Type: OperationProvision, State: brokerapi.InProgress}
+	details.PlanID = ""
+	details.RawParameters = json.RawMessage(`{"kv_version": 2}`)
+	spec, err := env.Broker.Provision(env.Context, env.InstanceID, details, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spec.IsAsync || spec.OperationData != OperationProvision {
+		t.Fatalf("expected an asynchronous provision but received %+v", spec)
+	}
+
+	// An instance that failed to provision is provisioned again.
+	env.Broker.instances[env.InstanceID].LastOperation.State = brokerapi.Failed
+	details.RawParameters = nil
+	if _, exists, err := env.Broker.provision(env.Context, env.InstanceID, details, false); err != nil || exists {
+		t.Fatalf("expected the instance to be provisioned but received %t, %v", exists, err)
 	}
 }
 
-func TestBroker_Update(t *testing.T) {
+func TestBroker_Operation_InProgress(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
 
-	spec, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, env.Async)
-	if err != nil {
-		t.Fatal(err)
+	env.Broker.instances[env.InstanceID] = &instanceInfo{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		LastOperation: &operationInfo{
+			Type:  OperationProvision,
+			State: brokerapi.InProgress,
+		},
 	}
-	if !reflect.DeepEqual(spec, brokerapi.UpdateServiceSpec{}) {
-		t.Fatalf("%+v differs from %+v", spec, brokerapi.UpdateServiceSpec{})
+
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, true); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
+
+	// Resuming the operation, as happens on start, completes it.
+	env.Broker.resumeOperations()
+	if lastOperation := waitForOperation(t, env, OperationProvision); lastOperation.State != brokerapi.Succeeded {
+		t.Fatalf("expected %q but received %+v", brokerapi.Succeeded, lastOperation)
 	}
 }
 
-func TestBroker_LastOperation(t *testing.T) {
+func TestBroker_Operation_Synchronous(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
 
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+
+	// Only one of concurrent requests to provision an instance provisions it.
+	var wg sync.WaitGroup
+	provisioned := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, exists, err := env.Broker.provision(env.Context, env.InstanceID, details, false)
+			if err != nil && err != ErrConcurrentOperation {
+				t.Error(err)
+			}
+			provisioned <- err == nil && !exists
+		}()
+	}
+	wg.Wait()
+	close(provisioned)
+	n := 0
+	for p := range provisioned {
+		if p {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected the instance to be provisioned %d times but received %d", 1, n)
+	}
+
+	// No other operation starts while a synchronous one is in progress.
+	env.Broker.instances[env.InstanceID].operation = OperationUpdate
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, false); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, false); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, false); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != ErrConcurrentOperation {
+		t.Fatalf("expected %v but received %v", ErrConcurrentOperation, err)
+	}
 	lastOperation, err := env.Broker.LastOperation(env.Context, env.InstanceID, "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(lastOperation, brokerapi.LastOperation{}) {
-		t.Fatalf("%+v differs from %+v", lastOperation, brokerapi.LastOperation{})
+	if lastOperation.State != brokerapi.InProgress {
+		t.Fatalf("expected %q but received %q", brokerapi.InProgress, lastOperation.State)
+	}
+
+	// A failed operation leaves the instance as it was.
+	instance := env.Broker.instances[env.InstanceID]
+	instance.operation = ""
+	updated := *instance
+	updated.PlanID = env.Broker.plans[1].ID
+	updated.operation = OperationUpdate
+	env.Broker.instances[env.InstanceID] = &updated
+	env.Broker.endOperation(env.InstanceID, &updated, instance, errors.New("failed"))
+	if env.Broker.instances[env.InstanceID] != instance || updated.operation != "" {
+		t.Fatalf("expected the instance to be restored but received %+v", env.Broker.instances[env.InstanceID])
+	}
+}
+
+// waitForOperation polls the last operation on the environment's instance
+// until it is no longer in progress.
+func waitForOperation(t *testing.T, env *Environment, operationData string) brokerapi.LastOperation {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lastOperation, err := env.Broker.LastOperation(env.Context, env.InstanceID, operationData)
+		if err == brokerapi.ErrInstanceDoesNotExist {
+			return lastOperation
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastOperation.State != brokerapi.InProgress {
+			return lastOperation
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	t.Fatalf("%s operation did not complete", operationData)
+	return brokerapi.LastOperation{}
 }
 
 type Environment struct {
@@ -248,14 +1949,238 @@ type Environment struct {
 	SpaceGUID        string
 	OrganizationGUID string
 	Async            bool
+
+	requestsLock sync.Mutex
+	requests     []string
+	bodies       map[string][]byte
+	state        map[string]json.RawMessage
+	archives     map[string]json.RawMessage
+
+	// instanceSecretMounted lists the instance's secret backend in the mount
+	// table, as version 1 of the KV secrets engine.
+	instanceSecretMounted bool
+}
+
+// State returns the record stored in the state backend at the path, or nil if
+// there is none.
+func (e *Environment) State(path string) *stateRecord {
+	e.requestsLock.Lock()
+	defer e.requestsLock.Unlock()
+	data, ok := e.state[path]
+	if !ok {
+		return nil
+	}
+	var record stateRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil
+	}
+	return &record
+}
+
+// Archive returns the archive stored at the path in the archive backend, or
+// nil if there is none.
+func (e *Environment) Archive(path string) *archiveRecord {
+	e.requestsLock.Lock()
+	defer e.requestsLock.Unlock()
+	data, ok := e.archives[path]
+	if !ok {
+		return nil
+	}
+	var record archiveRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil
+	}
+	return &record
+}
+
+// Archives returns the paths of every archive in the archive backend.
+func (e *Environment) Archives() []string {
+	e.requestsLock.Lock()
+	defer e.requestsLock.Unlock()
+	var paths []string
+	for k := range e.archives {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// testCiphertext is the prefix of the ciphertexts of the fake transit backend,
+// which leaves the plaintext as it is.
+const testCiphertext = "vault:v1:"
+
+// decryptTestArchive returns the secrets of an archive encrypted by the fake
+// transit backend.
+func decryptTestArchive(t *testing.T, record *archiveRecord) map[string]map[string]interface{} {
+	plaintext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(record.Ciphertext, testCiphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secrets map[string]map[string]interface{}
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		t.Fatal(err)
+	}
+	return secrets
+}
+
+// encryptTestArchive returns the ciphertext of the secrets as the fake transit
+// backend encrypts them.
+func encryptTestArchive(t *testing.T, secrets map[string]map[string]interface{}) string {
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCiphertext + base64.StdEncoding.EncodeToString(plaintext)
+}
+
+// serveKV serves the requests to the KV version 2 backend at the mount from
+// the store in memory.
+func (e *Environment) serveKV(w http.ResponseWriter, r *http.Request, body []byte, mount string, store map[string]json.RawMessage) {
+	e.requestsLock.Lock()
+	defer e.requestsLock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/"+mount+"/")
+	switch {
+	case path == "config" && r.Method == "GET":
+		w.WriteHeader(200)
+		w.Write([]byte(`{"data": {"max_versions": 0, "cas_required": false}}`))
+
+	case strings.HasPrefix(path, "data/") && (r.Method == "PUT" || r.Method == "POST"):
+		var req struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		store[strings.TrimPrefix(path, "data/")] = req.Data
+		w.WriteHeader(200)
+		w.Write([]byte(`{"data": {"version": 1}}`))
+
+	case strings.HasPrefix(path, "data/") && r.Method == "GET":
+		data, ok := store[strings.TrimPrefix(path, "data/")]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"data": {"data": %s, "metadata": {"version": 1}}}`, data)
+
+	case strings.HasPrefix(path, "metadata") && r.Method == "GET" && r.URL.Query().Get("list") == "true":
+		dir := strings.TrimPrefix(strings.TrimPrefix(path, "metadata"), "/")
+		if dir != "" {
+			dir += "/"
+		}
+		seen := make(map[string]bool)
+		keys := []string{}
+		for k := range store {
+			if !strings.HasPrefix(k, dir) {
+				continue
+			}
+			key := strings.TrimPrefix(k, dir)
+			if i := strings.Index(key, "/"); i >= 0 {
+				key = key[:i+1]
+			}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(404)
+			return
+		}
+		sort.Strings(keys)
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"keys": keys},
+		})
+
+	case strings.HasPrefix(path, "metadata/") && r.Method == "DELETE":
+		delete(store, strings.TrimPrefix(path, "metadata/"))
+		w.WriteHeader(204)
+
+	default:
+		w.WriteHeader(400)
+	}
+}
+
+// Requests returns the "METHOD url" of every request Vault has received.
+func (e *Environment) Requests() []string {
+	e.requestsLock.Lock()
+	defer e.requestsLock.Unlock()
+	return append([]string(nil), e.requests...)
+}
+
+// Body returns the decoded JSON body of the last request Vault received with
+// the given "METHOD url", or nil if there was none.
+func (e *Environment) Body(req string) map[string]interface{} {
+	e.requestsLock.Lock()
+	defer e.requestsLock.Unlock()
+	var body map[string]interface{}
+	if err := json.Unmarshal(e.bodies[req], &body); err != nil {
+		return nil
+	}
+	return body
+}
+
+// Count returns the number of times Vault has received the given "METHOD url".
+func (e *Environment) Count(req string) int {
+	n := 0
+	for _, r := range e.Requests() {
+		if r == req {
+			n++
+		}
+	}
+	return n
+}
+
+// Requested returns true if Vault has received the given "METHOD url".
+func (e *Environment) Requested(req string) bool {
+	for _, r := range e.Requests() {
+		if r == req {
+			return true
+		}
+	}
+	return false
 }
 
 func defaultEnvironment(t *testing.T) (*Environment, func()) {
+	env := &Environment{
+		bodies:   make(map[string][]byte),
+		archives: make(map[string]json.RawMessage),
+		state: map[string]json.RawMessage{
+			"instance-id/bad-accessor-test": json.RawMessage(`{
+				"schema_version": 1,
+				"kind": "binding",
+				"record": {"Organization": "organization-guid", "Space": "space-guid", "Accessor": "invalid-accessor"}
+			}`),
+		},
+	}
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		reqURL := r.URL.String()
 
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		env.requestsLock.Lock()
+		env.requests = append(env.requests, r.Method+" "+reqURL)
+		env.bodies[r.Method+" "+reqURL] = body
+		env.requestsLock.Unlock()
+
+		// The broker's state is kept in memory, as it would be in the KV
+		// store (v2).
+		if strings.HasPrefix(r.URL.Path, "/v1/"+StateMount+"/") {
+			env.serveKV(w, r, body, StateMount, env.state)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/"+ArchiveMount+"/") {
+			env.serveKV(w, r, body, ArchiveMount, env.archives)
+			return
+		}
+
 		switch {
 
 		// The following auth calls are all for the token auth engine.
@@ -289,6 +2214,59 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/auth/approle/role/cf-binding-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/auth/approle/role/cf-binding-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/auth/approle/role/cf-binding-id/role-id" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"role_id": "role-id"}}`))
+			return
+
+		case reqURL == "/v1/auth/approle/role/cf-binding-id/secret-id" && r.Method == "PUT":
+			// Every secret ID after the first is numbered.
+			suffix := ""
+			if n := env.Count(r.Method + " " + reqURL); n > 1 {
+				suffix = fmt.Sprintf("-%d", n)
+			}
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"data": {"secret_id": "secret-id%s", "secret_id_accessor": "secret-id-accessor%s"}}`, suffix, suffix)
+			return
+
+		case reqURL == "/v1/auth/approle/role/cf-binding-id/secret-id-accessor/destroy" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/auth/cert/certs/cf-binding-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/auth/cert/certs/cf-binding-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/auth/jwt/role/cf-binding-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/auth/jwt/role/cf-binding-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/wrapping/wrap" && r.Method == "PUT":
+			if r.Header.Get("X-Vault-Wrap-TTL") == "" {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errors":["wrap TTL is missing"]}`))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"wrap_info": {"token": "wrapping-token", "ttl": 300}}`))
+			return
+
 		case reqURL == "/v1/auth/token/create/cf-instance-id" && r.Method == "POST":
 			w.WriteHeader(200)
 			w.Write([]byte(`{
@@ -324,7 +2302,8 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
-		// The following calls to cf/broker are all for the generic KV store (v1).
+		// The following calls to cf/broker are all for the legacy state, stored in
+		// the generic KV store (v1), which is migrated when the broker starts.
 		case reqURL == "/v1/cf/broker?list=true" && r.Method == "GET":
 			w.WriteHeader(200)
 			w.Write([]byte(`{
@@ -377,54 +2356,20 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
-		case reqURL == "/v1/cf/broker/instance-id" && r.Method == "PUT":
-			w.WriteHeader(204)
-			return
-
-		case reqURL == "/v1/cf/broker/instance-id" && r.Method == "DELETE":
-			w.WriteHeader(204)
-			return
-
-		case reqURL == "/v1/cf/broker/app-id" && r.Method == "PUT":
-			w.WriteHeader(204)
-			return
-
-		case reqURL == "/v1/cf/broker/instance-id/binding-id" && r.Method == "PUT":
+		case reqURL == "/v1/cf/broker/foo" && r.Method == "DELETE":
+		case reqURL == "/v1/cf/broker/foo/foo" && r.Method == "DELETE":
 			w.WriteHeader(204)
 			return
 
-		case reqURL == "/v1/cf/broker/instance-id/binding-id" && r.Method == "GET":
-			w.WriteHeader(200)
-			w.Write([]byte(`{
-				"auth": null,
-				"data": {
-					"json": "{\"OrganizationGUID\": \"organization-guid\", \"SpaceGUID\": \"space-guid\"}"
-				},
-				"lease_duration": 2764800,
-				"lease_id": "",
-				"renewable": false
-			}`))
-			return
-
-		case reqURL == "/v1/cf/broker/instance-id/bad-accessor-test" && r.Method == "GET":
+		// This call is for listing mounts themselves.
+		case reqURL == "/v1/sys/mounts" && r.Method == "GET" && env.instanceSecretMounted:
 			w.WriteHeader(200)
-			w.Write([]byte(`{
-				"auth": null,
-				"data": {
-					"json": "{\"OrganizationGUID\": \"organization-guid\", \"SpaceGUID\": \"space-guid\", \"Accessor\": \"invalid-accessor\"}"
-				},
-				"lease_duration": 2764800,
-				"lease_id": "",
-				"renewable": false
-			}`))
-			return
-
-		case reqURL == "/v1/cf/broker/instance-id/binding-id" && r.Method == "DELETE":
-		case reqURL == "/v1/cf/broker/instance-id/bad-accessor-test" && r.Method == "DELETE":
-			w.WriteHeader(204)
+			w.Write([]byte(`{"data": {
+				"cf/instance-id/secret/": {"type": "generic", "description": ""},
+				"cf/instance-id/transit/": {"type": "transit", "description": ""}
+			}}`))
 			return
 
-		// This call is for listing mounts themselves.
 		case reqURL == "/v1/sys/mounts" && r.Method == "GET":
 			w.WriteHeader(200)
 			w.Write([]byte(`{"data": {
@@ -438,6 +2383,36 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 						"seal_wrap": false
 					}
 				},
+				"cf/broker/": {
+					"type": "generic",
+					"description": "",
+					"config": {
+						"default_lease_ttl": 0,
+						"max_lease_ttl": 0,
+						"force_no_cache": false,
+						"seal_wrap": false
+					}
+				},
+				"cf/instance-id/transit/": {
+					"type": "transit",
+					"description": "",
+					"config": {
+						"default_lease_ttl": 0,
+						"max_lease_ttl": 0,
+						"force_no_cache": false,
+						"seal_wrap": false
+					}
+				},
+				"cf/organization-guid/secret/": {
+					"type": "generic",
+					"description": "",
+					"config": {
+						"default_lease_ttl": 0,
+						"max_lease_ttl": 0,
+						"force_no_cache": false,
+						"seal_wrap": false
+					}
+				},
 				"sys": {
 					"type": "system",
 					"description": "system endpoint",
@@ -453,7 +2428,7 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 
 		// These posts provide configs to the given endpoints, configs like:
 		// {"config":{"default_lease_ttl":"","force_no_cache":false,"max_lease_ttl":""},"description":"","local":false,"type":"generic"}
-		case reqURL == "/v1/sys/mounts/cf/broker" && r.Method == "POST":
+		case reqURL == "/v1/sys/mounts/cf/broker-state" && r.Method == "POST":
 			w.WriteHeader(204)
 			return
 
@@ -465,6 +2440,22 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/sys/mounts/cf/instance-id/secret" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/instance-id/transit" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/instance-id/secret/tune" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/instance-id/transit/tune" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/sys/mounts/cf/app-id/secret" && r.Method == "POST":
 			w.WriteHeader(204)
 			return
@@ -481,6 +2472,79 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/sys/mounts/cf/organization-guid/secret" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/"+ArchiveMount && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		// The organization's backend has a secret at the top level and one in
+		// a directory.
+		case reqURL == "/v1/cf/organization-guid/secret?list=true" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"keys": ["db", "team/"]}}`))
+			return
+
+		case reqURL == "/v1/cf/organization-guid/secret/team?list=true" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"keys": ["api"]}}`))
+			return
+
+		case reqURL == "/v1/cf/organization-guid/secret/db" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"password": "db-password"}}`))
+			return
+
+		case reqURL == "/v1/cf/organization-guid/secret/team/api" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"key": "api-key"}}`))
+			return
+
+		case strings.HasPrefix(reqURL, "/v1/cf/organization-guid/secret/") && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/"+ArchiveTransitMount && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		// The transit backend of the broker "encrypts" by prefixing the
+		// plaintext.
+		case reqURL == "/v1/"+ArchiveTransitMount+"/encrypt/"+ArchiveKey && r.Method == "PUT":
+			var req struct{ Plaintext string }
+			json.Unmarshal(body, &req)
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"ciphertext": testCiphertext + req.Plaintext},
+			})
+			return
+
+		case reqURL == "/v1/"+ArchiveTransitMount+"/decrypt/"+ArchiveKey && r.Method == "PUT":
+			var req struct{ Ciphertext string }
+			json.Unmarshal(body, &req)
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"plaintext": strings.TrimPrefix(req.Ciphertext, testCiphertext)},
+			})
+			return
+
+		// The instance's backend has a single secret.
+		case reqURL == "/v1/cf/instance-id/secret?list=true" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"keys": ["password"]}}`))
+			return
+
+		case reqURL == "/v1/cf/instance-id/secret/password" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"value": "instance-password"}}`))
+			return
+
+		case strings.HasPrefix(reqURL, "/v1/cf/instance-id/secret/") && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/sys/policies/acl/cf-instance-id" && r.Method == "PUT":
 			w.WriteHeader(204)
 			return
@@ -539,25 +2603,43 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 		t.Fatal(err)
 	}
 
-	return &Environment{
-		Context: context.Background(),
-		Broker: &Broker{
-			log:                log.New(os.Stdout, "", 0),
-			vaultClient:        client,
-			serviceID:          "0654695e-0760-a1d4-1cad-5dd87b75ed99",
-			serviceName:        "hashicorp-vault",
-			serviceDescription: "HashiCorp Vault Service Broker",
-			planName:           "shared",
-			planDescription:    "Secure access to Vault's storage and transit backends",
-			vaultAdvertiseAddr: "https://127.0.0.1:8200",
-			vaultRenewToken:    true,
-			instances:          make(map[string]*instanceInfo),
-			binds:              make(map[string]*bindingInfo),
+	env.Context = context.Background()
+	env.Broker = &Broker{
+		log:                log.New(os.Stdout, "", 0),
+		vaultClient:        client,
+		serviceID:          "0654695e-0760-a1d4-1cad-5dd87b75ed99",
+		serviceName:        "hashicorp-vault",
+		serviceDescription: "HashiCorp Vault Service Broker",
+		plans: []*Plan{
+			{
+				ID:          "0654695e-0760-a1d4-1cad-5dd87b75ed99.shared",
+				Name:        "shared",
+				Description: "Secure access to Vault's storage and transit backends",
+				Engines:     []string{EngineSecret, EngineTransit},
+			},
+			{
+				ID:          "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only",
+				Name:        "kv-only",
+				Description: "Secure access to Vault's storage backend",
+				Engines:     []string{EngineSecret},
+			},
 		},
-		InstanceID:       "instance-id",
-		BindingID:        "binding-id",
-		SpaceGUID:        "space-guid",
-		OrganizationGUID: "organization-guid",
-		Async:            false,
-	}, ts.Close
+		vaultAdvertiseAddr: "https://127.0.0.1:8200",
+		vaultRenewToken:    true,
+		planUpdatable:      true,
+		started:            true,
+		appRolePath:        "approle",
+		certPath:           "cert",
+		certCA:             "ca",
+		jwtPath:            "jwt",
+		jwtUserClaim:       "sub",
+		instances:          make(map[string]*instanceInfo),
+		binds:              make(map[string]*bindingInfo),
+	}
+	env.InstanceID = "instance-id"
+	env.BindingID = "binding-id"
+	env.SpaceGUID = "space-guid"
+	env.OrganizationGUID = "organization-guid"
+	env.Async = false
+	return env, ts.Close
 }
@@ -0,0 +1,221 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+	"gopkg.in/yaml.v2"
+)
+
+// Catalog is an Open Service Broker catalog document, as loaded from the file
+// given in CATALOG_FILE.
+type Catalog struct {
+	Services []*CatalogService `json:"services"`
+}
+
+// CatalogService is a service in the catalog document.
+type CatalogService struct {
+	ID            string                     `json:"id"`
+	Name          string                     `json:"name"`
+	Description   string                     `json:"description"`
+	Tags          []string                   `json:"tags,omitempty"`
+	Bindable      *bool                      `json:"bindable,omitempty"`
+	PlanUpdatable *bool                      `json:"plan_updateable,omitempty"`
+	Requires      []string                   `json:"requires,omitempty"`
+	Metadata      *brokerapi.ServiceMetadata `json:"metadata,omitempty"`
+	Plans         []*Plan                    `json:"plans"`
+}
+
+// PlanSchemas are the JSON schemas for the parameters a plan accepts.
+type PlanSchemas struct {
+	ServiceInstance *ServiceInstanceSchemas `json:"service_instance,omitempty"`
+	ServiceBinding  *ServiceBindingSchemas  `json:"service_binding,omitempty"`
+}
+
+// ServiceInstanceSchemas are the schemas for the parameters accepted when
+// creating and updating an instance.
+type ServiceInstanceSchemas struct {
+	Create *InputParametersSchema `json:"create,omitempty"`
+	Update *InputParametersSchema `json:"update,omitempty"`
+}
+
+// ServiceBindingSchemas are the schemas for the parameters accepted when
+// creating a binding.
+type ServiceBindingSchemas struct {
+	Create *InputParametersSchema `json:"create,omitempty"`
+}
+
+// InputParametersSchema holds the JSON schema for a set of parameters.
+type InputParametersSchema struct {
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// LoadCatalog reads the catalog document at the given path. Files with a
+// ".json" extension are decoded as JSON, and any other file as YAML. Fields the
+// broker does not know how to advertise are rejected.
+func LoadCatalog(path string) (*Catalog, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" {
+		var doc interface{}
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("failed to decode catalog %s: %s", path, err)
+		}
+		doc, err = yamlToJSON(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode catalog %s: %s", path, err)
+		}
+		if raw, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("failed to decode catalog %s: %s", path, err)
+		}
+	}
+
+	var catalog Catalog
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("failed to decode catalog %s: %s", path, err)
+	}
+	return &catalog, nil
+}
+
+// Validate ensures the catalog describes a service this broker is able to
+// offer. The broker offers exactly one bindable service, and does not support
+// any of the permissions a service may require.
+func (c *Catalog) Validate() error {
+	if len(c.Services) != 1 {
+		return fmt.Errorf("catalog must contain exactly one service, found %d", len(c.Services))
+	}
+	s := c.Services[0]
+	if s.ID == "" {
+		return fmt.Errorf("service %q is missing an id", s.Name)
+	}
+	if s.Name == "" {
+		return fmt.Errorf("service %q is missing a name", s.ID)
+	}
+	if s.Description == "" {
+		return fmt.Errorf("service %q is missing a description", s.Name)
+	}
+	if s.Bindable != nil && !*s.Bindable {
+		return fmt.Errorf("service %q must be bindable", s.Name)
+	}
+	if len(s.Requires) > 0 {
+		return fmt.Errorf("service %q cannot require %s, no permissions are supported", s.Name, strings.Join(s.Requires, ", "))
+	}
+	for _, p := range s.Plans {
+		if p.ID == "" {
+			return fmt.Errorf("plan %q is missing an id", p.Name)
+		}
+		if p.Bindable != nil && !*p.Bindable {
+			return fmt.Errorf("plan %q must be bindable", p.Name)
+		}
+		if err := p.Schemas.validate(); err != nil {
+			return fmt.Errorf("plan %q has invalid schemas: %s", p.Name, err)
+		}
+	}
+	return validatePlans(s.Plans)
+}
+
+// validate ensures the schemas only describe operations the broker supports.
+func (s *PlanSchemas) validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.ServiceInstance != nil {
+		if err := s.ServiceInstance.Create.validate(); err != nil {
+			return fmt.Errorf("service_instance.create: %s", err)
+		}
+		if err := s.ServiceInstance.Create.validateNames(instanceParameterNames); err != nil {
+			return fmt.Errorf("service_instance.create: %s", err)
+		}
+		if err := s.ServiceInstance.Update.validate(); err != nil {
+			return fmt.Errorf("service_instance.update: %s", err)
+		}
+		if err := s.ServiceInstance.Update.validateNames(updateParameterNames); err != nil {
+			return fmt.Errorf("service_instance.update: %s", err)
+		}
+	}
+	if s.ServiceBinding != nil {
+		if err := s.ServiceBinding.Create.validate(); err != nil {
+			return fmt.Errorf("service_binding.create: %s", err)
+		}
+		if err := s.ServiceBinding.Create.validateNames(bindingParameterNames); err != nil {
+			return fmt.Errorf("service_binding.create: %s", err)
+		}
+	}
+	return nil
+}
+
+// validate ensures the parameters schema describes an object, and only uses
+// keywords the broker is able to validate parameters against.
+func (s *InputParametersSchema) validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.Parameters == nil {
+		return fmt.Errorf("missing parameters schema")
+	}
+	if t, ok := s.Parameters["type"]; ok && t != "object" {
+		return fmt.Errorf("parameters must be of type object, not %v", t)
+	}
+	return checkSchema(s.Parameters)
+}
+
+// validateNames ensures the parameters schema only describes parameters with
+// the given names.
+func (s *InputParametersSchema) validateNames(names map[string]bool) error {
+	if s == nil {
+		return nil
+	}
+	props, _ := s.Parameters["properties"].(map[string]interface{})
+	for name := range props {
+		if !names[name] {
+			return fmt.Errorf("unsupported parameter %q", name)
+		}
+	}
+	return nil
+}
+
+// yamlToJSON converts the maps decoded from YAML, which may have keys of any
+// type, into maps with string keys so the document can be encoded as JSON.
+func yamlToJSON(v interface{}) (interface{}, error) {
+	switch typed := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(typed))
+		for k, v := range typed {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is %T, not string", k, k)
+			}
+			converted, err := yamlToJSON(v)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = converted
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(typed))
+		for i, v := range typed {
+			converted, err := yamlToJSON(v)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = converted
+		}
+		return l, nil
+	default:
+		return v, nil
+	}
+}
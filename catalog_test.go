@@ -0,0 +1,199 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testCatalogYAML = `
+services:
+- id: service-id
+  name: vault
+  description: Vault, by HashiCorp
+  bindable: true
+  tags: [vault, secrets]
+  metadata:
+    displayName: Vault
+    documentationUrl: https://docs.example.com/
+  plans:
+  - id: kv-only-id
+    name: kv-only
+    description: Secret storage
+    engines: [secret]
+    metadata:
+      displayName: KV only
+      bullets: [Secret storage]
+  - id: full-id
+    name: full
+    description: Secret storage and transit
+    engines: [secret, transit]
+    schemas:
+      service_instance:
+        create:
+          parameters:
+            type: object
+            properties:
+              description:
+                type: string
+`
+
+const testCatalogJSON = `{
+  "services": [{
+    "id": "service-id",
+    "name": "vault",
+    "description": "Vault, by HashiCorp",
+    "plans": [
+      {"id": "kv-only-id", "name": "kv-only", "description": "Secret storage", "engines": ["secret"]}
+    ]
+  }]
+}`
+
+func writeTestFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCatalog(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		contents string
+		plans    int
+	}{
+		{
+			"yaml",
+			"catalog.yml",
+			testCatalogYAML,
+			2,
+		},
+		{
+			"json",
+			"catalog.json",
+			testCatalogJSON,
+			1,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			catalog, err := LoadCatalog(writeTestFile(t, tc.file, tc.contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := catalog.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			s := catalog.Services[0]
+			if s.ID != "service-id" {
+				t.Errorf("expected %q but received %q", "service-id", s.ID)
+			}
+			if len(s.Plans) != tc.plans {
+				t.Fatalf("expected %d plans but received %d", tc.plans, len(s.Plans))
+			}
+			if s.Plans[0].Engines[0] != EngineSecret {
+				t.Errorf("expected %q but received %q", EngineSecret, s.Plans[0].Engines[0])
+			}
+		})
+	}
+}
+
+func TestLoadCatalog_Schemas(t *testing.T) {
+	catalog, err := LoadCatalog(writeTestFile(t, "catalog.yaml", testCatalogYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := catalog.Services[0].Plans[1].Schemas
+	if schemas == nil || schemas.ServiceInstance == nil || schemas.ServiceInstance.Create == nil {
+		t.Fatalf("expected an instance create schema but received %+v", schemas)
+	}
+	if schemas.ServiceInstance.Create.Parameters["type"] != "object" {
+		t.Fatalf("expected an object schema but received %+v", schemas.ServiceInstance.Create.Parameters)
+	}
+}
+
+func TestLoadCatalog_UnknownField(t *testing.T) {
+	_, err := LoadCatalog(writeTestFile(t, "catalog.json", `{"services": [{"id": "service-id", "dashboard_client": {}}]}`))
+	if err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func TestCatalog_Validate(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+	}{
+		{
+			"no-services",
+			`{"services": []}`,
+		},
+		{
+			"many-services",
+			`{"services": [
+				{"id": "a", "name": "a", "description": "a", "plans": [{"id": "a", "name": "a", "engines": ["secret"]}]},
+				{"id": "b", "name": "b", "description": "b", "plans": [{"id": "b", "name": "b", "engines": ["secret"]}]}
+			]}`,
+		},
+		{
+			"not-bindable",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "bindable": false, "plans": [{"id": "a", "name": "a", "engines": ["secret"]}]}]}`,
+		},
+		{
+			"requires",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "requires": ["syslog_drain"], "plans": [{"id": "a", "name": "a", "engines": ["secret"]}]}]}`,
+		},
+		{
+			"no-plans",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "plans": []}]}`,
+		},
+		{
+			"plan-missing-id",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "plans": [{"name": "a", "engines": ["secret"]}]}]}`,
+		},
+		{
+			"unsupported-update-parameter",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "plans": [{"id": "a", "name": "a", "engines": ["secret"],
+				"schemas": {"service_instance": {"update": {"parameters": {"type": "object", "properties": {"transit": {}}}}}}}]}]}`,
+		},
+		{
+			"unsupported-schema-keyword",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "plans": [{"id": "a", "name": "a", "engines": ["secret"],
+				"schemas": {"service_instance": {"create": {"parameters": {"type": "object", "anyOf": []}}}}}]}]}`,
+		},
+		{
+			"unsupported-parameter",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "plans": [{"id": "a", "name": "a", "engines": ["secret"],
+				"schemas": {"service_instance": {"create": {"parameters": {"type": "object", "properties": {"foo": {}}}}}}}]}]}`,
+		},
+		{
+			"unsupported-binding-parameter",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "plans": [{"id": "a", "name": "a", "engines": ["secret"],
+				"schemas": {"service_binding": {"create": {"parameters": {"type": "object", "properties": {"ttl": {}}}}}}}]}]}`,
+		},
+		{
+			"non-object-schema",
+			`{"services": [{"id": "a", "name": "a", "description": "a", "plans": [{"id": "a", "name": "a", "engines": ["secret"],
+				"schemas": {"service_binding": {"create": {"parameters": {"type": "string"}}}}}]}]}`,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			catalog, err := LoadCatalog(writeTestFile(t, "catalog.json", tc.contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := catalog.Validate(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
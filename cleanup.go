@@ -0,0 +1,268 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// SharedMountCleanupNever keeps the shared backends of organizations,
+	// spaces, and applications mounted forever.
+	SharedMountCleanupNever = "never"
+
+	// SharedMountCleanupArchive archives the secrets of a shared KV backend
+	// once no instance or binding references it anymore, and then unmounts
+	// it. Other backends are kept, since their data cannot be archived.
+	SharedMountCleanupArchive = "archive"
+
+	// SharedMountCleanupUnmount unmounts a shared backend once no instance or
+	// binding references it anymore, deleting its data.
+	SharedMountCleanupUnmount = "unmount"
+)
+
+// mountReferencesDir is the directory of the state backend where the broker
+// stores the references to each shared backend, at "<mount_path>". It is not
+// a GUID, so it is never mistaken for the record of an instance.
+const mountReferencesDir = "_mounts"
+
+// sharedMountCleanups are the ways the broker may clean up shared backends.
+var sharedMountCleanups = map[string]bool{
+	SharedMountCleanupNever:   true,
+	SharedMountCleanupArchive: true,
+	SharedMountCleanupUnmount: true,
+}
+
+// mountOwner is the organization, space, and application a shared backend
+// belongs to. The backend of an organization has no space, and only the
+// backends of applications have an application.
+type mountOwner struct {
+	OrganizationGUID string
+	SpaceGUID        string `json:",omitempty"`
+	ApplicationGUID  string `json:",omitempty"`
+}
+
+// mountReferences is the record of the instances and bindings referencing a
+// shared backend.
+type mountReferences struct {
+	mountOwner
+
+	// References are the IDs of the instances, and the
+	// "<instance_id>/<binding_id>" of the bindings, referencing the backend.
+	// The backend is cleaned up once there are none left.
+	References map[string]bool
+}
+
+// instanceSharedMounts returns the shared backends of the organization and
+// space of the instance, and who they belong to.
+func instanceSharedMounts(info *instanceInfo) map[string]mountOwner {
+	return map[string]mountOwner{
+		"cf/" + info.OrganizationGUID + "/secret": {
+			OrganizationGUID: info.OrganizationGUID,
+		},
+		"cf/" + info.SpaceGUID + "/secret": {
+			OrganizationGUID: info.OrganizationGUID,
+			SpaceGUID:        info.SpaceGUID,
+		},
+	}
+}
+
+// applicationMounts returns the shared backends of the application in the
+// organization and space, for every engine, and who they belong to.
+func applicationMounts(application, organizationGUID, spaceGUID string) map[string]mountOwner {
+	owner := mountOwner{
+		OrganizationGUID: organizationGUID,
+		SpaceGUID:        spaceGUID,
+		ApplicationGUID:  application,
+	}
+	mounts := make(map[string]mountOwner)
+	for _, e := range (&instanceInfo{}).engines() {
+		mounts["cf/"+application+"/"+e] = owner
+	}
+	return mounts
+}
+
+// sortedMounts returns the paths of the mounts in order, so that they are
+// always locked and logged in the same order.
+func sortedMounts(mounts map[string]mountOwner) []string {
+	paths := make([]string, 0, len(mounts))
+	for p := range mounts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// releasingAny returns true if any of the shared backends is being cleaned up.
+func (b *Broker) releasingAny(mounts map[string]mountOwner) bool {
+	b.referencesLock.Lock()
+	defer b.referencesLock.Unlock()
+	return b.releasingAnyLocked(mounts)
+}
+
+// releasingAnyLocked is releasingAny, which must be called with referencesLock
+// held.
+func (b *Broker) releasingAnyLocked(mounts map[string]mountOwner) bool {
+	for p := range mounts {
+		if b.releasing[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireMounts records that the instance or binding of the reference uses the
+// shared backends, which keeps them from being cleaned up until it releases
+// them. It returns an ErrConcurrentOperation if any of them is being cleaned
+// up, and must be called before the backends are mounted, so that they are not
+// cleaned up from under the instance or binding. Recording a reference again
+// does nothing.
+func (b *Broker) acquireMounts(ref string, mounts map[string]mountOwner) error {
+	b.referencesLock.Lock()
+	defer b.referencesLock.Unlock()
+	if b.releasingAnyLocked(mounts) {
+		return b.error(ErrConcurrentOperation)
+	}
+
+	for _, p := range sortedMounts(mounts) {
+		path := mountReferencesDir + "/" + p
+		refs := new(mountReferences)
+		if _, err := b.readState(path, recordKindMount, refs); err != nil {
+			return b.wErrorf(err, "failed to read references to %s", p)
+		}
+		if refs.References[ref] {
+			continue
+		}
+		if refs.References == nil {
+			refs.References = make(map[string]bool)
+		}
+		refs.mountOwner = mounts[p]
+		refs.References[ref] = true
+		b.log.Printf("[DEBUG] adding reference of %s to %s, which now has %d", ref, p, len(refs.References))
+		if err := b.writeState(path, recordKindMount, refs); err != nil {
+			return b.wErrorf(err, "failed to store references to %s", p)
+		}
+	}
+	return nil
+}
+
+// referenceRestoredMounts records the references of the restored instances
+// and bindings to their shared backends. It must be called before the broker
+// starts serving requests.
+func (b *Broker) referenceRestoredMounts() error {
+	for instanceID, info := range b.instances {
+		if err := b.acquireMounts(instanceID, instanceSharedMounts(info)); err != nil {
+			return err
+		}
+	}
+	for bindingID, info := range b.binds {
+		if info.Application == "" {
+			continue
+		}
+		mounts := applicationMounts(info.Application, info.Organization, info.Space)
+		if err := b.acquireMounts(info.Instance+"/"+bindingID, mounts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseMounts removes the reference of the instance or binding to the shared
+// backends, and cleans up those no instance or binding references anymore, as
+// the broker is configured to. The instance or binding must no longer use
+// them. Failures are logged rather than returned, since a reference left
+// behind only keeps a backend mounted, and the backends can still be cleaned
+// up by an operator. The backends are claimed while they are cleaned up, which
+// keeps them from being mounted again until they are.
+func (b *Broker) releaseMounts(ref string, mounts map[string]mountOwner) {
+	cleanup := b.sharedMountCleanup != "" && b.sharedMountCleanup != SharedMountCleanupNever
+
+	b.referencesLock.Lock()
+	var claimed []string
+	for _, p := range sortedMounts(mounts) {
+		path := mountReferencesDir + "/" + p
+		refs := new(mountReferences)
+		ok, err := b.readState(path, recordKindMount, refs)
+		if err != nil {
+			b.log.Printf("[WARN] failed to read references to %s: %s", p, err)
+			continue
+		}
+		delete(refs.References, ref)
+		if len(refs.References) > 0 {
+			b.log.Printf("[DEBUG] removing reference of %s to %s, which now has %d", ref, p, len(refs.References))
+			if err := b.writeState(path, recordKindMount, refs); err != nil {
+				b.log.Printf("[WARN] failed to store references to %s: %s", p, err)
+			}
+			continue
+		}
+		if ok {
+			b.log.Printf("[DEBUG] removing last reference of %s to %s", ref, p)
+			if err := b.deleteState(path); err != nil {
+				b.log.Printf("[WARN] failed to delete references to %s: %s", p, err)
+				continue
+			}
+		}
+		if !cleanup || b.releasing[p] {
+			continue
+		}
+		if b.releasing == nil {
+			b.releasing = make(map[string]bool)
+		}
+		b.releasing[p] = true
+		claimed = append(claimed, p)
+	}
+	b.referencesLock.Unlock()
+	if len(claimed) == 0 {
+		return
+	}
+	defer func() {
+		b.referencesLock.Lock()
+		defer b.referencesLock.Unlock()
+		for _, p := range claimed {
+			delete(b.releasing, p)
+		}
+	}()
+
+	b.mountMutex.Lock()
+	result, err := b.vaultClient.Sys().ListMounts()
+	b.mountMutex.Unlock()
+	if err != nil {
+		b.log.Printf("[WARN] failed to list mounts to clean up: %s", err)
+		return
+	}
+	mounted := make(map[string]*api.MountOutput, len(result))
+	for k, m := range result {
+		mounted[strings.Trim(k, "/")] = m
+	}
+
+	var unmount []string
+	for _, p := range claimed {
+		m, ok := mounted[p]
+		if !ok {
+			continue
+		}
+		if b.sharedMountCleanup == SharedMountCleanupArchive {
+			if mountKVVersion(m) == 0 {
+				b.log.Printf("[INFO] keeping unreferenced %s backend %s, which cannot be archived", m.Type, p)
+				continue
+			}
+			if _, err := b.archiveMount(p, m, mounts[p]); err != nil {
+				b.log.Printf("[WARN] keeping unreferenced backend %s: %s", p, err)
+				continue
+			}
+		}
+		unmount = append(unmount, p)
+	}
+	if len(unmount) == 0 {
+		return
+	}
+
+	b.log.Printf("[INFO] removing unreferenced mounts %s", strings.Join(unmount, ", "))
+	if err := b.idempotentUnmount(unmount); err != nil {
+		b.log.Printf("[WARN] failed to remove unreferenced mounts: %s", err)
+	}
+}
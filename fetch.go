@@ -0,0 +1,159 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var (
+	// ErrInstanceNotFound is returned when fetching an instance that does not
+	// exist, or is still being provisioned.
+	ErrInstanceNotFound = brokerapi.NewFailureResponse(
+		errors.New("instance does not exist"), http.StatusNotFound, "instance-not-found")
+
+	// ErrBindingNotFound is returned when fetching a binding that does not
+	// exist.
+	ErrBindingNotFound = brokerapi.NewFailureResponse(
+		errors.New("binding does not exist"), http.StatusNotFound, "binding-not-found")
+)
+
+// GetInstanceDetailsSpec is an instance as returned when fetching it.
+type GetInstanceDetailsSpec struct {
+	ServiceID    string              `json:"service_id"`
+	PlanID       string              `json:"plan_id"`
+	DashboardURL string              `json:"dashboard_url,omitempty"`
+	Parameters   *instanceParameters `json:"parameters,omitempty"`
+}
+
+// GetBindingSpec is a binding as returned when fetching it.
+type GetBindingSpec struct {
+	brokerapi.Binding
+
+	// Health is the health of the binding's token, once renewing it failed.
+	Health *bindingHealth `json:"health,omitempty"`
+
+	// Renewal is the state of the renewal of the binding's token, while the
+	// broker renews it.
+	Renewal *bindingRenewal `json:"renewal,omitempty"`
+}
+
+// bindingRenewal is the state of the renewal of a binding's token, as returned
+// when fetching the binding.
+type bindingRenewal struct {
+	// NextRenewal is when the token is next renewed, and LastRenewal when it
+	// last was, with a TTL of TTL.
+	NextRenewal time.Time  `json:"next_renewal"`
+	LastRenewal *time.Time `json:"last_renewal,omitempty"`
+	TTL         string     `json:"ttl,omitempty"`
+
+	// Failures is the number of attempts to renew the token that failed
+	// since it was last renewed, and LastError the error of the last one.
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// newBindingRenewal returns the renewal state of a binding's token from the
+// status of its renewal.
+func newBindingRenewal(status renewalStatus) *bindingRenewal {
+	renewal := &bindingRenewal{
+		NextRenewal: status.NextRenewal.UTC(),
+		Failures:    status.Failures,
+		LastError:   status.LastError,
+	}
+	if !status.LastRenewal.IsZero() {
+		lastRenewal := status.LastRenewal.UTC()
+		renewal.LastRenewal = &lastRenewal
+		renewal.TTL = status.TTL.String()
+	}
+	return renewal
+}
+
+// GetInstance returns the plan and parameters of the instance.
+func (b *Broker) GetInstance(ctx context.Context, instanceID string) (GetInstanceDetailsSpec, error) {
+	b.log.Printf("[INFO] fetching instance %s", instanceID)
+
+	var spec GetInstanceDetailsSpec
+
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	instance, ok := b.instances[instanceID]
+	if !ok {
+		return spec, b.error(ErrInstanceNotFound)
+	}
+	switch instance.operationInProgress() {
+	case "":
+	case OperationProvision:
+		return spec, b.error(ErrInstanceNotFound)
+	default:
+		return spec, b.error(ErrConcurrentOperation)
+	}
+	plan, err := b.plan(instance.PlanID)
+	if err != nil {
+		return spec, b.error(err)
+	}
+
+	spec.ServiceID = b.serviceID
+	spec.PlanID = plan.ID
+	spec.Parameters = instance.Parameters
+	return spec, nil
+}
+
+// GetBinding returns the credentials of the binding as Bind returned them, or
+// with the token that replaced a failed one, and the health and renewal of its
+// token.
+func (b *Broker) GetBinding(ctx context.Context, instanceID, bindingID string) (GetBindingSpec, error) {
+	b.log.Printf("[INFO] fetching binding %s of instance %s", bindingID, instanceID)
+
+	var binding GetBindingSpec
+
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	instance, ok := b.instances[instanceID]
+	if !ok {
+		return binding, b.error(ErrInstanceNotFound)
+	}
+
+	path := instanceID + "/" + bindingID
+	info := new(bindingInfo)
+	ok, err := b.readState(path, recordKindBinding, info)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to read binding info for %s", path)
+	}
+	if !ok {
+		return binding, b.error(ErrBindingNotFound)
+	}
+
+	// The secret of a binding whose credentials were response-wrapped was
+	// only ever handed out in its single-use wrapping token.
+	auth := info.auth()
+	if info.Wrapped {
+		for _, k := range credentialSecrets {
+			delete(auth, k)
+		}
+	}
+	credentials, err := b.bindingCredentials(instanceID, instance, info, auth)
+	if err != nil {
+		return binding, err
+	}
+	binding.Credentials = credentials
+	binding.Health = info.Health
+
+	if info.renewable() {
+		b.startLock.Lock()
+		renewals := b.renewals
+		b.startLock.Unlock()
+		if status, ok := renewals.status(info.Accessor); ok {
+			binding.Renewal = newBindingRenewal(status)
+		}
+	}
+	return binding, nil
+}
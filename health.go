@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	// healthCheckTimeout bounds the requests to Vault of a readiness check.
+	healthCheckTimeout = 5 * time.Second
+
+	// renewalBacklogGrace is how overdue the renewal of a token may be before
+	// the broker is not ready, because its workers cannot keep up.
+	renewalBacklogGrace = time.Minute
+)
+
+// healthCheck is the outcome of one check of the broker's readiness. Since it
+// is served without authentication, the error is a generic description of the
+// failure, whose details are logged instead.
+type healthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// readinessResponse is the response of the readiness endpoint.
+type readinessResponse struct {
+	Ready  bool          `json:"ready"`
+	Checks []healthCheck `json:"checks"`
+}
+
+// handleLive serves the liveness of the broker, which is live as long as it
+// serves requests.
+func (b *Broker) handleLive(w http.ResponseWriter, r *http.Request) {
+	b.respond(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady serves the readiness of the broker. It responds with 200 OK if
+// every check passes, and 503 Service Unavailable otherwise.
+func (b *Broker) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	resp := readinessResponse{
+		Ready: true,
+		Checks: []healthCheck{
+			b.checkStarted(),
+			b.checkToken(ctx),
+			b.checkState(ctx),
+			b.checkRenewals(),
+		},
+	}
+	status := http.StatusOK
+	for _, c := range resp.Checks {
+		if !c.Healthy {
+			resp.Ready = false
+			status = http.StatusServiceUnavailable
+		}
+	}
+	b.respond(w, status, resp)
+}
+
+// newHealthCheck returns the check with the name, which failed with the error
+// if it is not nil. The error is logged, and the check reports the generic
+// description of its failure instead.
+func (b *Broker) newHealthCheck(name, description string, err error) healthCheck {
+	if err != nil {
+		b.log.Printf("[WARN] readiness check %s failed: %s", name, err)
+		return healthCheck{Name: name, Error: description}
+	}
+	return healthCheck{Name: name, Healthy: true}
+}
+
+// requireStarted responds to requests with 503 Service Unavailable until the
+// broker started, since its health is served while it starts.
+func (b *Broker) requireStarted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.isStarted() {
+			b.respond(w, http.StatusServiceUnavailable, brokerapi.ErrorResponse{
+				Description: "broker is starting",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isStarted returns true if the broker started.
+func (b *Broker) isStarted() bool {
+	b.startLock.Lock()
+	defer b.startLock.Unlock()
+	return b.started
+}
+
+// checkStarted checks that the broker started.
+func (b *Broker) checkStarted() healthCheck {
+	var err error
+	if !b.isStarted() {
+		err = fmt.Errorf("broker is not running")
+	}
+	return b.newHealthCheck("started", "broker is not running", err)
+}
+
+// checkToken checks that the broker's token is valid.
+func (b *Broker) checkToken(ctx context.Context) healthCheck {
+	_, err := b.vaultClient.Auth().Token().LookupSelfWithContext(ctx)
+	return b.newHealthCheck("token", "token lookup failed", err)
+}
+
+// checkState checks that the state backend is reachable.
+func (b *Broker) checkState(ctx context.Context) healthCheck {
+	_, err := b.vaultClient.Logical().ReadWithContext(ctx, StateMount+"/config")
+	return b.newHealthCheck("state", "state backend is unreachable", err)
+}
+
+// checkRenewals checks that no renewal of a binding token is overdue by more
+// than renewalBacklogGrace.
+func (b *Broker) checkRenewals() healthCheck {
+	b.startLock.Lock()
+	renewals := b.renewals
+	b.startLock.Unlock()
+
+	var err error
+	if n := renewals.backlog(renewalBacklogGrace); n > 0 {
+		err = fmt.Errorf("%d token renewals are overdue by more than %s", n, renewalBacklogGrace)
+	}
+	return b.newHealthCheck("renewals", "token renewals are overdue", err)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// kvMountInput returns the input used to mount a KV secrets engine of the given
+// version. Version 1 is mounted as the "generic" type, as it always has been.
+func kvMountInput(version int) *api.MountInput {
+	if version == 2 {
+		return &api.MountInput{
+			Type:    "kv",
+			Options: map[string]string{"version": "2"},
+		}
+	}
+	return &api.MountInput{Type: "generic"}
+}
+
+// mountKVVersion returns the version of the KV secrets engine at the mount, or
+// 0 if the mount is not a KV secrets engine.
+func mountKVVersion(m *api.MountOutput) int {
+	switch m.Type {
+	case "generic":
+		return 1
+	case "kv":
+		if m.Options["version"] == "2" {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// defaultKVVersion returns the version of the KV secrets engine mounted for new
+// secret backends.
+func (b *Broker) defaultKVVersion() int {
+	if b.kvVersion == 0 {
+		return 1
+	}
+	return b.kvVersion
+}
+
+// instanceKVVersion returns the version of the KV secrets engine mounted for
+// the instance's own secret backend.
+func (b *Broker) instanceKVVersion(info *instanceInfo) int {
+	if info.Parameters != nil && info.Parameters.KVVersion != 0 {
+		return info.Parameters.KVVersion
+	}
+	return b.defaultKVVersion()
+}
+
+// kvVersions returns the version of the KV secrets engine of each secret
+// backend the instance has access to, keyed by mount path. Backends shared
+// with other instances may have been mounted with a different version than
+// the broker would use today, so the versions are read from the mount table,
+// and only backends missing from it are assumed to have the version they
+// would be mounted with.
+func (b *Broker) kvVersions(instanceID string, info *instanceInfo) (map[string]int, error) {
+	versions := map[string]int{
+		"cf/" + info.OrganizationGUID + "/secret": b.defaultKVVersion(),
+		"cf/" + info.SpaceGUID + "/secret":        b.defaultKVVersion(),
+	}
+	if info.hasEngine(EngineSecret) {
+		versions["cf/"+instanceID+"/secret"] = b.instanceKVVersion(info)
+		if info.ApplicationGUID != "" {
+			versions["cf/"+info.ApplicationGUID+"/secret"] = b.defaultKVVersion()
+		}
+	}
+
+	b.mountMutex.Lock()
+	defer b.mountMutex.Unlock()
+	mounts, err := b.vaultClient.Sys().ListMounts()
+	if err != nil {
+		return nil, err
+	}
+	for k, m := range mounts {
+		k = strings.Trim(k, "/")
+		if _, ok := versions[k]; !ok {
+			continue
+		}
+		if v := mountKVVersion(m); v != 0 {
+			versions[k] = v
+		}
+	}
+	return versions, nil
+}
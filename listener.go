@@ -0,0 +1,193 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// certificatePollInterval is how often the files of the broker's certificate
+// are checked for changes.
+const certificatePollInterval = 10 * time.Second
+
+// tlsVersions are the minimum TLS versions the broker's listener may be
+// configured with.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certificateReloader serves the certificate in certFile and the key in
+// keyFile, loading them again when they change.
+type certificateReloader struct {
+	log      *log.Logger
+	certFile string
+	keyFile  string
+
+	// lock guards cert and the modification times of the files it was loaded
+	// from.
+	lock                    sync.RWMutex
+	cert                    *tls.Certificate
+	certModTime, keyModTime time.Time
+}
+
+// newCertificateReloader returns a reloader serving the certificate in the
+// files, which must be valid.
+func newCertificateReloader(logger *log.Logger, certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		log:      logger,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate again. If it is not valid, the certificate that
+// was loaded last is still served, and it is not loaded again until its files
+// change.
+func (r *certificateReloader) reload() error {
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	return nil
+}
+
+// modTimes returns when the certificate and key files were last modified.
+func (r *certificateReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// changed returns true if either file was modified since the certificate was
+// loaded.
+func (r *certificateReloader) changed() bool {
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		// The files may be being replaced
+		return false
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime)
+}
+
+// GetCertificate returns the certificate that was loaded last. It is the
+// GetCertificate of the listener's TLS config.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate whenever its files change, or a value is sent
+// on reloadCh, until stopCh is closed.
+func (r *certificateReloader) watch(interval time.Duration, reloadCh <-chan os.Signal, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			r.log.Printf("[INFO] certificate %s changed, reloading", r.certFile)
+		case s := <-reloadCh:
+			r.log.Printf("[INFO] received signal %s, reloading certificate %s", s, r.certFile)
+		case <-stopCh:
+			return
+		}
+		if err := r.reload(); err != nil {
+			r.log.Printf("[ERR] failed to reload certificate %s, still serving the previous one: %s", r.certFile, err)
+		}
+	}
+}
+
+// loadCertPool returns a pool of the PEM-encoded certificates in the file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("no PEM-encoded certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig returns the TLS config of the broker's listener, serving the
+// certificate of the reloader, or nil if the listener does not use TLS.
+func (c *Configuration) serverTLSConfig(certs *certificateReloader) (*tls.Config, error) {
+	if c.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tlsVersions[c.TLSMinVersion],
+	}
+	if c.TLSClientCAFile != "" {
+		pool, err := loadCertPool(c.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// The health of the broker is served without a client certificate,
+		// so the requests to the Open Service Broker API without one are
+		// rejected by requireClientCert instead
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// requireClientCert rejects the requests that were not made with a verified
+// client certificate, if the broker requires them.
+func (b *Broker) requireClientCert(next http.Handler) http.Handler {
+	if !b.requireClientCerts {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			b.respond(w, http.StatusForbidden, brokerapi.ErrorResponse{
+				Description: "a verified client certificate is required",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
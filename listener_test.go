@@ -0,0 +1,179 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificateFiles writes a certificate from testCertificate and its key to
+// files in the directory, and returns the certificate.
+func testCertificateFiles(t *testing.T, dir string) string {
+	cert, key := testCertificate(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testServedCertificate returns the certificate the reloader serves.
+func testServedCertificate(t *testing.T, r *certificateReloader) *x509.Certificate {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	testCertificateFiles(t, dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	r, err := newCertificateReloader(log.New(ioutil.Discard, "", 0), certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := testServedCertificate(t, r)
+
+	reloadCh := make(chan os.Signal, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go r.watch(10*time.Millisecond, reloadCh, stopCh)
+
+	waitForChange := func(changed bool) *x509.Certificate {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			served := testServedCertificate(t, r)
+			if !served.Equal(first) == changed {
+				return served
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the certificate to have changed to be %t", changed)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// An invalid certificate is not served
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	waitForChange(false)
+
+	// A new certificate is served once its files change
+	testCertificateFiles(t, dir)
+	first = waitForChange(true)
+
+	// Or once the broker is signalled, even if they look unchanged
+	r.lock.RLock()
+	certModTime, keyModTime := r.certModTime, r.keyModTime
+	r.lock.RUnlock()
+	newDir := t.TempDir()
+	testCertificateFiles(t, newDir)
+	os.Chtimes(filepath.Join(newDir, "cert.pem"), certModTime, certModTime)
+	os.Chtimes(filepath.Join(newDir, "key.pem"), keyModTime, keyModTime)
+	if err := os.Rename(filepath.Join(newDir, "cert.pem"), certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(newDir, "key.pem"), keyFile); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	waitForChange(false)
+	reloadCh <- os.Interrupt
+	waitForChange(true)
+}
+
+func TestConfiguration_serverTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := testCertificateFiles(t, dir)
+	clientCert, clientKey := testCertificate(t)
+	clientCAFile := filepath.Join(dir, "client-ca.pem")
+	if err := ioutil.WriteFile(clientCAFile, []byte(clientCert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Configuration{
+		TLSCertFile:     filepath.Join(dir, "cert.pem"),
+		TLSKeyFile:      filepath.Join(dir, "key.pem"),
+		TLSMinVersion:   "1.3",
+		TLSClientCAFile: clientCAFile,
+	}
+
+	certs, err := newCertificateReloader(log.New(ioutil.Discard, "", 0), config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := config.serverTLSConfig(certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Broker{log: log.New(ioutil.Discard, "", 0), requireClientCerts: true}
+	server := &http.Server{Handler: b.requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))}
+	go server.Serve(tls.NewListener(ln, tlsConfig))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(serverCert))
+	cert, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients without a certificate are rejected by the handler rather than
+	// the listener, which also serves the health of the broker
+	cases := []struct {
+		name   string
+		config *tls.Config
+		status int
+		err    bool
+	}{
+		{"client-cert", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}, http.StatusOK, false},
+		{"no-client-cert", &tls.Config{RootCAs: roots}, http.StatusForbidden, false},
+		{"old-version", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}, 0, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc.config}}
+			resp, err := client.Get("https://" + ln.Addr().String())
+			if (err != nil) != tc.err {
+				t.Fatalf("expected an error to be %t but received %v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected %d but received %d", tc.status, resp.StatusCode)
+			}
+		})
+	}
+
+	if tlsConfig, err := (&Configuration{}).serverTLSConfig(nil); err != nil || tlsConfig != nil {
+		t.Fatalf("expected no TLS config but received %v and %v", tlsConfig, err)
+	}
+}
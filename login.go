@@ -0,0 +1,420 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// loginFraction is the fraction of the TTL of the broker's token after
+	// which the broker logs in again.
+	loginFraction = 2.0 / 3.0
+
+	// loginRetry is how long the broker waits to log in again after failing
+	// to.
+	loginRetry = 10 * time.Second
+
+	// tokenFilePollInterval is how often the broker looks for a new token in
+	// its token file.
+	tokenFilePollInterval = 5 * time.Second
+)
+
+// brokerLogin is a way for the broker to log in to Vault.
+type brokerLogin interface {
+	// login returns the auth of a new token for the broker, logging in with
+	// the client, which has no token.
+	login(ctx context.Context, client *api.Client) (*api.SecretAuth, error)
+
+	// owned returns true if only the broker uses the tokens it logs in with,
+	// so that the token each login replaces is revoked.
+	owned() bool
+
+	// String describes the login method for logs.
+	String() string
+}
+
+// appRoleLogin logs the broker in with the role ID and secret ID of an AppRole
+// in the AppRole auth method at the path.
+type appRoleLogin struct {
+	path     string
+	roleID   string
+	secretID string
+}
+
+func (l *appRoleLogin) login(ctx context.Context, client *api.Client) (*api.SecretAuth, error) {
+	secret, err := client.Logical().WriteWithContext(ctx, "auth/"+l.path+"/login", map[string]interface{}{
+		"role_id":   l.roleID,
+		"secret_id": l.secretID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, fmt.Errorf("login returned no auth")
+	}
+	return secret.Auth, nil
+}
+
+func (l *appRoleLogin) owned() bool {
+	return true
+}
+
+func (l *appRoleLogin) String() string {
+	return "AppRole at auth/" + l.path
+}
+
+// watchedLogin is a way for the broker to log in whose credentials change
+// outside the broker, which the login manager polls for changes.
+type watchedLogin interface {
+	brokerLogin
+
+	// changed returns true if the broker should log in again because its
+	// credentials changed since it logged in with the current token.
+	changed(current string) bool
+
+	// interval is how often changed is polled.
+	interval() time.Duration
+}
+
+// tokenFileLogin reads the broker's token from the file at the path, which
+// something other than the broker keeps up to date, such as the sink of a Vault
+// Agent. The file is polled every poll for a new token.
+type tokenFileLogin struct {
+	path string
+	poll time.Duration
+
+	// rejected is the last token read from the file that was not valid, which
+	// is not tried again until the file changes.
+	rejected string
+}
+
+func (l *tokenFileLogin) login(ctx context.Context, client *api.Client) (*api.SecretAuth, error) {
+	contents, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return nil, fmt.Errorf("%s is empty", l.path)
+	}
+
+	// Look the token up to learn when it expires
+	client.SetToken(token)
+	defer client.ClearToken()
+	secret, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		l.rejected = token
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("token lookup returned no data")
+	}
+	l.rejected = ""
+	auth := &api.SecretAuth{ClientToken: token}
+	if ttl, ok := secret.Data["ttl"].(json.Number); ok {
+		seconds, err := ttl.Int64()
+		if err != nil {
+			return nil, err
+		}
+		auth.LeaseDuration = int(seconds)
+	}
+	auth.Renewable, _ = secret.Data["renewable"].(bool)
+	return auth, nil
+}
+
+func (l *tokenFileLogin) changed(current string) bool {
+	contents, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		// The file may be replaced, so keep the current token until the new
+		// one is there
+		return false
+	}
+	token := strings.TrimSpace(string(contents))
+	return token != "" && token != current && token != l.rejected
+}
+
+func (l *tokenFileLogin) interval() time.Duration {
+	if l.poll <= 0 {
+		return tokenFilePollInterval
+	}
+	return l.poll
+}
+
+// owned returns false, since the tokens in the file belong to whatever writes
+// it.
+func (l *tokenFileLogin) owned() bool {
+	return false
+}
+
+func (l *tokenFileLogin) String() string {
+	return "token file " + l.path
+}
+
+// loginContextKey marks the context of the requests the login manager makes
+// itself, which loginTransport passes through as they are.
+type loginContextKey struct{}
+
+// loginManager keeps the broker logged in to Vault. It logs in again before
+// the broker's token expires, and when Vault rejects the token, swapping the
+// token of the broker's client. The client guards its token, so requests in
+// flight are unaffected.
+type loginManager struct {
+	log    *log.Logger
+	client *api.Client
+	method brokerLogin
+
+	// loginClient is a clone of client without a token, which logs in. It
+	// shares the headers of client, such as its namespace.
+	loginClient *api.Client
+
+	// lock serializes logins. next is when the broker next logs in, or zero
+	// if its token does not expire, and token the token it last logged in
+	// with.
+	lock  sync.Mutex
+	next  time.Time
+	token string
+
+	wakeCh chan struct{}
+}
+
+// newLoginManager returns a manager logging the client in with the method.
+func newLoginManager(logger *log.Logger, client *api.Client, method brokerLogin) (*loginManager, error) {
+	loginClient, err := client.Clone()
+	if err != nil {
+		return nil, err
+	}
+	loginClient.ClearToken()
+	loginClient.SetHeaders(client.Headers())
+	return &loginManager{
+		log:         logger,
+		client:      client,
+		method:      method,
+		loginClient: loginClient,
+		wakeCh:      make(chan struct{}, 1),
+	}, nil
+}
+
+// login logs the broker in, and sets the token of its client.
+func (m *loginManager) login() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.loginLocked()
+}
+
+// loginLocked logs the broker in. It must be called with lock held.
+func (m *loginManager) loginLocked() error {
+	ctx := context.WithValue(context.Background(), loginContextKey{}, true)
+	auth, err := m.method.login(ctx, m.loginClient)
+	if err != nil {
+		m.next = time.Now().Add(loginRetry)
+		m.wake()
+		return err
+	}
+
+	// Swap the token before revoking the one it replaces, so that no request
+	// is made with a revoked token
+	previous := m.token
+	m.token = auth.ClientToken
+	m.client.SetToken(auth.ClientToken)
+	if m.method.owned() && previous != "" && previous != auth.ClientToken {
+		m.revoke(ctx, previous)
+	}
+
+	m.next = time.Time{}
+	if auth.LeaseDuration > 0 {
+		ttl := time.Duration(auth.LeaseDuration) * time.Second
+		m.next = time.Now().Add(time.Duration(float64(ttl) * loginFraction))
+		m.log.Printf("[INFO] login: logged in with %s, token expires in %s", m.method, ttl)
+	} else {
+		m.log.Printf("[INFO] login: logged in with %s, token does not expire", m.method)
+	}
+	m.wake()
+	return nil
+}
+
+// relogin logs the broker in again after Vault rejected the stale token, and
+// returns the new token. It returns an empty token if the stale token is still
+// valid, since Vault then rejected the request for another reason. A token that
+// another request already replaced is not replaced again.
+func (m *loginManager) relogin(stale string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if current := m.client.Token(); current != stale {
+		return current, nil
+	}
+
+	ctx := context.WithValue(context.Background(), loginContextKey{}, true)
+	client, err := m.tokenClient(stale)
+	if err != nil {
+		return "", err
+	}
+	if _, err := client.Auth().Token().LookupSelfWithContext(ctx); err == nil {
+		return "", nil
+	}
+
+	m.log.Printf("[WARN] login: Vault rejected the broker's token, logging in again")
+	if err := m.loginLocked(); err != nil {
+		return "", err
+	}
+	return m.client.Token(), nil
+}
+
+// tokenClient returns a clone of loginClient with the token.
+func (m *loginManager) tokenClient(token string) (*api.Client, error) {
+	client, err := m.loginClient.Clone()
+	if err != nil {
+		return nil, err
+	}
+	client.SetHeaders(m.loginClient.Headers())
+	client.SetToken(token)
+	return client, nil
+}
+
+// revoke revokes the token the broker no longer uses, with the token itself.
+// Failures are logged rather than returned, since the token still expires. A
+// token Vault already rejects needs no revoking.
+func (m *loginManager) revoke(ctx context.Context, token string) {
+	client, err := m.tokenClient(token)
+	if err == nil {
+		err = client.Auth().Token().RevokeSelfWithContext(ctx, "")
+	}
+	if respErr, ok := err.(*api.ResponseError); ok && respErr.StatusCode == http.StatusForbidden {
+		return
+	}
+	if err != nil {
+		m.log.Printf("[WARN] login: failed to revoke the broker's previous token: %s", err)
+		return
+	}
+	m.log.Printf("[DEBUG] login: revoked the broker's previous token")
+}
+
+// wake wakes run to look at when the broker next logs in.
+func (m *loginManager) wake() {
+	select {
+	case m.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// run logs the broker in again before its token expires, and when its
+// credentials change if they are watched, until stopCh is closed.
+func (m *loginManager) run(stopCh <-chan struct{}) {
+	if watched, ok := m.method.(watchedLogin); ok {
+		go m.watch(watched, stopCh)
+	}
+
+	for {
+		m.lock.Lock()
+		next := m.next
+		m.lock.Unlock()
+
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timerCh = timer.C
+		}
+		select {
+		case <-timerCh:
+			if err := m.login(); err != nil {
+				m.log.Printf("[ERR] login: failed to log in with %s, retrying in %s: %s", m.method, loginRetry, err)
+			}
+		case <-m.wakeCh:
+		case <-stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// watch logs the broker in again whenever the credentials of the method
+// change, until stopCh is closed.
+func (m *loginManager) watch(method watchedLogin, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(method.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.lock.Lock()
+			if method.changed(m.client.Token()) {
+				m.log.Printf("[INFO] login: %s changed, logging in again", m.method)
+				if err := m.loginLocked(); err != nil {
+					m.log.Printf("[ERR] login: failed to log in with %s: %s", m.method, err)
+				}
+			}
+			m.lock.Unlock()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// loginTransport logs the broker in again when Vault rejects its token with
+// 403 Forbidden, and retries the request once with the new token. Requests
+// made with other tokens, such as those of bindings, are passed through. It is
+// installed before the broker's client is created, and given the login manager
+// of the client before the client makes any request.
+type loginTransport struct {
+	base   http.RoundTripper
+	logins *loginManager
+}
+
+func (t *loginTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := req.Header.Get("X-Vault-Token")
+	if token == "" || t.logins == nil || req.Context().Value(loginContextKey{}) != nil || token != t.logins.client.Token() {
+		return t.base.RoundTrip(req)
+	}
+
+	// Keep the body to send it again
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+
+	newToken, loginErr := t.logins.relogin(token)
+	if loginErr != nil {
+		t.logins.log.Printf("[ERR] login: failed to log in with %s: %s", t.logins.method, loginErr)
+		return resp, nil
+	}
+	if newToken == "" {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	retry := req.Clone(req.Context())
+	retry.Header.Set("X-Vault-Token", newToken)
+	if body != nil {
+		retry.Body = ioutil.NopCloser(bytes.NewReader(body))
+		retry.ContentLength = int64(len(body))
+	}
+	return t.base.RoundTrip(retry)
+}
@@ -0,0 +1,272 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// loginEnvironment is a fake Vault that logs in with AppRole, and serves
+// secret/foo to valid tokens and secret/forbidden to none.
+type loginEnvironment struct {
+	lock    sync.Mutex
+	logins  int
+	valid   map[string]bool
+	request string
+}
+
+func (e *loginEnvironment) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	token := r.Header.Get("X-Vault-Token")
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e.logins++
+		token := fmt.Sprintf("token-%d", e.logins)
+		e.valid[token] = true
+		fmt.Fprintf(w, `{"auth": {"client_token": %q, "lease_duration": 3600, "renewable": true}}`, token)
+
+	case "/v1/auth/token/revoke-self":
+		if !e.valid[token] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		delete(e.valid, token)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "/v1/auth/token/lookup-self":
+		if !e.valid[token] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"ttl": 60, "renewable": false}}`))
+
+	case "/v1/secret/foo":
+		if !e.valid[token] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		e.request = string(body)
+		w.Write([]byte(`{"data": {"token": "` + token + `"}}`))
+
+	default:
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+func (e *loginEnvironment) revoke(token string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.valid, token)
+}
+
+func testLoginManager(t *testing.T, method brokerLogin) (*loginEnvironment, *api.Client, *loginManager) {
+	env := &loginEnvironment{valid: map[string]bool{"static": true}}
+	server := httptest.NewServer(env)
+	t.Cleanup(server.Close)
+
+	config := api.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	transport := &loginTransport{base: config.HttpClient.Transport}
+	config.HttpClient.Transport = transport
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ClearToken()
+
+	logins, err := newLoginManager(log.New(ioutil.Discard, "", 0), client, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.logins = logins
+	return env, client, logins
+}
+
+func TestLoginManager_AppRole(t *testing.T) {
+	env, client, logins := testLoginManager(t, &appRoleLogin{path: "approle", roleID: "role", secretID: "secret"})
+	if err := logins.login(); err != nil {
+		t.Fatal(err)
+	}
+	if token := client.Token(); token != "token-1" {
+		t.Fatalf("expected %s but received %s", "token-1", token)
+	}
+	if next := time.Until(logins.next); next < 39*time.Minute || next > 40*time.Minute {
+		t.Fatalf("expected the next login in %s but received %s", 40*time.Minute, next)
+	}
+
+	// A rejected token is replaced, and the request retried with its body
+	env.revoke("token-1")
+	secret, err := client.Logical().Write("secret/foo", map[string]interface{}{"value": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := secret.Data["token"]; token != "token-2" || client.Token() != "token-2" {
+		t.Fatalf("expected %s but received %s and %s", "token-2", token, client.Token())
+	}
+	if env.request != `{"value":"bar"}` {
+		t.Fatalf("expected the request body to be retried but received %q", env.request)
+	}
+
+	// A request denied to a valid token does not log in again
+	if _, err := client.Logical().Read("secret/forbidden"); err == nil {
+		t.Fatal("expected the request to be denied")
+	}
+	if env.logins != 2 {
+		t.Fatalf("expected %d logins but received %d", 2, env.logins)
+	}
+
+	// Requests made with other tokens are passed through
+	other, err := client.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SetToken("token-1")
+	if _, err := other.Logical().Read("secret/foo"); err == nil {
+		t.Fatal("expected the request to be denied")
+	}
+	if env.logins != 2 {
+		t.Fatalf("expected %d logins but received %d", 2, env.logins)
+	}
+
+	// Logging in again revokes the token it replaces
+	if err := logins.login(); err != nil {
+		t.Fatal(err)
+	}
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	if env.valid["token-2"] || !env.valid["token-3"] {
+		t.Fatalf("expected only %s to be valid but received %v", "token-3", env.valid)
+	}
+}
+
+func TestLoginManager_concurrent(t *testing.T) {
+	env, client, logins := testLoginManager(t, &appRoleLogin{path: "approle", roleID: "role", secretID: "secret"})
+	if err := logins.login(); err != nil {
+		t.Fatal(err)
+	}
+	env.revoke("token-1")
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Logical().Read("secret/foo"); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+	if env.logins != 2 {
+		t.Fatalf("expected %d logins but received %d", 2, env.logins)
+	}
+}
+
+func TestLoginManager_TokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("static\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, client, logins := testLoginManager(t, &tokenFileLogin{path: path})
+	if err := logins.login(); err != nil {
+		t.Fatal(err)
+	}
+	if token := client.Token(); token != "static" {
+		t.Fatalf("expected %s but received %s", "static", token)
+	}
+	if next := time.Until(logins.next); next < 39*time.Second || next > 40*time.Second {
+		t.Fatalf("expected the next login in %s but received %s", 40*time.Second, next)
+	}
+
+	// A token that is not valid is not used
+	if err := ioutil.WriteFile(path, []byte("revoked"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := logins.login(); err == nil {
+		t.Fatal("expected an error logging in with a revoked token")
+	}
+	if token := client.Token(); token != "static" {
+		t.Fatalf("expected %s but received %s", "static", token)
+	}
+
+	os.Remove(path)
+	if err := logins.login(); err == nil {
+		t.Fatal("expected an error logging in without a token file")
+	}
+}
+
+func TestLoginManager_watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("static"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env, client, logins := testLoginManager(t, &tokenFileLogin{path: path, poll: 10 * time.Millisecond})
+	env.valid["rotated"] = true
+	if err := logins.login(); err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go logins.run(stopCh)
+
+	waitForToken := func(expected string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for client.Token() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s but received %s", expected, client.Token())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A new token is swapped in once it is written
+	if err := ioutil.WriteFile(path, []byte("rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitForToken("rotated")
+
+	// A token that is not valid is not swapped in
+	if err := ioutil.WriteFile(path, []byte("revoked"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	waitForToken("rotated")
+
+	// Nor is a missing token
+	os.Remove(path)
+	time.Sleep(100 * time.Millisecond)
+	waitForToken("rotated")
+
+	if err := ioutil.WriteFile(path, []byte("static"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitForToken("static")
+}
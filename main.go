@@ -4,6 +4,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -41,6 +44,19 @@ func main() {
 
 	// Setup the vault client
 	vaultClientConfig := api.DefaultConfig()
+	if err := config.configureVaultTLS(vaultClientConfig); err != nil {
+		logger.Fatal("[ERR] failed to configure TLS for vault api client", err)
+	}
+
+	// Log in again when Vault rejects the broker's token, unless the broker
+	// was given a static token. The transport is given the login manager once
+	// the client it logs in exists.
+	method := config.brokerLogin()
+	var transport *loginTransport
+	if method != nil {
+		transport = &loginTransport{base: vaultClientConfig.HttpClient.Transport}
+		vaultClientConfig.HttpClient.Transport = transport
+	}
 
 	vaultClient, err := api.NewClient(vaultClientConfig)
 	if err != nil {
@@ -53,20 +69,36 @@ func main() {
 		vaultClient.SetNamespace(config.VaultNamespace)
 	}
 
+	// Log in, unless the broker was given a static token, and keep logging in
+	// while it runs
+	var logins *loginManager
+	if method != nil {
+		logins, err = newLoginManager(logger, vaultClient, method)
+		if err != nil {
+			logger.Fatal("[ERR] failed to create login manager", err)
+		}
+		transport.logins = logins
+		if err := logins.login(); err != nil {
+			logger.Fatalf("[ERR] failed to log in with %s: %s", method, err)
+		}
+	}
+
+	// The retention was validated along with the rest of the configuration
+	archiveTTL, _ := parseTTL(config.ArchiveRetention)
+
 	// Setup the broker
 	broker := &Broker{
 		log:         logger,
 		vaultClient: vaultClient,
+		logins:      logins,
 
 		serviceID:          config.ServiceID,
 		serviceName:        config.ServiceName,
 		serviceDescription: config.ServiceDescription,
 		serviceTags:        config.ServiceTags,
 
-		planName:         config.PlanName,
-		planDescription:  config.PlanDescription,
-		planMetadataName: config.PlanMetadataName,
-		planBullets:      config.PlanBullets,
+		plans:         config.Plans.Plans,
+		planUpdatable: config.PlanUpdatable,
 
 		displayName:         config.DisplayName,
 		imageUrl:            config.ImageUrl.String(),
@@ -77,9 +109,30 @@ func main() {
 
 		vaultAdvertiseAddr: config.VaultAdvertiseAddr,
 		vaultRenewToken:    config.VaultRenew,
-	}
-	if err := broker.Start(); err != nil {
-		logger.Fatalf("[ERR] failed to start broker: %s", err)
+		renewalWorkers:     config.RenewalWorkers,
+		recoverTokens:      config.RecoverBindingTokens,
+
+		kvVersion: config.KVVersion,
+
+		appRolePath:            config.AppRolePath,
+		appRoleSecretIDNumUses: config.AppRoleSecretIDNumUses,
+
+		certPath: config.CertPath,
+		certCA:   config.CertCA,
+
+		jwtPath:           config.JWTPath,
+		jwtUserClaim:      config.JWTUserClaim,
+		jwtBoundAudiences: config.JWTBoundAudiences,
+
+		bindingPolicies: config.BindingPolicies,
+
+		refuseDeprovisionWithBindings: config.RefuseDeprovisionWithBindings,
+		sharedMountCleanup:            config.SharedMountCleanup,
+
+		archiveInstances: config.ArchiveInstances,
+		archiveTTL:       archiveTTL,
+
+		requireClientCerts: config.TLSClientCAFile != "",
 	}
 
 	// Parse the broker credentials
@@ -89,18 +142,52 @@ func main() {
 	}
 
 	// Setup the HTTP handler
-	handler := brokerapi.New(broker, cfLogger, creds)
+	handler := NewHandler(broker, cfLogger, creds)
+
+	// Terminate TLS, if configured, reloading the certificate on SIGHUP or
+	// when its files change
+	stopCh := make(chan struct{})
+	server := &http.Server{
+		Addr:    config.Port,
+		Handler: handler,
+	}
+	if config.TLSCertFile != "" {
+		certs, err := newCertificateReloader(logger, config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			logger.Fatalf("[ERR] failed to load certificate: %s", err)
+		}
+		server.TLSConfig, err = config.serverTLSConfig(certs)
+		if err != nil {
+			logger.Fatalf("[ERR] failed to configure TLS: %s", err)
+		}
+		reloadCh := make(chan os.Signal, 1)
+		signal.Notify(reloadCh, syscall.SIGHUP)
+		go certs.watch(certificatePollInterval, reloadCh, stopCh)
+	}
 
 	// Listen to incoming connection
 	serverCh := make(chan struct{}, 1)
 	go func() {
-		logger.Printf("[INFO] starting server on %s", config.Port)
-		if err := http.ListenAndServe(config.Port, handler); err != nil {
+		var err error
+		if server.TLSConfig != nil {
+			logger.Printf("[INFO] starting server with TLS on %s", config.Port)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			logger.Printf("[INFO] starting server on %s", config.Port)
+			err = server.ListenAndServe()
+		}
+		if err != nil {
 			logger.Fatalf("[ERR] server exited with: %s", err)
 		}
 		close(serverCh)
 	}()
 
+	// Start the broker once its health is served, so that orchestrators can
+	// tell it is still starting
+	if err := broker.Start(); err != nil {
+		logger.Fatalf("[ERR] failed to start broker: %s", err)
+	}
+
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
 
@@ -109,6 +196,7 @@ func main() {
 	case s := <-signalCh:
 		logger.Printf("[INFO] received signal %s", s)
 	}
+	close(stopCh)
 
 	if err := broker.Stop(); err != nil {
 		logger.Fatalf("[ERR] faild to stop broker: %s", err)
@@ -180,7 +268,33 @@ type Configuration struct {
 	// Required
 	SecurityUserName     string `envconfig:"security_user_name"`
 	SecurityUserPassword string `envconfig:"security_user_password"`
+
+	// The broker logs in to Vault with exactly one of: the token VaultToken,
+	// the token in the file VaultTokenFile, or the AppRole with the role ID
+	// VaultAppRoleRoleID and secret ID VaultAppRoleSecretID, in the AppRole
+	// auth method at VaultAppRolePath.
 	VaultToken           string `envconfig:"vault_token"`
+	VaultTokenFile       string `envconfig:"vault_token_file"`
+	VaultAppRoleRoleID   string `envconfig:"vault_approle_role_id"`
+	VaultAppRoleSecretID string `envconfig:"vault_approle_secret_id"`
+	VaultAppRolePath     string `envconfig:"vault_approle_path" default:"approle"`
+
+	// VaultTLSCACert is the PEM-encoded CA certificates that verify Vault's
+	// certificate, and VaultTLSCAPath the path of a file or directory of them.
+	// VaultTLSClientCert and VaultTLSClientKey are the PEM-encoded certificate
+	// and key the broker presents to Vault. VaultTLSServerName is the name
+	// Vault's certificate is verified for, if not that of VAULT_ADDR, and
+	// VaultTLSSkipVerify skips verifying it altogether.
+	VaultTLSCACert     string `envconfig:"vault_tls_ca_cert"`
+	VaultTLSCAPath     string `envconfig:"vault_tls_ca_path"`
+	VaultTLSClientCert string `envconfig:"vault_tls_client_cert"`
+	VaultTLSClientKey  string `envconfig:"vault_tls_client_key"`
+	VaultTLSServerName string `envconfig:"vault_tls_server_name"`
+	VaultTLSSkipVerify bool   `envconfig:"vault_tls_skip_verify" default:"false"`
+
+	// VaultTokenFilePoll is how often VaultTokenFile is read for a new token,
+	// such as 5s or 1m.
+	VaultTokenFilePoll string `envconfig:"vault_token_file_poll" default:"5s"`
 
 	// Optional, for using CredHub
 	CredhubURL                       string `envconfig:"credhub_url"`
@@ -211,8 +325,87 @@ type Configuration struct {
 	DocumentationUrl    string          `envconfig:"documentation_url" default:"https://www.vaultproject.io/"`
 	SupportUrl          string          `envconfig:"support_url" default:"https://support.hashicorp.com/"`
 
+	// Plans is a JSON list of plans. When it is not given, the single plan
+	// described by the PLAN_* settings is advertised.
+	Plans *PlansDecoder `envconfig:"plans"`
+
+	// PlanUpdatable toggles whether instances may change plans. Plan changes
+	// are only advertised when there is more than one plan.
+	PlanUpdatable bool `envconfig:"plan_updatable" default:"true"`
+
+	// CatalogFile is the path to a JSON or YAML catalog document. When it is
+	// given, it takes precedence over the service and plan settings above.
+	CatalogFile string `envconfig:"catalog_file"`
+
 	ServiceTags []string `envconfig:"service_tags"`
 	VaultRenew  bool     `envconfig:"vault_renew" default:"true"`
+
+	// KVVersion is the version of the KV secrets engine mounted for secret
+	// backends, either 1 or 2.
+	KVVersion int `envconfig:"kv_version" default:"1"`
+
+	// BindingMode is the mode applications are bound with under plans that
+	// do not declare one.
+	BindingMode string `envconfig:"binding_mode" default:"token"`
+
+	// AppRolePath is the path of the AppRole auth method used by AppRole
+	// bindings, and AppRoleSecretIDNumUses the number of times their secret
+	// ID may be used, or 0 for unlimited. Secret IDs are single use by
+	// default, since they are kept in the broker's state.
+	AppRolePath            string `envconfig:"approle_path" default:"approle"`
+	AppRoleSecretIDNumUses int    `envconfig:"approle_secret_id_num_uses" default:"1"`
+
+	// CertPath is the path of the cert auth method used by cert bindings, and
+	// CertCA the PEM-encoded CA certificate that issues the instance identity
+	// certificates of application containers. CertCA is required when a plan
+	// uses cert bindings.
+	CertPath string `envconfig:"cert_path" default:"cert"`
+	CertCA   string `envconfig:"cert_ca"`
+
+	// JWTPath is the path of the JWT auth method used by JWT bindings.
+	// JWTUserClaim and JWTBoundAudiences are the user claim and audiences of
+	// their roles.
+	JWTPath           string   `envconfig:"jwt_path" default:"jwt"`
+	JWTUserClaim      string   `envconfig:"jwt_user_claim" default:"sub"`
+	JWTBoundAudiences []string `envconfig:"jwt_bound_audiences"`
+
+	// BindingPolicies are the policies bindings may request for their tokens,
+	// in addition to the policy of their instance.
+	BindingPolicies []string `envconfig:"binding_policies"`
+
+	// RefuseDeprovisionWithBindings refuses to deprovision instances that are
+	// still bound. By default, their bindings are revoked.
+	RefuseDeprovisionWithBindings bool `envconfig:"refuse_deprovision_with_bindings" default:"false"`
+
+	// SharedMountCleanup is how the shared backends of organizations, spaces,
+	// and applications are cleaned up once no instance or binding references
+	// them: never, archive, or unmount, which only unmounts those of
+	// applications.
+	SharedMountCleanup string `envconfig:"shared_mount_cleanup" default:"never"`
+
+	// ArchiveInstances archives the secrets of an instance's secret backend,
+	// encrypted with a key of the broker, before deprovisioning unmounts it.
+	// ArchiveRetention is how long archives may be restored before they are
+	// purged, such as 720h or 30d.
+	ArchiveInstances bool   `envconfig:"archive_instances" default:"false"`
+	ArchiveRetention string `envconfig:"archive_retention" default:"30d"`
+
+	// RenewalWorkers is the number of binding tokens renewed at once.
+	RenewalWorkers int `envconfig:"renewal_workers" default:"10"`
+
+	// RecoverBindingTokens replaces the tokens of bindings that expired or
+	// were revoked with new ones.
+	RecoverBindingTokens bool `envconfig:"recover_binding_tokens" default:"false"`
+
+	// TLSCertFile and TLSKeyFile are the paths of the PEM-encoded certificate
+	// and key the broker serves TLS with. Without them, it serves plain HTTP.
+	// TLSMinVersion is the minimum TLS version it accepts, and
+	// TLSClientCAFile the path of the PEM-encoded CA certificates that issue
+	// the client certificates it requires, if any.
+	TLSCertFile     string `envconfig:"tls_cert_file"`
+	TLSKeyFile      string `envconfig:"tls_key_file"`
+	TLSMinVersion   string `envconfig:"tls_min_version" default:"1.2"`
+	TLSClientCAFile string `envconfig:"tls_client_ca_file"`
 }
 
 func (c *Configuration) Validate() error {
@@ -223,8 +416,64 @@ func (c *Configuration) Validate() error {
 	if c.SecurityUserPassword == "" {
 		return errors.New("missing SECURITY_USER_PASSWORD")
 	}
-	if c.VaultToken == "" {
-		return errors.New("missing VAULT_TOKEN")
+	logins := 0
+	for _, s := range []string{c.VaultToken, c.VaultTokenFile, c.VaultAppRoleRoleID} {
+		if s != "" {
+			logins++
+		}
+	}
+	switch {
+	case logins == 0:
+		return errors.New("missing VAULT_TOKEN, VAULT_TOKEN_FILE, or VAULT_APPROLE_ROLE_ID")
+	case logins > 1:
+		return errors.New("only one of VAULT_TOKEN, VAULT_TOKEN_FILE, and VAULT_APPROLE_ROLE_ID may be given")
+	case c.VaultAppRoleRoleID != "" && c.VaultAppRoleSecretID == "":
+		return errors.New("missing VAULT_APPROLE_SECRET_ID, required by VAULT_APPROLE_ROLE_ID")
+	}
+	c.VaultAppRolePath = strings.Trim(c.VaultAppRolePath, "/")
+	if c.VaultTLSCACert != "" {
+		if err := validateCertificate(c.VaultTLSCACert); err != nil {
+			return fmt.Errorf("invalid VAULT_TLS_CA_CERT: %s", err)
+		}
+	}
+	if c.VaultTLSCAPath != "" {
+		if _, err := os.Stat(c.VaultTLSCAPath); err != nil {
+			return fmt.Errorf("invalid VAULT_TLS_CA_PATH: %s", err)
+		}
+	}
+	switch {
+	case c.VaultTLSClientCert != "" && c.VaultTLSClientKey != "":
+		if _, err := tls.X509KeyPair([]byte(c.VaultTLSClientCert), []byte(c.VaultTLSClientKey)); err != nil {
+			return fmt.Errorf("invalid VAULT_TLS_CLIENT_CERT or VAULT_TLS_CLIENT_KEY: %s", err)
+		}
+	case c.VaultTLSClientCert != "":
+		return errors.New("missing VAULT_TLS_CLIENT_KEY, required by VAULT_TLS_CLIENT_CERT")
+	case c.VaultTLSClientKey != "":
+		return errors.New("missing VAULT_TLS_CLIENT_CERT, required by VAULT_TLS_CLIENT_KEY")
+	}
+	switch {
+	case c.TLSCertFile != "" && c.TLSKeyFile != "":
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			return fmt.Errorf("invalid TLS_CERT_FILE or TLS_KEY_FILE: %s", err)
+		}
+	case c.TLSCertFile != "":
+		return errors.New("missing TLS_KEY_FILE, required by TLS_CERT_FILE")
+	case c.TLSKeyFile != "":
+		return errors.New("missing TLS_CERT_FILE, required by TLS_KEY_FILE")
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+		return fmt.Errorf("invalid TLS_MIN_VERSION %q, must be 1.0, 1.1, 1.2, or 1.3", c.TLSMinVersion)
+	}
+	if c.TLSClientCAFile != "" {
+		if c.TLSCertFile == "" {
+			return errors.New("missing TLS_CERT_FILE, required by TLS_CLIENT_CA_FILE")
+		}
+		if _, err := loadCertPool(c.TLSClientCAFile); err != nil {
+			return fmt.Errorf("invalid TLS_CLIENT_CA_FILE: %s", err)
+		}
+	}
+	if poll, err := parseTTL(c.VaultTokenFilePoll); err != nil || poll <= 0 {
+		return fmt.Errorf("invalid VAULT_TOKEN_FILE_POLL %q, must be a positive duration such as 5s", c.VaultTokenFilePoll)
 	}
 
 	// If these values aren't perfect, we can fix them
@@ -236,9 +485,179 @@ func (c *Configuration) Validate() error {
 	}
 	c.VaultAddr = normalizeAddr(c.VaultAddr)
 	c.VaultAdvertiseAddr = normalizeAddr(c.VaultAdvertiseAddr)
+
+	if c.KVVersion != 1 && c.KVVersion != 2 {
+		return fmt.Errorf("invalid KV_VERSION %d, must be 1 or 2", c.KVVersion)
+	}
+	if !bindingModes[c.BindingMode] {
+		return fmt.Errorf("invalid BINDING_MODE %q", c.BindingMode)
+	}
+	if !sharedMountCleanups[c.SharedMountCleanup] {
+		return fmt.Errorf("invalid SHARED_MOUNT_CLEANUP %q", c.SharedMountCleanup)
+	}
+	if retention, err := parseTTL(c.ArchiveRetention); err != nil || retention <= 0 {
+		return fmt.Errorf("invalid ARCHIVE_RETENTION %q, must be a positive duration such as 720h or 30d", c.ArchiveRetention)
+	}
+	if c.RenewalWorkers <= 0 {
+		return fmt.Errorf("invalid RENEWAL_WORKERS %d, must be positive", c.RenewalWorkers)
+	}
+	if c.AppRoleSecretIDNumUses < 0 {
+		return fmt.Errorf("invalid APPROLE_SECRET_ID_NUM_USES %d, must not be negative", c.AppRoleSecretIDNumUses)
+	}
+	c.AppRolePath = strings.Trim(c.AppRolePath, "/")
+	for _, p := range c.BindingPolicies {
+		if p == "root" {
+			return errors.New("invalid BINDING_POLICIES, must not contain root")
+		}
+	}
+
+	if c.CatalogFile != "" {
+		catalog, err := LoadCatalog(c.CatalogFile)
+		if err != nil {
+			return err
+		}
+		if err := catalog.Validate(); err != nil {
+			return fmt.Errorf("invalid CATALOG_FILE: %s", err)
+		}
+		c.applyCatalog(catalog)
+	}
+
+	// Without a list of plans, advertise the single plan described by the
+	// PLAN_* settings, which mounts every engine.
+	if c.Plans == nil || len(c.Plans.Plans) == 0 {
+		c.Plans = &PlansDecoder{Plans: []*Plan{
+			{
+				Name:        c.PlanName,
+				Description: c.PlanDescription,
+				Metadata: &brokerapi.ServicePlanMetadata{
+					DisplayName: c.PlanMetadataName,
+					Bullets:     c.PlanBullets,
+				},
+				Engines: []string{EngineSecret, EngineTransit},
+			},
+		}}
+	}
+	for _, p := range c.Plans.Plans {
+		if p.ID == "" {
+			p.ID = fmt.Sprintf("%s.%s", c.ServiceID, p.Name)
+		}
+		if p.BindingMode == "" {
+			p.BindingMode = c.BindingMode
+		}
+	}
+	if err := validatePlans(c.Plans.Plans); err != nil {
+		return fmt.Errorf("invalid PLANS: %s", err)
+	}
+
+	c.CertPath = strings.Trim(c.CertPath, "/")
+	c.JWTPath = strings.Trim(c.JWTPath, "/")
+	for _, p := range c.Plans.Plans {
+		if p.BindingMode != BindingModeCert {
+			continue
+		}
+		if c.CertCA == "" {
+			return fmt.Errorf("missing CERT_CA, required by plan %q", p.Name)
+		}
+		if err := validateCertificate(c.CertCA); err != nil {
+			return fmt.Errorf("invalid CERT_CA: %s", err)
+		}
+		break
+	}
 	return nil
 }
 
+// brokerLogin returns the method the broker logs in to Vault with, or nil if
+// it uses the static VAULT_TOKEN.
+func (c *Configuration) brokerLogin() brokerLogin {
+	switch {
+	case c.VaultAppRoleRoleID != "":
+		return &appRoleLogin{
+			path:     c.VaultAppRolePath,
+			roleID:   c.VaultAppRoleRoleID,
+			secretID: c.VaultAppRoleSecretID,
+		}
+	case c.VaultTokenFile != "":
+		// The interval was validated along with the rest of the configuration
+		poll, _ := parseTTL(c.VaultTokenFilePoll)
+		return &tokenFileLogin{path: c.VaultTokenFile, poll: poll}
+	}
+	return nil
+}
+
+// configureVaultTLS applies the TLS settings for Vault to the config of the
+// Vault client. It must be called before the transport of the config is
+// wrapped.
+func (c *Configuration) configureVaultTLS(config *api.Config) error {
+	if err := config.ConfigureTLS(&api.TLSConfig{
+		CACertBytes:   []byte(c.VaultTLSCACert),
+		CAPath:        c.VaultTLSCAPath,
+		TLSServerName: c.VaultTLSServerName,
+		Insecure:      c.VaultTLSSkipVerify,
+	}); err != nil {
+		return err
+	}
+	if c.VaultTLSClientCert == "" {
+		return nil
+	}
+
+	// ConfigureTLS only loads client certificates from files, so present the
+	// certificate the same way it would
+	cert, err := tls.X509KeyPair([]byte(c.VaultTLSClientCert), []byte(c.VaultTLSClientKey))
+	if err != nil {
+		return err
+	}
+	transport := config.HttpClient.Transport.(*http.Transport)
+	transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	}
+	return nil
+}
+
+// validateCertificate ensures the string is a PEM-encoded certificate.
+func validateCertificate(s string) error {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("no PEM-encoded certificate found")
+	}
+	_, err := x509.ParseCertificate(block.Bytes)
+	return err
+}
+
+// applyCatalog replaces the service and plan settings with those of the
+// given catalog. Optional fields the catalog leaves empty keep their settings.
+func (c *Configuration) applyCatalog(catalog *Catalog) {
+	s := catalog.Services[0]
+	c.ServiceID = s.ID
+	c.ServiceName = s.Name
+	c.ServiceDescription = s.Description
+	c.ServiceTags = s.Tags
+	c.Plans = &PlansDecoder{Plans: s.Plans}
+	if s.PlanUpdatable != nil {
+		c.PlanUpdatable = *s.PlanUpdatable
+	}
+
+	if m := s.Metadata; m != nil {
+		if m.DisplayName != "" {
+			c.DisplayName = m.DisplayName
+		}
+		if m.ImageUrl != "" {
+			c.ImageUrl = &ImageDefaulter{Image: m.ImageUrl}
+		}
+		if m.LongDescription != "" {
+			c.LongDescription = m.LongDescription
+		}
+		if m.ProviderDisplayName != "" {
+			c.ProviderDisplayName = m.ProviderDisplayName
+		}
+		if m.DocumentationUrl != "" {
+			c.DocumentationUrl = m.DocumentationUrl
+		}
+		if m.SupportUrl != "" {
+			c.SupportUrl = m.SupportUrl
+		}
+	}
+}
+
 // credhubProcess iterates over the names of variables as set in the `envconfig` tag
 // on the Configuration. It prepends them with "prefix" and then looks
 // in Credhub to see if they exist. If they do and they have a value, the Configuration
@@ -292,10 +711,27 @@ func credhubProcess(cfLogger lager.Logger, prefix string, config *Configuration)
 				return fmt.Errorf("error parsing bool %s: %s", credhubName, err)
 			}
 			settableField.SetBool(asBool)
+		case reflect.Int:
+			asInt, err := strconv.Atoi(settingValue)
+			if err != nil {
+				return fmt.Errorf("error parsing int %s: %s", credhubName, err)
+			}
+			settableField.SetInt(int64(asInt))
 		case reflect.String:
 			settableField.SetString(settingValue)
 		case reflect.Slice:
 			settableField.Set(reflect.ValueOf(strings.Split(settingValue, ",")))
+		case reflect.Ptr:
+			if settableField.IsNil() {
+				settableField.Set(reflect.New(fieldTypeInfo.Type.Elem()))
+			}
+			decoder, ok := settableField.Interface().(envconfig.Decoder)
+			if !ok {
+				return fmt.Errorf("unsupported type of %s for %s", fieldTypeInfo.Type, credhubName)
+			}
+			if err := decoder.Decode(settingValue); err != nil {
+				return fmt.Errorf("error decoding %s: %s", credhubName, err)
+			}
 		default:
 			return fmt.Errorf("unsupported type of %s for %s", fieldTypeInfo.Type.Kind(), credhubName)
 		}
@@ -5,15 +5,59 @@ package main
 
 import (
 	"code.cloudfoundry.org/lager/lagertest"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
 )
 
 var logger = lagertest.NewTestLogger("vault-broker-test")
 
+// testCertificate returns a PEM-encoded self-signed CA certificate for
+// localhost and its key.
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(cert), string(keyPEM)
+}
+
 func TestNormalizeAddr(t *testing.T) {
 	cases := []struct {
 		name string
@@ -120,6 +164,51 @@ func TestParseConfigDefaults(t *testing.T) {
 	if config.VaultRenew != true {
 		t.Fatal("expected true but received false")
 	}
+	if config.KVVersion != 1 {
+		t.Fatalf("expected %d but received %d", 1, config.KVVersion)
+	}
+	if config.PlanUpdatable != true {
+		t.Fatal("expected true but received false")
+	}
+	if config.Plans.Plans[0].BindingMode != BindingModeToken {
+		t.Fatalf("expected %s but received %s", BindingModeToken, config.Plans.Plans[0].BindingMode)
+	}
+	if config.AppRolePath != "approle" {
+		t.Fatalf("expected %s but received %s", "approle", config.AppRolePath)
+	}
+	if config.AppRoleSecretIDNumUses != 1 {
+		t.Fatalf("expected %d but received %d", 1, config.AppRoleSecretIDNumUses)
+	}
+	if config.RefuseDeprovisionWithBindings != false {
+		t.Fatal("expected false but received true")
+	}
+	if config.SharedMountCleanup != SharedMountCleanupNever {
+		t.Fatalf("expected %s but received %s", SharedMountCleanupNever, config.SharedMountCleanup)
+	}
+	if config.ArchiveInstances != false || config.ArchiveRetention != "30d" {
+		t.Fatalf("expected false and %s but received %t and %s", "30d", config.ArchiveInstances, config.ArchiveRetention)
+	}
+	if config.RecoverBindingTokens != false {
+		t.Fatal("expected false but received true")
+	}
+	if config.RenewalWorkers != DefaultRenewalWorkers {
+		t.Fatalf("expected %d but received %d", DefaultRenewalWorkers, config.RenewalWorkers)
+	}
+	if config.VaultAppRolePath != "approle" || config.brokerLogin() != nil {
+		t.Fatalf("expected %s and no login but received %s and %s", "approle", config.VaultAppRolePath, config.brokerLogin())
+	}
+	if config.JWTPath != "jwt" || config.JWTUserClaim != "sub" {
+		t.Fatalf("expected %s and %s but received %s and %s", "jwt", "sub", config.JWTPath, config.JWTUserClaim)
+	}
+	if len(config.Plans.Plans) != 1 {
+		t.Fatalf("expected %d but received %d plans", 1, len(config.Plans.Plans))
+	}
+	if config.Plans.Plans[0].ID != "0654695e-0760-a1d4-1cad-5dd87b75ed99.shared" {
+		t.Fatalf("expected %s but received %s", `"0654695e-0760-a1d4-1cad-5dd87b75ed99.shared"`, config.Plans.Plans[0].ID)
+	}
+	if config.Plans.Plans[0].Name != "shared" {
+		t.Fatalf("expected %s but received %s", `"shared"`, config.Plans.Plans[0].Name)
+	}
 	if config.ImageUrl.String() != "data:image/gif;base64,iVBORw0KGgoAAAANSUhEUgAAAQAAAAEABAMAAACuXLVVAAAAJ1BMVEVHcEwVFRUVFRUVFRUVFRUVFRUVFRUVFRUVFRUVFRUVFRUVFRUVFRUPAUIJAAAADHRSTlMAYOgXdQi7SS72ldNTKM7gAAAE00lEQVR42u3dvUscQRQA8JFzuSvlIJVpDBIhXGFlcZUYDFx3gmkskyIWV0iKpNjmqmvSpolsJwEPbEyjxTU5grD6/qgUfu3u7M7XvvcmgffKBZ0fem92dvbmPaUkJCQkJP7HSOovb7ON/67++psxEyC9qb8+2OAZfwZNALjiGH+YNQPyj/TjHwygGQD5PvX43QWYALBcox2/NwEzAG6mlON3RmADwC3ldNAHOwC+jwkT0AVAl4xDcAPAMc34h5krAH6SJaAjYLlPlYCOALg7QU/AOfgA8KeDPfAD5Ke4yZiCJwAA9d68A/4A+IQ3/lEWAoAzrPFXqr/ZEYB1b+4tIAwAv3ES8AKiApIRxAWsQ1zADOIChllcwOEAogK6C4gKKN6BYwCSOSABemEL5T5gAVaDFsop4AFgKyABc0yA/0L5MANUgO+9eWUAyIDlLkoChgO8Fso1d+D2AI+FcrIHFAA43W6fgK0ArgvlGVAB4Dr8DlyK41CAy3RgTkDjgt8B8GM/9A5ciMb9BweAdROrM7GOvzluA7AkY90SuBKGXHICmDex+tbxTT/uBjD8CV0S0PQHdAQ0f4iG1vHN87kroCkZO9YEtHyEnQF5/f+xYx3fksTOAAgD5LY1BTXgXMUF2KdxWoDDBjApYGMcF+D0ZEEIcHsJQQdwXE6SAVwX1FSAO20C7rIC9Am4+4sToE/AvcmSE3Be8+aAE3Bct2/CCLiqXbXxAfQJOAVOgD4B368auQD6Cvxh1coF2G16c8IFWGvauI0EeH5sjQMoPLZGART3rWIAesV9qwiA0qvjCIDKvhk/oPLmih3wBeICdiAy4KUABCAAAQhAAAIQgAA0wPva4AO4hgAEIAABCEAAAhCAAAQgAAEIQAACEIAA6PaIvtaGbNMJQAACEIAABCAAAfx7gOvIgKcTnpEAz99KjgMofCs5CuB2qqICSsdSIgDKx1L4AcsXKipg+VbFBVSPpXADtGMhzADtYLZezoMUcKmNr1cToATop4o/AydAPxbyDTgBxQn4PmoPU5MB9HOB9dUMqAD6ucCGciZEgFe71StN1RSIAPq5wAWwAqrRXE6FB2Co5sACaK6nxAMwlnPhABirSTAAzOVk6AGWahbkAFs1C2rAURYXsDqAqICVBYQBtKVDGKA7sY6/5Zi7QYDSucD6aK6mUJk9QwCduXV8UzWF8v0rAGCtp2WrZlC6g/sDknXr+LaKSMWajP4Aaz0vh1rKhVWkN8BeTih3qIo1CwbYywm51dNO0bbptDAUYyp+kkZUANfacI+18bAB7tXxHpIRGeBTH/D+gQIX4Fe9+ChDB3jWiNzBBlwrz0hxAf41vJM+JuDPtjdAdeZ4gJuA8ZXqTbEAbSvZtwVUNm75Aa27GbQEtO/n0A6A0NGiFQCjp0cbAEpXkxYAnEYO4QCkzjbBAKz+AcFFMNA6KKRhALyWMkk/BIDZRaPyyOn76hYhyk+tLgDsTiqlp1YHAH4vmeJTqx1A0U1n6AM4wx9fjWfuAJqOSs/JaANcKpp42kKyAOi6aj0moxlA2VfsIRmNgLupIoyDgQ1A3VtumJkB+ZkijpkZwNBfMDUBODosJqNmwKbiiM5FE4C0sV9xOvhQf/31lGd8lTTUqj1REhISEhISAfEXumiA5AUel8MAAAAASUVORK5CYII=" {
 		t.Fatal("received incorrect image url: " + config.ImageUrl.String())
 	}
@@ -142,6 +231,8 @@ func TestParseConfigFromEnv(t *testing.T) {
 	os.Setenv("PLAN_DESCRIPTION", "Can you believe it's opensource?")
 	os.Setenv("SERVICE_TAGS", "hello,world")
 	os.Setenv("VAULT_RENEW", "false")
+	os.Setenv("KV_VERSION", "2")
+	os.Setenv("BINDING_POLICIES", "reader,auditor")
 
 	config, err := parseConfig(logger)
 	if err != nil {
@@ -189,6 +280,318 @@ func TestParseConfigFromEnv(t *testing.T) {
 	if config.VaultRenew != false {
 		t.Fatal("expected false but received true")
 	}
+	if config.KVVersion != 2 {
+		t.Fatalf("expected %d but received %d", 2, config.KVVersion)
+	}
+	if len(config.BindingPolicies) != 2 || config.BindingPolicies[1] != "auditor" {
+		t.Fatalf("expected %s but received %s", `["reader" "auditor"]`, config.BindingPolicies)
+	}
+
+	os.Setenv("BINDING_POLICIES", "reader,root")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for the root policy in BINDING_POLICIES")
+	}
+	os.Setenv("BINDING_POLICIES", "reader")
+
+	os.Setenv("SHARED_MOUNT_CLEANUP", "delete")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for an unknown SHARED_MOUNT_CLEANUP")
+	}
+	os.Setenv("SHARED_MOUNT_CLEANUP", "archive")
+
+	os.Setenv("ARCHIVE_RETENTION", "0")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for a zero ARCHIVE_RETENTION")
+	}
+	os.Setenv("ARCHIVE_RETENTION", "30d")
+
+	os.Setenv("RENEWAL_WORKERS", "0")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for zero RENEWAL_WORKERS")
+	}
+	os.Setenv("RENEWAL_WORKERS", "10")
+
+	os.Setenv("VAULT_APPROLE_ROLE_ID", "broker-role")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for both VAULT_TOKEN and VAULT_APPROLE_ROLE_ID")
+	}
+	os.Unsetenv("VAULT_TOKEN")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for VAULT_APPROLE_ROLE_ID without VAULT_APPROLE_SECRET_ID")
+	}
+	os.Setenv("VAULT_APPROLE_SECRET_ID", "broker-secret")
+	os.Setenv("VAULT_APPROLE_PATH", "/broker-approle/")
+	config, err = parseConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	method, ok := config.brokerLogin().(*appRoleLogin)
+	if !ok || method.path != "broker-approle" || method.roleID != "broker-role" || method.secretID != "broker-secret" {
+		t.Fatalf("expected an AppRole login at %s but received %#v", "broker-approle", config.brokerLogin())
+	}
+	os.Unsetenv("VAULT_APPROLE_ROLE_ID")
+	os.Unsetenv("VAULT_APPROLE_SECRET_ID")
+
+	os.Setenv("VAULT_TOKEN_FILE", "/var/run/vault/token")
+	os.Setenv("VAULT_TOKEN_FILE_POLL", "0")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for a zero VAULT_TOKEN_FILE_POLL")
+	}
+	os.Setenv("VAULT_TOKEN_FILE_POLL", "1m")
+	config, err = parseConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile, ok := config.brokerLogin().(*tokenFileLogin)
+	if !ok || tokenFile.path != "/var/run/vault/token" || tokenFile.poll != time.Minute {
+		t.Fatalf("expected a token file login every %s but received %#v", time.Minute, config.brokerLogin())
+	}
+	os.Unsetenv("VAULT_TOKEN_FILE")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error without a way to log in")
+	}
+}
+
+func TestParseConfigPlans(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("SERVICE_ID", "1234")
+	os.Setenv("PLANS", `[
+		{"name": "kv-only", "engines": ["secret"]},
+		{"id": "full-id", "name": "full", "engines": ["secret", "transit"]}
+	]`)
+
+	config, err := parseConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Plans.Plans) != 2 {
+		t.Fatalf("expected %d but received %d plans", 2, len(config.Plans.Plans))
+	}
+	if config.Plans.Plans[0].ID != "1234.kv-only" {
+		t.Fatalf("expected %s but received %s", `"1234.kv-only"`, config.Plans.Plans[0].ID)
+	}
+	if config.Plans.Plans[1].ID != "full-id" {
+		t.Fatalf("expected %s but received %s", `"full-id"`, config.Plans.Plans[1].ID)
+	}
+
+	os.Setenv("BINDING_MODE", "approle")
+	config, err = parseConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Plans.Plans[0].BindingMode != BindingModeAppRole {
+		t.Fatalf("expected %s but received %s", BindingModeAppRole, config.Plans.Plans[0].BindingMode)
+	}
+
+	os.Setenv("BINDING_MODE", "cert")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for cert bindings without CERT_CA")
+	}
+	os.Setenv("CERT_CA", "not a certificate")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for an invalid CERT_CA")
+	}
+	ca, _ := testCertificate(t)
+	os.Setenv("CERT_CA", ca)
+	if _, err := parseConfig(logger); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("CERT_CA")
+
+	os.Setenv("BINDING_MODE", "userpass")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for an unknown binding mode")
+	}
+	os.Unsetenv("BINDING_MODE")
+
+	os.Setenv("PLANS", `[{"name": "pki", "engines": ["pki"]}]`)
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for a plan with an unknown engine")
+	}
+}
+
+func TestParseConfigVaultTLS(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	ca, _ := testCertificate(t)
+	cert, key := testCertificate(t)
+
+	os.Setenv("VAULT_TLS_CA_CERT", "not a certificate")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for an invalid VAULT_TLS_CA_CERT")
+	}
+	os.Setenv("VAULT_TLS_CA_CERT", ca)
+
+	os.Setenv("VAULT_TLS_CA_PATH", "/does/not/exist")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for a missing VAULT_TLS_CA_PATH")
+	}
+	os.Setenv("VAULT_TLS_CA_PATH", writeTestFile(t, "ca.pem", ca))
+
+	os.Setenv("VAULT_TLS_CLIENT_CERT", cert)
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for VAULT_TLS_CLIENT_CERT without VAULT_TLS_CLIENT_KEY")
+	}
+	_, otherKey := testCertificate(t)
+	os.Setenv("VAULT_TLS_CLIENT_KEY", otherKey)
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for a VAULT_TLS_CLIENT_KEY that does not match")
+	}
+	os.Setenv("VAULT_TLS_CLIENT_KEY", key)
+	os.Setenv("VAULT_TLS_SERVER_NAME", "vault.example.com")
+
+	config, err := parseConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.VaultTLSServerName != "vault.example.com" || config.VaultTLSSkipVerify {
+		t.Fatalf("expected %s and false but received %s and %t", "vault.example.com", config.VaultTLSServerName, config.VaultTLSSkipVerify)
+	}
+}
+
+func TestParseConfigTLS(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	cert, key := testCertificate(t)
+	_, otherKey := testCertificate(t)
+	certFile := writeTestFile(t, "cert.pem", cert)
+
+	os.Setenv("TLS_CLIENT_CA_FILE", certFile)
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for TLS_CLIENT_CA_FILE without TLS_CERT_FILE")
+	}
+	os.Setenv("TLS_CERT_FILE", certFile)
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for TLS_CERT_FILE without TLS_KEY_FILE")
+	}
+	os.Setenv("TLS_KEY_FILE", writeTestFile(t, "other-key.pem", otherKey))
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for a TLS_KEY_FILE that does not match")
+	}
+	os.Setenv("TLS_KEY_FILE", writeTestFile(t, "key.pem", key))
+	os.Setenv("TLS_MIN_VERSION", "1.4")
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for an unknown TLS_MIN_VERSION")
+	}
+	os.Unsetenv("TLS_MIN_VERSION")
+	os.Setenv("TLS_CLIENT_CA_FILE", writeTestFile(t, "client-ca.pem", "not a certificate"))
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for an invalid TLS_CLIENT_CA_FILE")
+	}
+	os.Setenv("TLS_CLIENT_CA_FILE", certFile)
+
+	config, err := parseConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TLSMinVersion != "1.2" {
+		t.Fatalf("expected %s but received %s", "1.2", config.TLSMinVersion)
+	}
+}
+
+func TestConfigureVaultTLS(t *testing.T) {
+	ca, caKey := testCertificate(t)
+	cert, key := testCertificate(t)
+
+	// Vault requires a client certificate issued by the broker's certificate
+	serverCert, err := tls.X509KeyPair([]byte(ca), []byte(caKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM([]byte(cert))
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": {}}`))
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	cases := []struct {
+		name   string
+		config *Configuration
+		err    bool
+	}{
+		{"verified", &Configuration{VaultTLSCACert: ca, VaultTLSClientCert: cert, VaultTLSClientKey: key, VaultTLSServerName: "localhost"}, false},
+		{"skip-verify", &Configuration{VaultTLSClientCert: cert, VaultTLSClientKey: key, VaultTLSSkipVerify: true}, false},
+		{"unknown-ca", &Configuration{VaultTLSClientCert: cert, VaultTLSClientKey: key}, true},
+		{"wrong-server-name", &Configuration{VaultTLSCACert: ca, VaultTLSClientCert: cert, VaultTLSClientKey: key, VaultTLSServerName: "vault.example.com"}, true},
+		{"no-client-cert", &Configuration{VaultTLSCACert: ca}, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			vaultClientConfig := api.DefaultConfig()
+			vaultClientConfig.Address = ts.URL
+			vaultClientConfig.MaxRetries = 0
+			if err := tc.config.configureVaultTLS(vaultClientConfig); err != nil {
+				t.Fatal(err)
+			}
+			client, err := api.NewClient(vaultClientConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Logical().Read("secret/foo")
+			if (err != nil) != tc.err {
+				t.Fatalf("expected an error to be %t but received %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestParseConfigCatalogFile(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("SERVICE_NAME", "ignored")
+	os.Setenv("SUPPORT_URL", "https://support.example.com/")
+	os.Setenv("CATALOG_FILE", writeTestFile(t, "catalog.yml", testCatalogYAML))
+
+	config, err := parseConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServiceID != "service-id" {
+		t.Fatalf("expected %s but received %s", `"service-id"`, config.ServiceID)
+	}
+	if config.ServiceName != "vault" {
+		t.Fatalf("expected %s but received %s", `"vault"`, config.ServiceName)
+	}
+	if config.DocumentationUrl != "https://docs.example.com/" {
+		t.Fatalf("expected %s but received %s", `"https://docs.example.com/"`, config.DocumentationUrl)
+	}
+	if config.SupportUrl != "https://support.example.com/" {
+		t.Fatalf("expected %s but received %s", `"https://support.example.com/"`, config.SupportUrl)
+	}
+	if len(config.ServiceTags) != 2 {
+		t.Fatalf("expected %d but received %d: %s", 2, len(config.ServiceTags), config.ServiceTags)
+	}
+	if len(config.Plans.Plans) != 2 {
+		t.Fatalf("expected %d but received %d plans", 2, len(config.Plans.Plans))
+	}
+
+	os.Setenv("CATALOG_FILE", writeTestFile(t, "catalog.json", `{"services": []}`))
+	if _, err := parseConfig(logger); err == nil {
+		t.Fatal("expected an error for an invalid catalog")
+	}
 }
 
 func TestParseConfigFromCredhub(t *testing.T) {
@@ -227,6 +630,8 @@ func TestParseConfigFromCredhub(t *testing.T) {
 		"planDescription":             config.PlanDescription,
 		"[service tags]":              fmt.Sprintf("%s", config.ServiceTags),
 		"false":                       fmt.Sprintf("%v", config.VaultRenew),
+		"vaultTLSServerName":          config.VaultTLSServerName,
+		"true":                        fmt.Sprintf("%v", config.VaultTLSSkipVerify),
 	}
 
 	for expected, actual := range expectedVsActual {
@@ -331,6 +736,10 @@ func testCredhubServer() *httptest.Server {
 			respVal = "service,tags"
 		case "VAULT_SERVICE_BROKER_VAULT_RENEW":
 			respVal = "false"
+		case "VAULT_SERVICE_BROKER_VAULT_TLS_SERVER_NAME":
+			respVal = "vaultTLSServerName"
+		case "VAULT_SERVICE_BROKER_VAULT_TLS_SKIP_VERIFY":
+			respVal = "true"
 		default:
 			writer.WriteHeader(400)
 		}
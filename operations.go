@@ -0,0 +1,170 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	// OperationProvision is the operation data returned for asynchronous
+	// provisioning.
+	OperationProvision = "provision"
+
+	// OperationDeprovision is the operation data returned for asynchronous
+	// deprovisioning.
+	OperationDeprovision = "deprovision"
+
+	// OperationUpdate is the operation data returned for asynchronous updates.
+	OperationUpdate = "update"
+)
+
+// ErrConcurrentOperation is returned when an instance is asked to do something
+// while another operation on it is still in progress.
+var ErrConcurrentOperation = brokerapi.NewFailureResponseBuilder(
+	errors.New("another operation for this service instance is in progress"),
+	http.StatusUnprocessableEntity, "concurrent-operation",
+).WithErrorKey("ConcurrencyError").Build()
+
+// operationInfo is the state of the last asynchronous operation on an
+// instance. It is persisted with the instance so that its state can still be
+// reported, and the operation resumed, after the broker restarts.
+type operationInfo struct {
+	Type        string
+	State       brokerapi.LastOperationState
+	Description string
+
+	// Unmount is the list of engines an update operation unmounts.
+	Unmount []string `json:",omitempty"`
+
+	// Tune is true if an update operation tunes the instance's mounts.
+	Tune bool `json:",omitempty"`
+}
+
+// operationInProgress returns the type of the operation in progress on the
+// instance, whether it is synchronous or not, or "" if there is none. It must
+// be called with instancesLock held.
+func (i *instanceInfo) operationInProgress() string {
+	if i.operation != "" {
+		return i.operation
+	}
+	if i.LastOperation != nil && i.LastOperation.State == brokerapi.InProgress {
+		return i.LastOperation.Type
+	}
+	return ""
+}
+
+// inProgress returns true if the instance has an operation in progress. It
+// must be called with instancesLock held.
+func (i *instanceInfo) inProgress() bool {
+	return i.operationInProgress() != ""
+}
+
+// provisionFailed returns true if provisioning the instance failed, which
+// leaves it unusable. It must be called with instancesLock held.
+func (i *instanceInfo) provisionFailed() bool {
+	op := i.LastOperation
+	return op != nil && op.Type == OperationProvision && op.State == brokerapi.Failed
+}
+
+// startOperation records that the given operation is in progress on the
+// instance and runs it in the background. It must be called with
+// instancesLock held, in the same hold as the checks that no other operation
+// is in progress on the instance.
+func (b *Broker) startOperation(instanceID string, info *instanceInfo, op *operationInfo) error {
+	b.log.Printf("[INFO] starting %s operation for instance %s", op.Type, instanceID)
+
+	previous := info.LastOperation
+	op.State = brokerapi.InProgress
+	op.Description = op.Type + " in progress"
+	info.LastOperation = op
+	if err := b.storeInstance(instanceID, info); err != nil {
+		info.LastOperation = previous
+		return err
+	}
+
+	go b.runOperation(instanceID, info)
+	return nil
+}
+
+// endOperation records that the synchronous operation on the instance, which
+// replaces the previous info of the instance, completed. If it failed, the
+// previous info is kept, or the instance removed if there was none.
+func (b *Broker) endOperation(instanceID string, info, previous *instanceInfo, err error) {
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	info.operation = ""
+	if previous == nil {
+		if err != nil && b.instances[instanceID] == info {
+			delete(b.instances, instanceID)
+		}
+		return
+	}
+	previous.operation = ""
+	if err != nil && b.instances[instanceID] == info {
+		b.instances[instanceID] = previous
+	}
+}
+
+// runOperation performs the operation in progress on the instance and records
+// its result. It is designed to be called as a goroutine.
+func (b *Broker) runOperation(instanceID string, info *instanceInfo) {
+	b.instancesLock.Lock()
+	op := info.LastOperation.Type
+	unmount, tune := info.LastOperation.Unmount, info.LastOperation.Tune
+	b.instancesLock.Unlock()
+
+	var err error
+	switch op {
+	case OperationProvision:
+		err = b.provisionInstance(instanceID, info)
+	case OperationUpdate:
+		err = b.updateInstance(instanceID, info, unmount, tune)
+	case OperationDeprovision:
+		err = b.deprovisionInstance(instanceID, info.engines())
+		if err == nil {
+			// The instance is gone, which is how completion is reported.
+			b.log.Printf("[INFO] completed %s operation for instance %s", op, instanceID)
+			return
+		}
+	default:
+		err = b.errorf("unknown operation %q", op)
+	}
+
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	if err != nil {
+		b.log.Printf("[ERR] %s operation for instance %s failed", op, instanceID)
+		info.LastOperation.State = brokerapi.Failed
+		info.LastOperation.Description = strings.Replace(err.Error(), "\n", " ", -1)
+	} else {
+		b.log.Printf("[INFO] completed %s operation for instance %s", op, instanceID)
+		info.LastOperation.State = brokerapi.Succeeded
+		info.LastOperation.Description = op + " succeeded"
+	}
+	if err := b.storeInstance(instanceID, info); err != nil {
+		b.log.Printf("[ERR] failed to record result of %s operation for instance %s", op, instanceID)
+	}
+}
+
+// resumeOperations restarts the operations that were in progress when the
+// broker last stopped. Every operation is idempotent, so they are run again
+// from the start.
+func (b *Broker) resumeOperations() {
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	for id, info := range b.instances {
+		if info.inProgress() {
+			b.log.Printf("[INFO] resuming %s operation for instance %s", info.LastOperation.Type, id)
+			go b.runOperation(id, info)
+		}
+	}
+}
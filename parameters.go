@@ -0,0 +1,607 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// ttlPattern matches the TTLs accepted in parameters: a number of seconds, or
+// a number followed by a unit of s, m, h, or d. clearableTTLPattern also
+// matches an empty TTL, which resets the TTLs of update parameters to their
+// defaults.
+const (
+	ttlPattern          = `^[0-9]+[smhd]?$`
+	clearableTTLPattern = `^([0-9]+[smhd]?)?$`
+)
+
+var ttlRegexp = regexp.MustCompile(ttlPattern)
+
+// instanceParameters are the parameters accepted when provisioning an
+// instance. They configure the backends mounted at "cf/<instance_id>/".
+type instanceParameters struct {
+	// KVVersion is the version of the KV secrets engine mounted for the
+	// secret engine, either 1 or 2.
+	KVVersion int `json:"kv_version,omitempty"`
+
+	// DefaultLeaseTTL and MaxLeaseTTL tune the lease TTLs of the mounts.
+	DefaultLeaseTTL string `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL     string `json:"max_lease_ttl,omitempty"`
+
+	// Description is the description of the mounts.
+	Description string `json:"description,omitempty"`
+
+	// AuditNonHMACRequestKeys and AuditNonHMACResponseKeys are the keys of
+	// requests to and responses from the mounts that audit devices log in
+	// plain text instead of HMAC-ing them.
+	AuditNonHMACRequestKeys  []string `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys []string `json:"audit_non_hmac_response_keys,omitempty"`
+
+	// Transit, when false, skips mounting the transit engine of the plan.
+	Transit *bool `json:"transit,omitempty"`
+
+	// Restore is the ID of a deprovisioned instance of the same space whose
+	// archived secrets are restored into the instance's secret backend, or
+	// the GUID of the organization or space of the instance whose archived
+	// backend is restored.
+	Restore string `json:"restore,omitempty"`
+}
+
+// instanceParameterNames are the names of the parameters accepted when
+// provisioning an instance.
+var instanceParameterNames = map[string]bool{
+	"kv_version":                   true,
+	"default_lease_ttl":            true,
+	"max_lease_ttl":                true,
+	"description":                  true,
+	"audit_non_hmac_request_keys":  true,
+	"audit_non_hmac_response_keys": true,
+	"transit":                      true,
+	"restore":                      true,
+}
+
+// updateParameters are the parameters accepted when updating an instance.
+type updateParameters struct {
+	// UnmountDropped, when true, unmounts the engines of the instance that
+	// its new plan does not include. Otherwise they stay mounted, so that
+	// changing plans never destroys secrets unless asked to.
+	UnmountDropped bool `json:"unmount_dropped,omitempty"`
+
+	// DefaultLeaseTTL, MaxLeaseTTL, Description, AuditNonHMACRequestKeys, and
+	// AuditNonHMACResponseKeys replace the provision parameters of the same
+	// name, and tune the instance's mounts accordingly. Those not given are
+	// left unchanged, and those given empty are cleared, which resets the
+	// mounts to their defaults.
+	DefaultLeaseTTL          *string   `json:"default_lease_ttl,omitempty"`
+	MaxLeaseTTL              *string   `json:"max_lease_ttl,omitempty"`
+	Description              *string   `json:"description,omitempty"`
+	AuditNonHMACRequestKeys  *[]string `json:"audit_non_hmac_request_keys,omitempty"`
+	AuditNonHMACResponseKeys *[]string `json:"audit_non_hmac_response_keys,omitempty"`
+}
+
+// updateParameterNames are the names of the parameters accepted when updating
+// an instance.
+var updateParameterNames = map[string]bool{
+	"unmount_dropped":              true,
+	"default_lease_ttl":            true,
+	"max_lease_ttl":                true,
+	"description":                  true,
+	"audit_non_hmac_request_keys":  true,
+	"audit_non_hmac_response_keys": true,
+}
+
+// bindingParameters are the parameters accepted when binding an instance.
+type bindingParameters struct {
+	// WrapTTL, when given, asks for the secret of the credentials to be
+	// response-wrapped with this TTL, so that only a single-use wrapping
+	// token appears in the credentials.
+	WrapTTL string `json:"wrap_ttl,omitempty"`
+
+	// Period, ExplicitMaxTTL, and NumUses configure the tokens issued to the
+	// binding. Period may only shorten the period of the instance's token
+	// role.
+	Period         string `json:"period,omitempty"`
+	ExplicitMaxTTL string `json:"explicit_max_ttl,omitempty"`
+	NumUses        int    `json:"num_uses,omitempty"`
+
+	// Policies are policies attached to the tokens issued to the binding in
+	// addition to the instance's policy. They must be among the policies the
+	// broker allows bindings to request.
+	Policies []string `json:"policies,omitempty"`
+}
+
+// bindingParameterNames are the names of the parameters accepted when binding
+// an instance.
+var bindingParameterNames = map[string]bool{
+	"wrap_ttl":         true,
+	"period":           true,
+	"explicit_max_ttl": true,
+	"num_uses":         true,
+	"policies":         true,
+}
+
+// errInvalidParameters returns the OSB error for parameters that were
+// rejected.
+func errInvalidParameters(err error) error {
+	return brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-parameters")
+}
+
+// parseInstanceParameters validates the raw provision parameters against the
+// plan's schema and decodes them. It returns nil if no parameters were given.
+func parseInstanceParameters(plan *Plan, raw json.RawMessage) (*instanceParameters, error) {
+	var params instanceParameters
+	if ok, err := parseParameters(plan.provisionSchema(), raw, &params); !ok || err != nil {
+		return nil, err
+	}
+	if err := params.validate(plan); err != nil {
+		return nil, errInvalidParameters(err)
+	}
+	return &params, nil
+}
+
+// parseUpdateParameters validates the raw update parameters against the plan's
+// schema and decodes them.
+func parseUpdateParameters(plan *Plan, raw json.RawMessage) (*updateParameters, error) {
+	var params updateParameters
+	if _, err := parseParameters(plan.updateSchema(), raw, &params); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+// parseBindingParameters validates the raw binding parameters against the
+// plan's schema and decodes them. Requested policies must be among the allowed
+// ones.
+func parseBindingParameters(plan *Plan, raw json.RawMessage, allowedPolicies []string) (*bindingParameters, error) {
+	var params bindingParameters
+	if _, err := parseParameters(plan.bindingSchema(), raw, &params); err != nil {
+		return nil, err
+	}
+	if err := params.validate(allowedPolicies); err != nil {
+		return nil, errInvalidParameters(err)
+	}
+	if params.WrapTTL != "" {
+		ttl, err := parseTTL(params.WrapTTL)
+		if err != nil {
+			return nil, errInvalidParameters(fmt.Errorf("invalid wrap_ttl: %s", err))
+		}
+		if ttl == 0 {
+			return nil, errInvalidParameters(fmt.Errorf("wrap_ttl must be greater than 0"))
+		}
+		switch mode := plan.bindingMode(); mode {
+		case BindingModeToken, BindingModeAppRole:
+		default:
+			return nil, errInvalidParameters(fmt.Errorf("wrap_ttl is not supported by %s bindings, whose credentials have no secret", mode))
+		}
+	}
+	return &params, nil
+}
+
+// validate checks the token parameters, independently of any schema the
+// catalog gives for them.
+func (p *bindingParameters) validate(allowedPolicies []string) error {
+	if p.Period != "" {
+		period, err := parseTTL(p.Period)
+		if err != nil {
+			return fmt.Errorf("invalid period: %s", err)
+		}
+		if period == 0 || period > VaultPeriodicTTL*time.Second {
+			return fmt.Errorf("period must be greater than 0 and at most %s", VaultPeriodicTTL*time.Second)
+		}
+	}
+	if p.ExplicitMaxTTL != "" {
+		if _, err := parseTTL(p.ExplicitMaxTTL); err != nil {
+			return fmt.Errorf("invalid explicit_max_ttl: %s", err)
+		}
+	}
+	if p.NumUses < 0 {
+		return fmt.Errorf("num_uses must not be negative")
+	}
+	for _, policy := range p.Policies {
+		allowed := false
+		for _, a := range allowedPolicies {
+			allowed = allowed || a == policy
+		}
+		if !allowed {
+			return fmt.Errorf("policy %q is not allowed", policy)
+		}
+	}
+	return nil
+}
+
+// parseParameters validates the raw parameters against the schema and decodes
+// them into v. It returns false if no parameters were given.
+func parseParameters(schema map[string]interface{}, raw json.RawMessage, v interface{}) (bool, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return false, nil
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return false, errInvalidParameters(fmt.Errorf("parameters are not valid JSON: %s", err))
+	}
+	if doc == nil {
+		return false, nil
+	}
+	if err := validateSchema(schema, "parameters", doc); err != nil {
+		return false, errInvalidParameters(err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return false, errInvalidParameters(fmt.Errorf("invalid parameters: %s", err))
+	}
+	return true, nil
+}
+
+// validate checks the parameters against the plan, independently of any
+// schema the catalog gives for them.
+func (p *instanceParameters) validate(plan *Plan) error {
+	if p.KVVersion != 0 {
+		if !plan.HasEngine(EngineSecret) {
+			return fmt.Errorf("kv_version is not supported by plan %q", plan.Name)
+		}
+		if p.KVVersion != 1 && p.KVVersion != 2 {
+			return fmt.Errorf("kv_version must be 1 or 2")
+		}
+	}
+	if p.Transit != nil && *p.Transit && !plan.HasEngine(EngineTransit) {
+		return fmt.Errorf("transit is not supported by plan %q", plan.Name)
+	}
+	if p.Restore != "" && !plan.HasEngine(EngineSecret) {
+		return fmt.Errorf("restore is not supported by plan %q", plan.Name)
+	}
+	return p.validateTuning()
+}
+
+// validateTuning checks the parameters that tune the instance's mounts.
+func (p *instanceParameters) validateTuning() error {
+	var defaultTTL, maxTTL time.Duration
+	var err error
+	if p.DefaultLeaseTTL != "" {
+		if defaultTTL, err = parseTTL(p.DefaultLeaseTTL); err != nil {
+			return fmt.Errorf("invalid default_lease_ttl: %s", err)
+		}
+	}
+	if p.MaxLeaseTTL != "" {
+		if maxTTL, err = parseTTL(p.MaxLeaseTTL); err != nil {
+			return fmt.Errorf("invalid max_lease_ttl: %s", err)
+		}
+	}
+	if defaultTTL > 0 && maxTTL > 0 && defaultTTL > maxTTL {
+		return fmt.Errorf("default_lease_ttl cannot be greater than max_lease_ttl")
+	}
+	return nil
+}
+
+// tune returns the instance parameters resulting from applying the update
+// parameters to the given ones, which are left unchanged. It returns false if
+// the update parameters do not tune the instance's mounts.
+func (p *updateParameters) tune(params *instanceParameters) (*instanceParameters, bool) {
+	if p.DefaultLeaseTTL == nil && p.MaxLeaseTTL == nil && p.Description == nil &&
+		p.AuditNonHMACRequestKeys == nil && p.AuditNonHMACResponseKeys == nil {
+		return params, false
+	}
+
+	tuned := &instanceParameters{}
+	if params != nil {
+		*tuned = *params
+	}
+	if p.DefaultLeaseTTL != nil {
+		tuned.DefaultLeaseTTL = *p.DefaultLeaseTTL
+	}
+	if p.MaxLeaseTTL != nil {
+		tuned.MaxLeaseTTL = *p.MaxLeaseTTL
+	}
+	if p.Description != nil {
+		tuned.Description = *p.Description
+	}
+	if p.AuditNonHMACRequestKeys != nil {
+		tuned.AuditNonHMACRequestKeys = *p.AuditNonHMACRequestKeys
+	}
+	if p.AuditNonHMACResponseKeys != nil {
+		tuned.AuditNonHMACResponseKeys = *p.AuditNonHMACResponseKeys
+	}
+	return tuned, true
+}
+
+// equal returns true if the parameters provision the same instance as the
+// other ones. No parameters are equal to empty ones, and an empty list to none.
+func (p *instanceParameters) equal(other *instanceParameters) bool {
+	return reflect.DeepEqual(p.normalize(), other.normalize())
+}
+
+// normalize returns a copy of the parameters without the values that are the
+// same as leaving them out.
+func (p *instanceParameters) normalize() instanceParameters {
+	var n instanceParameters
+	if p != nil {
+		n = *p
+	}
+	if len(n.AuditNonHMACRequestKeys) == 0 {
+		n.AuditNonHMACRequestKeys = nil
+	}
+	if len(n.AuditNonHMACResponseKeys) == 0 {
+		n.AuditNonHMACResponseKeys = nil
+	}
+	if n.Transit != nil && *n.Transit {
+		n.Transit = nil
+	}
+	return n
+}
+
+// engines returns the engines of the plan that are mounted for an instance
+// provisioned with the parameters.
+func (p *instanceParameters) engines(plan *Plan) []string {
+	if p == nil || p.Transit == nil || *p.Transit {
+		return plan.Engines
+	}
+	engines := make([]string, 0, len(plan.Engines))
+	for _, e := range plan.Engines {
+		if e != EngineTransit {
+			engines = append(engines, e)
+		}
+	}
+	return engines
+}
+
+// mountInput returns the input used to mount the given engine at
+// "cf/<instance_id>/<engine>" for an instance provisioned with the parameters.
+// The secret engine is mounted with the given KV version unless the
+// parameters ask for another.
+func (p *instanceParameters) mountInput(engine string, kvVersion int) *api.MountInput {
+	input := &api.MountInput{Type: planEngineTypes[engine]}
+	if engine == EngineSecret {
+		if p != nil && p.KVVersion != 0 {
+			kvVersion = p.KVVersion
+		}
+		input = kvMountInput(kvVersion)
+	}
+	if p == nil {
+		return input
+	}
+	input.Description = p.Description
+	input.Config.DefaultLeaseTTL = p.DefaultLeaseTTL
+	input.Config.MaxLeaseTTL = p.MaxLeaseTTL
+	input.Config.AuditNonHMACRequestKeys = p.AuditNonHMACRequestKeys
+	input.Config.AuditNonHMACResponseKeys = p.AuditNonHMACResponseKeys
+	return input
+}
+
+// tuneData returns the data written to "sys/mounts/<path>/tune" to tune the
+// mounts of an instance to the parameters. Every setting is written, even when
+// empty, so that the settings the parameters clear are reset to their
+// defaults rather than left as they were.
+func (p *instanceParameters) tuneData() map[string]interface{} {
+	var n instanceParameters
+	if p != nil {
+		n = *p
+	}
+	data := map[string]interface{}{
+		"description":                  n.Description,
+		"default_lease_ttl":            "system",
+		"max_lease_ttl":                "system",
+		"audit_non_hmac_request_keys":  append([]string{}, n.AuditNonHMACRequestKeys...),
+		"audit_non_hmac_response_keys": append([]string{}, n.AuditNonHMACResponseKeys...),
+	}
+	if n.DefaultLeaseTTL != "" {
+		data["default_lease_ttl"] = n.DefaultLeaseTTL
+	}
+	if n.MaxLeaseTTL != "" {
+		data["max_lease_ttl"] = n.MaxLeaseTTL
+	}
+	return data
+}
+
+// parseTTL parses a TTL matching ttlPattern.
+func parseTTL(s string) (time.Duration, error) {
+	if !ttlRegexp.MatchString(s) {
+		return 0, fmt.Errorf("%q is not a number of seconds or a number followed by s, m, h, or d", s)
+	}
+	unit := time.Second
+	switch s[len(s)-1] {
+	case 's':
+		s = s[:len(s)-1]
+	case 'm':
+		unit, s = time.Minute, s[:len(s)-1]
+	case 'h':
+		unit, s = time.Hour, s[:len(s)-1]
+	case 'd':
+		unit, s = 24*time.Hour, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// provisionSchema returns the schema provision parameters are validated
+// against. This is the schema given in the catalog, if any, or otherwise the
+// default schema for the plan.
+func (p *Plan) provisionSchema() map[string]interface{} {
+	if s := p.Schemas; s != nil && s.ServiceInstance != nil && s.ServiceInstance.Create != nil {
+		return s.ServiceInstance.Create.Parameters
+	}
+	return p.defaultProvisionSchema()
+}
+
+// defaultProvisionSchema returns the schema of the provision parameters
+// supported by the plan's engines.
+func (p *Plan) defaultProvisionSchema() map[string]interface{} {
+	properties := tuningProperties(ttlPattern)
+	if p.HasEngine(EngineSecret) {
+		properties["kv_version"] = map[string]interface{}{
+			"type":        "integer",
+			"description": "Version of the KV secrets engine mounted for the instance",
+			"enum":        []interface{}{1, 2},
+		}
+		properties["restore"] = map[string]interface{}{
+			"type":        "string",
+			"description": "ID of a deleted instance of the same space whose archived secrets are restored",
+		}
+	}
+	if p.HasEngine(EngineTransit) {
+		properties["transit"] = map[string]interface{}{
+			"type":        "boolean",
+			"description": "Whether to mount the transit secrets engine for the instance",
+		}
+	}
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// updateSchema returns the schema update parameters are validated against:
+// the schema given in the catalog, if any, or otherwise the default schema.
+func (p *Plan) updateSchema() map[string]interface{} {
+	if s := p.Schemas; s != nil && s.ServiceInstance != nil && s.ServiceInstance.Update != nil {
+		return s.ServiceInstance.Update.Parameters
+	}
+	return p.defaultUpdateSchema()
+}
+
+// defaultUpdateSchema returns the schema of the update parameters.
+func (p *Plan) defaultUpdateSchema() map[string]interface{} {
+	properties := tuningProperties(clearableTTLPattern)
+	properties["unmount_dropped"] = map[string]interface{}{
+		"type":        "boolean",
+		"description": "Whether to unmount the engines the new plan does not include, destroying their data",
+	}
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// tuningProperties returns the schemas of the parameters that tune the
+// instance's backends, which are accepted both when provisioning and updating
+// an instance. TTLs must match the pattern.
+func tuningProperties(pattern string) map[string]interface{} {
+	keys := map[string]interface{}{"type": "string"}
+	return map[string]interface{}{
+		"default_lease_ttl": map[string]interface{}{
+			"type":        "string",
+			"description": "Default lease TTL of the instance's backends, such as 3600 or 1h",
+			"pattern":     pattern,
+		},
+		"max_lease_ttl": map[string]interface{}{
+			"type":        "string",
+			"description": "Maximum lease TTL of the instance's backends, such as 86400 or 24h",
+			"pattern":     pattern,
+		},
+		"description": map[string]interface{}{
+			"type":        "string",
+			"description": "Description of the instance's backends",
+			"maxLength":   256,
+		},
+		"audit_non_hmac_request_keys": map[string]interface{}{
+			"type":        "array",
+			"description": "Keys of requests to the instance's backends that audit devices do not HMAC",
+			"items":       keys,
+		},
+		"audit_non_hmac_response_keys": map[string]interface{}{
+			"type":        "array",
+			"description": "Keys of responses from the instance's backends that audit devices do not HMAC",
+			"items":       keys,
+		},
+	}
+}
+
+// bindingSchema returns the schema binding parameters are validated against:
+// the schema given in the catalog, if any, or otherwise the default schema.
+func (p *Plan) bindingSchema() map[string]interface{} {
+	if s := p.Schemas; s != nil && s.ServiceBinding != nil && s.ServiceBinding.Create != nil {
+		return s.ServiceBinding.Create.Parameters
+	}
+	return p.defaultBindingSchema()
+}
+
+// defaultBindingSchema returns the schema of the binding parameters supported
+// by the plan's binding mode.
+func (p *Plan) defaultBindingSchema() map[string]interface{} {
+	properties := map[string]interface{}{
+		"period": map[string]interface{}{
+			"type":        "string",
+			"description": "Period of the tokens issued to the binding, at most the default of 120h",
+			"pattern":     ttlPattern,
+		},
+		"explicit_max_ttl": map[string]interface{}{
+			"type":        "string",
+			"description": "Maximum TTL of the tokens issued to the binding, beyond which they cannot be renewed",
+			"pattern":     ttlPattern,
+		},
+		"num_uses": map[string]interface{}{
+			"type":        "integer",
+			"description": "Number of requests the tokens issued to the binding may make, or 0 for unlimited",
+			"minimum":     0,
+		},
+		"policies": map[string]interface{}{
+			"type":        "array",
+			"description": "Additional policies of the tokens issued to the binding, among those the broker allows",
+			"items":       map[string]interface{}{"type": "string"},
+		},
+	}
+	switch p.bindingMode() {
+	case BindingModeToken, BindingModeAppRole:
+		properties["wrap_ttl"] = map[string]interface{}{
+			"type":        "string",
+			"description": "TTL of the response-wrapping token returned in place of the credentials' secret, such as 300 or 5m",
+			"pattern":     ttlPattern,
+		}
+	}
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// schemas returns the schemas advertised for the plan in the catalog. Plans
+// without instance create or update schemas, or binding create schemas,
+// advertise the default ones.
+func (p *Plan) schemas() *PlanSchemas {
+	s := &PlanSchemas{}
+	if p.Schemas != nil {
+		*s = *p.Schemas
+	}
+	instance := &ServiceInstanceSchemas{}
+	if s.ServiceInstance != nil {
+		*instance = *s.ServiceInstance
+	}
+	if instance.Create == nil {
+		instance.Create = &InputParametersSchema{Parameters: p.defaultProvisionSchema()}
+	}
+	if instance.Update == nil {
+		instance.Update = &InputParametersSchema{Parameters: p.defaultUpdateSchema()}
+	}
+	s.ServiceInstance = instance
+
+	binding := &ServiceBindingSchemas{}
+	if s.ServiceBinding != nil {
+		*binding = *s.ServiceBinding
+	}
+	if binding.Create == nil {
+		binding.Create = &InputParametersSchema{Parameters: p.defaultBindingSchema()}
+	}
+	s.ServiceBinding = binding
+	return s
+}
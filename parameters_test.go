@@ -0,0 +1,256 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseInstanceParameters(t *testing.T) {
+	full := &Plan{ID: "full-id", Name: "full", Engines: []string{"secret", "transit"}}
+	transitOnly := &Plan{ID: "transit-id", Name: "transit-only", Engines: []string{"transit"}}
+	custom := &Plan{ID: "custom-id", Name: "custom", Engines: []string{"secret"}, Schemas: &PlanSchemas{
+		ServiceInstance: &ServiceInstanceSchemas{
+			Create: &InputParametersSchema{
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"kv_version": map[string]interface{}{"enum": []interface{}{2}},
+					},
+				},
+			},
+		},
+	}}
+
+	cases := []struct {
+		name    string
+		plan    *Plan
+		raw     string
+		engines string
+		err     bool
+	}{
+		{"none", full, ``, "secret,transit", false},
+		{"null", full, `null`, "secret,transit", false},
+		{"no-transit", full, `{"transit": false}`, "secret", false},
+		{"ttls", full, `{"default_lease_ttl": "3600", "max_lease_ttl": "2d"}`, "secret,transit", false},
+		{"kv-version-without-secret", transitOnly, `{"kv_version": 2}`, "", true},
+		{"restore", full, `{"restore": "old-instance-id"}`, "secret,transit", false},
+		{"restore-without-secret", transitOnly, `{"restore": "old-instance-id"}`, "", true},
+		{"not-object", full, `[]`, "", true},
+		{"custom-schema", custom, `{"kv_version": 2}`, "secret", false},
+		{"custom-schema-rejected", custom, `{"kv_version": 1}`, "", true},
+		{"custom-schema-unknown", custom, `{"foo": 1}`, "", true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			params, err := parseInstanceParameters(tc.plan, json.RawMessage(tc.raw))
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error to be %t but received %v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if engines := strings.Join(params.engines(tc.plan), ","); engines != tc.engines {
+				t.Fatalf("expected %q but received %q", tc.engines, engines)
+			}
+		})
+	}
+}
+
+func TestInstanceParameters_mountInput(t *testing.T) {
+	var params *instanceParameters
+	if input := params.mountInput(EngineSecret, 1); input.Type != "generic" || input.Options != nil {
+		t.Fatalf("expected a generic mount but received %+v", input)
+	}
+	if input := params.mountInput(EngineSecret, 2); input.Type != "kv" || input.Options["version"] != "2" {
+		t.Fatalf("expected a kv version 2 mount but received %+v", input)
+	}
+
+	params = &instanceParameters{KVVersion: 2, DefaultLeaseTTL: "1h"}
+	input := params.mountInput(EngineSecret, 1)
+	if input.Type != "kv" || input.Options["version"] != "2" {
+		t.Fatalf("expected a kv version 2 mount but received %+v", input)
+	}
+	if input.Config.DefaultLeaseTTL != "1h" {
+		t.Fatalf("expected %q but received %q", "1h", input.Config.DefaultLeaseTTL)
+	}
+	if input := params.mountInput(EngineTransit, 2); input.Type != "transit" {
+		t.Fatalf("expected a transit mount but received %+v", input)
+	}
+}
+
+func TestInstanceParameters_equal(t *testing.T) {
+	yes, no := true, false
+	cases := []struct {
+		name  string
+		a, b  *instanceParameters
+		equal bool
+	}{
+		{"none", nil, nil, true},
+		{"empty", nil, &instanceParameters{}, true},
+		{"empty-keys", &instanceParameters{AuditNonHMACRequestKeys: []string{}}, nil, true},
+		{"transit", &instanceParameters{Transit: &yes}, nil, true},
+		{"no-transit", &instanceParameters{Transit: &no}, nil, false},
+		{"kv-version", &instanceParameters{KVVersion: 2}, &instanceParameters{KVVersion: 2}, true},
+		{"other-kv-version", &instanceParameters{KVVersion: 2}, &instanceParameters{KVVersion: 1}, false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			if equal := tc.a.equal(tc.b); equal != tc.equal {
+				t.Fatalf("expected %t but received %t", tc.equal, equal)
+			}
+			if equal := tc.b.equal(tc.a); equal != tc.equal {
+				t.Fatalf("expected %t but received %t", tc.equal, equal)
+			}
+		})
+	}
+}
+
+func TestUpdateParameters_tune(t *testing.T) {
+	params := &instanceParameters{KVVersion: 2, DefaultLeaseTTL: "1h", Description: "team secrets"}
+
+	if tuned, ok := (&updateParameters{UnmountDropped: true}).tune(params); ok || tuned != params {
+		t.Fatalf("expected no tuning but received %t, %+v", ok, tuned)
+	}
+
+	description := ""
+	tuned, ok := (&updateParameters{Description: &description, AuditNonHMACResponseKeys: &[]string{"data"}}).tune(params)
+	if !ok {
+		t.Fatal("expected tuning")
+	}
+	if tuned.KVVersion != 2 || tuned.DefaultLeaseTTL != "1h" || tuned.Description != "" || len(tuned.AuditNonHMACResponseKeys) != 1 {
+		t.Fatalf("unexpected parameters %+v", tuned)
+	}
+	if params.Description != "team secrets" {
+		t.Fatalf("expected the original parameters to be unchanged but received %+v", params)
+	}
+
+	maxTTL := "2h"
+	if tuned, ok := (&updateParameters{MaxLeaseTTL: &maxTTL}).tune(nil); !ok || tuned.MaxLeaseTTL != maxTTL {
+		t.Fatalf("expected %q but received %+v", maxTTL, tuned)
+	}
+}
+
+func TestInstanceParameters_tuneData(t *testing.T) {
+	data := (&instanceParameters{MaxLeaseTTL: "2h", AuditNonHMACRequestKeys: []string{"name"}}).tuneData()
+	expected := map[string]interface{}{
+		"description":                  "",
+		"default_lease_ttl":            "system",
+		"max_lease_ttl":                "2h",
+		"audit_non_hmac_request_keys":  []string{"name"},
+		"audit_non_hmac_response_keys": []string{},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("expected %v but received %v", expected, data)
+	}
+}
+
+func TestParseBindingParameters(t *testing.T) {
+	token := &Plan{ID: "token-id", Name: "token", Engines: []string{"secret"}}
+	jwt := &Plan{ID: "jwt-id", Name: "jwt", Engines: []string{"secret"}, BindingMode: BindingModeJWT}
+
+	cases := []struct {
+		name string
+		plan *Plan
+		raw  string
+		err  bool
+	}{
+		{"none", token, ``, false},
+		{"wrap-ttl", token, `{"wrap_ttl": "5m"}`, false},
+		{"zero-wrap-ttl", token, `{"wrap_ttl": "0"}`, true},
+		{"invalid-wrap-ttl", token, `{"wrap_ttl": "soon"}`, true},
+		{"unknown", token, `{"ttl": "5m"}`, true},
+		{"no-secret", jwt, `{"wrap_ttl": "5m"}`, true},
+		{"token", token, `{"period": "1h", "explicit_max_ttl": "720h", "num_uses": 10, "policies": ["reader"]}`, false},
+		{"long-period", token, `{"period": "30d"}`, true},
+		{"zero-period", token, `{"period": "0"}`, true},
+		{"invalid-explicit-max-ttl", token, `{"explicit_max_ttl": "forever"}`, true},
+		{"negative-num-uses", token, `{"num_uses": -1}`, true},
+		{"disallowed-policy", token, `{"policies": ["root"]}`, true},
+		{"jwt-policies", jwt, `{"policies": ["reader"]}`, false},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			_, err := parseBindingParameters(tc.plan, json.RawMessage(tc.raw), []string{"reader"})
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error to be %t but received %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	cases := map[string]time.Duration{
+		"30":   30 * time.Second,
+		"30s":  30 * time.Second,
+		"5m":   5 * time.Minute,
+		"12h":  12 * time.Hour,
+		"2d":   48 * time.Hour,
+		"1.5h": -1,
+		"h":    -1,
+		"":     -1,
+	}
+	for s, expected := range cases {
+		d, err := parseTTL(s)
+		if expected < 0 {
+			if err == nil {
+				t.Errorf("expected an error for %q", s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", s, err)
+		} else if d != expected {
+			t.Errorf("expected %s but received %s for %q", expected, d, s)
+		}
+	}
+}
+
+func TestPlan_schemas(t *testing.T) {
+	p := &Plan{ID: "kv-id", Name: "kv-only", Engines: []string{"secret"}}
+	schema := p.schemas().ServiceInstance.Create.Parameters
+	if err := checkSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	properties := schema["properties"].(map[string]interface{})
+	if _, ok := properties["kv_version"]; !ok {
+		t.Fatalf("expected kv_version in %v", properties)
+	}
+	if _, ok := properties["transit"]; ok {
+		t.Fatalf("expected no transit in %v", properties)
+	}
+	for name := range properties {
+		if !instanceParameterNames[name] {
+			t.Fatalf("unexpected parameter %q", name)
+		}
+	}
+
+	schema = p.schemas().ServiceInstance.Update.Parameters
+	if err := checkSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	for name := range schema["properties"].(map[string]interface{}) {
+		if !updateParameterNames[name] {
+			t.Fatalf("unexpected update parameter %q", name)
+		}
+	}
+
+	schema = p.schemas().ServiceBinding.Create.Parameters
+	if err := checkSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	for name := range schema["properties"].(map[string]interface{}) {
+		if !bindingParameterNames[name] {
+			t.Fatalf("unexpected binding parameter %q", name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	// EngineSecret is the plan engine for static secret storage.
+	EngineSecret = "secret"
+
+	// EngineTransit is the plan engine for encryption as a service.
+	EngineTransit = "transit"
+)
+
+// planEngineTypes maps each engine a plan may declare to the type of Vault
+// backend that is mounted for it.
+var planEngineTypes = map[string]string{
+	EngineSecret:  "generic",
+	EngineTransit: "transit",
+}
+
+// Plan is a service plan offered by the broker. In addition to the fields
+// advertised in the catalog, each plan declares which engines are mounted for
+// the instances provisioned under it.
+type Plan struct {
+	ID          string                         `json:"id"`
+	Name        string                         `json:"name"`
+	Description string                         `json:"description"`
+	Free        *bool                          `json:"free,omitempty"`
+	Bindable    *bool                          `json:"bindable,omitempty"`
+	Metadata    *brokerapi.ServicePlanMetadata `json:"metadata,omitempty"`
+	Schemas     *PlanSchemas                   `json:"schemas,omitempty"`
+
+	// Engines is the list of engines mounted at "cf/<instance_id>/<engine>"
+	// for each instance, and at "cf/<app_id>/<engine>" for each bound
+	// application.
+	Engines []string `json:"engines"`
+
+	// BindingMode is the mode applications are bound to instances with,
+	// "token" by default.
+	BindingMode string `json:"binding_mode,omitempty"`
+}
+
+// Validate ensures the plan is complete and only declares known engines.
+func (p *Plan) Validate() error {
+	if p.ID == "" {
+		return fmt.Errorf("plan %q is missing an id", p.Name)
+	}
+	if p.Name == "" {
+		return fmt.Errorf("plan %q is missing a name", p.ID)
+	}
+	if len(p.Engines) == 0 {
+		return fmt.Errorf("plan %q does not declare any engines", p.Name)
+	}
+	seen := make(map[string]struct{}, len(p.Engines))
+	for _, e := range p.Engines {
+		if _, ok := planEngineTypes[e]; !ok {
+			return fmt.Errorf("plan %q declares unknown engine %q", p.Name, e)
+		}
+		if _, ok := seen[e]; ok {
+			return fmt.Errorf("plan %q declares engine %q more than once", p.Name, e)
+		}
+		seen[e] = struct{}{}
+	}
+	if p.BindingMode != "" && !bindingModes[p.BindingMode] {
+		return fmt.Errorf("plan %q declares unknown binding mode %q", p.Name, p.BindingMode)
+	}
+	return nil
+}
+
+// HasEngine returns true if the plan mounts the given engine.
+func (p *Plan) HasEngine(engine string) bool {
+	for _, e := range p.Engines {
+		if e == engine {
+			return true
+		}
+	}
+	return false
+}
+
+// ServicePlan returns the plan as it is advertised in the catalog.
+func (p *Plan) ServicePlan() brokerapi.ServicePlan {
+	free := p.Free
+	if free == nil {
+		free = brokerapi.FreeValue(true)
+	}
+	return brokerapi.ServicePlan{
+		ID:          p.ID,
+		Name:        p.Name,
+		Description: p.Description,
+		Free:        free,
+		Bindable:    p.Bindable,
+		Metadata:    p.Metadata,
+	}
+}
+
+// validatePlans ensures each plan is valid and that plan IDs and names are
+// unique.
+func validatePlans(plans []*Plan) error {
+	if len(plans) == 0 {
+		return fmt.Errorf("at least one plan is required")
+	}
+	ids := make(map[string]struct{}, len(plans))
+	names := make(map[string]struct{}, len(plans))
+	for _, p := range plans {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if _, ok := ids[p.ID]; ok {
+			return fmt.Errorf("duplicate plan id %q", p.ID)
+		}
+		ids[p.ID] = struct{}{}
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("duplicate plan name %q", p.Name)
+		}
+		names[p.Name] = struct{}{}
+	}
+	return nil
+}
+
+// PlansDecoder decodes the JSON list of plans given in the PLANS setting.
+type PlansDecoder struct {
+	Plans []*Plan
+}
+
+func (d *PlansDecoder) Decode(s string) error {
+	d.Plans = nil
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(s), &d.Plans); err != nil {
+		return fmt.Errorf("failed to decode plans: %s", err)
+	}
+	return nil
+}
+
+func (d *PlansDecoder) String() string {
+	names := make([]string, len(d.Plans))
+	for i, p := range d.Plans {
+		names[i] = p.Name
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
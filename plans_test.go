@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValidatePlans(t *testing.T) {
+	cases := []struct {
+		name  string
+		plans []*Plan
+		err   bool
+	}{
+		{
+			"valid",
+			[]*Plan{
+				{ID: "a", Name: "kv-only", Engines: []string{"secret"}},
+				{ID: "b", Name: "full", Engines: []string{"secret", "transit"}},
+			},
+			false,
+		},
+		{
+			"empty",
+			nil,
+			true,
+		},
+		{
+			"missing-id",
+			[]*Plan{{Name: "kv-only", Engines: []string{"secret"}}},
+			true,
+		},
+		{
+			"missing-engines",
+			[]*Plan{{ID: "a", Name: "kv-only"}},
+			true,
+		},
+		{
+			"unknown-engine",
+			[]*Plan{{ID: "a", Name: "pki", Engines: []string{"pki"}}},
+			true,
+		},
+		{
+			"duplicate-engine",
+			[]*Plan{{ID: "a", Name: "kv-only", Engines: []string{"secret", "secret"}}},
+			true,
+		},
+		{
+			"approle",
+			[]*Plan{{ID: "a", Name: "kv-only", Engines: []string{"secret"}, BindingMode: "approle"}},
+			false,
+		},
+		{
+			"unknown-binding-mode",
+			[]*Plan{{ID: "a", Name: "kv-only", Engines: []string{"secret"}, BindingMode: "userpass"}},
+			true,
+		},
+		{
+			"duplicate-id",
+			[]*Plan{
+				{ID: "a", Name: "kv-only", Engines: []string{"secret"}},
+				{ID: "a", Name: "full", Engines: []string{"secret", "transit"}},
+			},
+			true,
+		},
+		{
+			"duplicate-name",
+			[]*Plan{
+				{ID: "a", Name: "full", Engines: []string{"secret"}},
+				{ID: "b", Name: "full", Engines: []string{"secret", "transit"}},
+			},
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			err := validatePlans(tc.plans)
+			if (err != nil) != tc.err {
+				t.Errorf("expected error to be %t but received %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestPlansDecoder(t *testing.T) {
+	var d PlansDecoder
+	if err := d.Decode(`[
+		{"name": "kv-only", "description": "KV only", "engines": ["secret"]},
+		{"id": "full-id", "name": "full", "engines": ["secret", "transit"]}
+	]`); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Plans) != 2 {
+		t.Fatalf("expected 2 plans but received %d", len(d.Plans))
+	}
+	if d.Plans[1].ID != "full-id" {
+		t.Fatalf("expected %q but received %q", "full-id", d.Plans[1].ID)
+	}
+	if !d.Plans[1].HasEngine(EngineTransit) {
+		t.Fatal("expected the full plan to mount transit")
+	}
+	if d.String() != "full,kv-only" {
+		t.Fatalf("expected %q but received %q", "full,kv-only", d.String())
+	}
+
+	if err := d.Decode("not json"); err == nil {
+		t.Fatal("expected an error decoding invalid json")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	// BindingHealthFailed is the health of a binding whose token expired or
+	// was revoked, and was not replaced.
+	BindingHealthFailed = "failed"
+
+	// BindingHealthRecovered is the health of a binding whose token expired
+	// or was revoked, and was replaced with a new one.
+	BindingHealthRecovered = "recovered"
+)
+
+// bindingHealth is the health of a binding whose token failed to renew.
+type bindingHealth struct {
+	// Status is BindingHealthFailed or BindingHealthRecovered.
+	Status string `json:"status"`
+
+	// Error is the error renewing the token failed with.
+	Error string `json:"error,omitempty"`
+
+	// FailedAt is when the token was found to have failed, and RecoveredAt
+	// when a new token replaced it.
+	FailedAt    time.Time  `json:"failed_at"`
+	RecoveredAt *time.Time `json:"recovered_at,omitempty"`
+
+	// NeedsRestage is true if the credentials of the binding changed since
+	// the application was bound, so it must be restaged to use them.
+	NeedsRestage bool `json:"needs_restage"`
+}
+
+// bindingByAccessor returns the ID and info of the binding whose token has the
+// accessor, or nil if there is none.
+func (b *Broker) bindingByAccessor(accessor string) (string, *bindingInfo) {
+	b.bindLock.Lock()
+	defer b.bindLock.Unlock()
+	for id, info := range b.binds {
+		if info.Accessor == accessor {
+			return id, info
+		}
+	}
+	return "", nil
+}
+
+// bindingTokenFailed records that the token with the accessor can no longer be
+// renewed in the record of its binding, and replaces it with a new token if the
+// broker is configured to. It is called by the renewal manager. Unbinding holds
+// instancesLock too, so a binding is either unbound before its token is
+// replaced, or its new token is the one revoked.
+func (b *Broker) bindingTokenFailed(accessor string, cause error) {
+	b.instancesLock.Lock()
+	defer b.instancesLock.Unlock()
+
+	bindingID, existing := b.bindingByAccessor(accessor)
+	if existing == nil {
+		// The binding was deleted since
+		return
+	}
+	path := existing.Instance + "/" + bindingID
+
+	// Record the failure on a copy, since the cached info is shared
+	info := *existing
+	health := &bindingHealth{
+		Status:   BindingHealthFailed,
+		FailedAt: time.Now().UTC(),
+	}
+	if existing.Health != nil && existing.Health.Status == BindingHealthFailed {
+		health.FailedAt = existing.Health.FailedAt
+	}
+	if cause != nil {
+		health.Error = cause.Error()
+	}
+	info.Health = health
+	b.log.Printf("[WARN] token of binding %s failed: %s", path, health.Error)
+
+	// The credentials of a response-wrapped binding are only handed out in
+	// their wrapping token, so a new token could never be fetched
+	switch {
+	case !b.recoverTokens:
+	case info.Wrapped:
+		b.log.Printf("[WARN] not recovering token of binding %s, whose credentials were response-wrapped, application %s must be rebound",
+			path, info.Application)
+	default:
+		if err := b.recoverBindingToken(bindingID, &info); err != nil {
+			b.log.Printf("[ERR] failed to recover token of binding %s: %s", path, err)
+		}
+	}
+
+	// Store the binding info in the state backend
+	if err := b.writeState(path, recordKindBinding, &info); err != nil {
+		b.log.Printf("[ERR] failed to commit health of binding %s: %s", path, err)
+		if info.Accessor != accessor {
+			if err := b.revokeBinding(&info); err != nil {
+				b.log.Printf("[WARN] failed to revoke binding %s: %s", path, err)
+			}
+		}
+		return
+	}
+
+	b.bindLock.Lock()
+	b.binds[bindingID] = &info
+	b.bindLock.Unlock()
+
+	// Renew the new token instead of the failed one
+	if info.Accessor != accessor {
+		b.renewals.stop(accessor)
+		b.renewals.add(info.ClientToken, info.Accessor)
+		b.log.Printf("[WARN] binding %s has a new token, application %s must be restaged to use it",
+			path, info.Application)
+	}
+}
+
+// recoverBindingToken creates a new token for the binding, with the parameters
+// it was created with, and records it in the binding info. It must be called
+// with instancesLock held.
+func (b *Broker) recoverBindingToken(bindingID string, info *bindingInfo) error {
+	instance, ok := b.instances[info.Instance]
+	if !ok {
+		return b.errorf("no instance exists with ID %s", info.Instance)
+	}
+	if instance.inProgress() {
+		return b.error(ErrConcurrentOperation)
+	}
+
+	if err := b.bindToken(info.Instance, bindingID, info, info.params()); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	info.Health.Status = BindingHealthRecovered
+	info.Health.RecoveredAt = &now
+	info.Health.NeedsRestage = true
+	return nil
+}
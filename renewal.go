@@ -0,0 +1,381 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// DefaultRenewalWorkers is the number of tokens renewed at once when the
+	// broker is not configured otherwise.
+	DefaultRenewalWorkers = 10
+
+	// renewalFraction is the fraction of a token's TTL after which it is
+	// renewed, and renewalJitter the fraction of its TTL by which renewals
+	// are brought forward at random, so that tokens created together are not
+	// renewed together.
+	renewalFraction = 2.0 / 3.0
+	renewalJitter   = 0.1
+
+	// renewalStartJitter spreads the first renewal of the tokens added when
+	// the broker starts, which prevents a thundering herd against Vault when a
+	// broker with a lot of bindings is restarted.
+	renewalStartJitter = 5 * time.Second
+
+	// renewalRetryMin and renewalRetryMax bound the backoff between attempts
+	// to renew a token after a failure that may be temporary.
+	renewalRetryMin = 5 * time.Second
+	renewalRetryMax = 5 * time.Minute
+)
+
+// renewalStatus is the state of the renewal of a token.
+type renewalStatus struct {
+	// Accessor is the accessor of the token.
+	Accessor string
+
+	// NextRenewal is when the token is next renewed, and LastRenewal when it
+	// last was. TTL is the TTL the token was last renewed with.
+	NextRenewal time.Time
+	LastRenewal time.Time
+	TTL         time.Duration
+
+	// Failures is the number of attempts to renew the token that failed
+	// since it was last renewed, and LastError the error of the last one.
+	Failures  int
+	LastError string
+}
+
+// renewal is a token in the renewal queue.
+type renewal struct {
+	token  string
+	status renewalStatus
+
+	// index is the index of the renewal in the queue, or -1 if it is not
+	// queued.
+	index int
+}
+
+// renewalQueue is a priority queue of renewals, ordered by their next renewal.
+// It implements heap.Interface.
+type renewalQueue []*renewal
+
+func (q renewalQueue) Len() int { return len(q) }
+
+func (q renewalQueue) Less(i, j int) bool {
+	return q[i].status.NextRenewal.Before(q[j].status.NextRenewal)
+}
+
+func (q renewalQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *renewalQueue) Push(x interface{}) {
+	r := x.(*renewal)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *renewalQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	r := old[n-1]
+	old[n-1] = nil
+	r.index = -1
+	*q = old[:n-1]
+	return r
+}
+
+// renewalManager renews the tokens of bindings. A single scheduler takes the
+// tokens off a queue ordered by when they are next renewed, and hands them to
+// a fixed pool of workers.
+//
+// A nil renewalManager renews nothing, as with a broker that was not started.
+type renewalManager struct {
+	log     *log.Logger
+	workers int
+
+	// renew renews the token, returning its new auth.
+	renew func(token string) (*api.Secret, error)
+
+	// failed, if set, is called with the accessor of a token that can no
+	// longer be renewed because it expired or was revoked, and the error
+	// renewing it last failed with.
+	failed func(accessor string, err error)
+
+	lock   sync.Mutex
+	queue  renewalQueue
+	tokens map[string]*renewal
+
+	// pending is the renewal the scheduler is handing to a worker, if any.
+	pending *renewal
+
+	wakeCh chan struct{}
+	workCh chan *renewal
+}
+
+// newRenewalManager returns a manager renewing tokens with the client, with the
+// given number of workers.
+func newRenewalManager(logger *log.Logger, client *api.Client, workers int) *renewalManager {
+	if workers <= 0 {
+		workers = DefaultRenewalWorkers
+	}
+	return &renewalManager{
+		log:     logger,
+		workers: workers,
+		renew: func(token string) (*api.Secret, error) {
+			return client.Auth().Token().RenewTokenAsSelf(token, 0)
+		},
+		tokens: make(map[string]*renewal),
+		wakeCh: make(chan struct{}, 1),
+		workCh: make(chan *renewal),
+	}
+}
+
+// start starts the scheduler and the workers, which run until stopCh is
+// closed.
+func (m *renewalManager) start(stopCh <-chan struct{}) {
+	go m.schedule(stopCh)
+	for i := 0; i < m.workers; i++ {
+		go m.work(stopCh)
+	}
+}
+
+// add queues the token for renewal, replacing any renewal of a token with the
+// same accessor. Its first renewal is shortly after it is added.
+func (m *renewalManager) add(token, accessor string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	m.remove(accessor)
+	r := &renewal{
+		token: token,
+		status: renewalStatus{
+			Accessor:    accessor,
+			NextRenewal: time.Now().Add(time.Duration(rand.Int63n(int64(renewalStartJitter)))),
+		},
+	}
+	m.tokens[accessor] = r
+	heap.Push(&m.queue, r)
+	m.lock.Unlock()
+	m.wake()
+}
+
+// stop stops renewing the token with the accessor.
+func (m *renewalManager) stop(accessor string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	m.remove(accessor)
+	m.lock.Unlock()
+	m.wake()
+}
+
+// remove removes the token with the accessor. It must be called with lock
+// held.
+func (m *renewalManager) remove(accessor string) {
+	r, ok := m.tokens[accessor]
+	if !ok {
+		return
+	}
+	delete(m.tokens, accessor)
+	if r.index >= 0 {
+		heap.Remove(&m.queue, r.index)
+	}
+}
+
+// status returns the state of the renewal of the token with the accessor, or
+// false if it is not renewed.
+func (m *renewalManager) status(accessor string) (renewalStatus, bool) {
+	if m == nil {
+		return renewalStatus{}, false
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	r, ok := m.tokens[accessor]
+	if !ok {
+		return renewalStatus{}, false
+	}
+	return r.status, true
+}
+
+// backlog returns the number of tokens whose renewal is overdue by more than
+// the grace period, because every worker is busy.
+func (m *renewalManager) backlog(grace time.Duration) int {
+	if m == nil {
+		return 0
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cutoff := time.Now().Add(-grace)
+	n := 0
+	if m.pending != nil && m.pending.status.NextRenewal.Before(cutoff) {
+		n++
+	}
+	for _, r := range m.queue {
+		if r.status.NextRenewal.Before(cutoff) {
+			n++
+		}
+	}
+	return n
+}
+
+// wake wakes the scheduler to look at the queue again.
+func (m *renewalManager) wake() {
+	select {
+	case m.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// schedule hands each token to a worker when it is due for renewal.
+func (m *renewalManager) schedule(stopCh <-chan struct{}) {
+	for {
+		m.lock.Lock()
+		var due *renewal
+		wait := time.Duration(-1)
+		if len(m.queue) > 0 {
+			if d := time.Until(m.queue[0].status.NextRenewal); d > 0 {
+				wait = d
+			} else {
+				due = heap.Pop(&m.queue).(*renewal)
+				m.pending = due
+			}
+		}
+		m.lock.Unlock()
+
+		if due != nil {
+			select {
+			case m.workCh <- due:
+				m.lock.Lock()
+				m.pending = nil
+				m.lock.Unlock()
+			case <-stopCh:
+				return
+			}
+			continue
+		}
+
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timerCh = timer.C
+		}
+		select {
+		case <-timerCh:
+		case <-m.wakeCh:
+		case <-stopCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// work renews the tokens handed to it until stopCh is closed.
+func (m *renewalManager) work(stopCh <-chan struct{}) {
+	for {
+		select {
+		case r := <-m.workCh:
+			secret, err := m.renew(r.token)
+			if m.renewed(r, secret, err) && m.failed != nil {
+				m.failed(r.status.Accessor, err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// renewed records the outcome of renewing the token, and queues its next
+// renewal unless it was removed meanwhile. A token that can no longer be
+// renewed, because it expired, was revoked, or is not renewable, is removed
+// instead. It returns true if the token failed for good: it expired or was
+// revoked.
+func (m *renewalManager) renewed(r *renewal, secret *api.Secret, err error) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	s := &r.status
+	current := m.tokens[s.Accessor] == r
+	switch {
+	case err != nil:
+		s.Failures++
+		s.LastError = err.Error()
+		// Once its TTL has passed without a renewal, the token has expired
+		// whether or not Vault could say so
+		expired := !s.LastRenewal.IsZero() && now.After(s.LastRenewal.Add(s.TTL))
+		if permanentRenewalError(err) || expired {
+			m.log.Printf("[WARN] renew-token (%s): stopping renewal, token probably expired: %s", s.Accessor, err)
+			if current {
+				delete(m.tokens, s.Accessor)
+			}
+			return current
+		}
+		backoff := renewalRetryMin << uint(s.Failures-1)
+		if backoff > renewalRetryMax || backoff <= 0 {
+			backoff = renewalRetryMax
+		}
+		s.NextRenewal = now.Add(backoff)
+		m.log.Printf("[ERR] renew-token (%s): failed, retrying in %s: %s", s.Accessor, backoff, err)
+
+	case secret == nil || secret.Auth == nil || !secret.Auth.Renewable || secret.Auth.LeaseDuration <= 0:
+		m.log.Printf("[WARN] renew-token (%s): stopping renewal, token is not renewable", s.Accessor)
+		if current {
+			delete(m.tokens, s.Accessor)
+		}
+		return false
+
+	default:
+		ttl := time.Duration(secret.Auth.LeaseDuration) * time.Second
+		fraction := renewalFraction - renewalJitter*rand.Float64()
+		s.LastRenewal = now
+		s.TTL = ttl
+		s.Failures = 0
+		s.LastError = ""
+		s.NextRenewal = now.Add(time.Duration(float64(ttl) * fraction))
+		m.log.Printf("[INFO] renew-token (%s): successfully renewed token (%s)", s.Accessor, ttl)
+	}
+
+	if !current {
+		return false
+	}
+	heap.Push(&m.queue, r)
+	m.wake()
+	return false
+}
+
+// permanentRenewalError returns true if the error means that retrying to renew
+// the token cannot succeed: Vault rejects tokens that expired or were revoked
+// with 403 Forbidden, and tokens that are not renewable with 400 Bad Request.
+func permanentRenewalError(err error) bool {
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) {
+		return false
+	}
+	return respErr.StatusCode == http.StatusForbidden || respErr.StatusCode == http.StatusBadRequest
+}
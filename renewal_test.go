@@ -0,0 +1,225 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func testRenewalManager(renew func(token string) (*api.Secret, error)) *renewalManager {
+	m := newRenewalManager(log.New(ioutil.Discard, "", 0), nil, 2)
+	m.renew = renew
+	return m
+}
+
+// due makes the renewal of the token due now.
+func (m *renewalManager) due(accessor string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	r := m.tokens[accessor]
+	r.status.NextRenewal = time.Now()
+	heap.Fix(&m.queue, r.index)
+}
+
+func TestRenewalQueue(t *testing.T) {
+	now := time.Now()
+	var q renewalQueue
+	renewals := make(map[string]*renewal)
+	for _, offset := range []int{30, 10, 50, 20, 40} {
+		r := &renewal{status: renewalStatus{
+			Accessor:    fmt.Sprintf("accessor-%d", offset),
+			NextRenewal: now.Add(time.Duration(offset) * time.Second),
+		}}
+		renewals[r.status.Accessor] = r
+		heap.Push(&q, r)
+	}
+	heap.Remove(&q, renewals["accessor-20"].index)
+
+	var order []string
+	for q.Len() > 0 {
+		order = append(order, heap.Pop(&q).(*renewal).status.Accessor)
+	}
+	expected := "[accessor-10 accessor-30 accessor-40 accessor-50]"
+	if fmt.Sprint(order) != expected {
+		t.Fatalf("expected %s but received %v", expected, order)
+	}
+}
+
+func TestRenewalManager_renewed(t *testing.T) {
+	renewable := &api.Secret{Auth: &api.SecretAuth{Renewable: true, LeaseDuration: 3600}}
+	notRenewable := &api.Secret{Auth: &api.SecretAuth{Renewable: false, LeaseDuration: 3600}}
+	forbidden := &api.ResponseError{StatusCode: 403, Errors: []string{"permission denied"}}
+	unavailable := errors.New("connection refused")
+
+	cases := []struct {
+		name     string
+		renewed  time.Duration
+		secret   *api.Secret
+		err      error
+		failures int
+		stopped  bool
+		failed   bool
+		min, max time.Duration
+	}{
+		{"renewed", 0, renewable, nil, 0, false, false, 2040 * time.Second, 2400 * time.Second},
+		{"unavailable", 0, nil, unavailable, 1, false, false, renewalRetryMin, renewalRetryMin},
+		{"unavailable-past-ttl", 2 * time.Hour, nil, unavailable, 1, true, true, 0, 0},
+		{"expired", 0, nil, forbidden, 1, true, true, 0, 0},
+		{"not-renewable", 0, notRenewable, nil, 0, true, false, 0, 0},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			m := testRenewalManager(nil)
+			m.add("token", "accessor")
+
+			// The scheduler hands the renewal to a worker
+			m.lock.Lock()
+			r := heap.Pop(&m.queue).(*renewal)
+			if tc.renewed != 0 {
+				r.status.LastRenewal = time.Now().Add(-tc.renewed)
+				r.status.TTL = time.Hour
+			}
+			m.lock.Unlock()
+
+			start := time.Now()
+			if failed := m.renewed(r, tc.secret, tc.err); failed != tc.failed {
+				t.Fatalf("expected failed to be %t but received %t", tc.failed, failed)
+			}
+			if queued := m.queue.Len() == 1; queued == tc.stopped {
+				t.Fatalf("expected the token to be queued to be %t", !tc.stopped)
+			}
+
+			// A token that is no longer renewed is forgotten
+			status, ok := m.status("accessor")
+			if ok == tc.stopped {
+				t.Fatalf("expected the token to have a status to be %t", !tc.stopped)
+			}
+			if tracked := len(m.tokens) == 1; tracked == tc.stopped {
+				t.Fatalf("expected the token to be tracked to be %t", !tc.stopped)
+			}
+			if tc.stopped {
+				return
+			}
+			if status.Failures != tc.failures {
+				t.Fatalf("expected %d failures but received %+v", tc.failures, status)
+			}
+			if next := status.NextRenewal.Sub(start); next < tc.min || next > tc.max+time.Second {
+				t.Fatalf("expected the next renewal in %s to %s but received %s", tc.min, tc.max, next)
+			}
+		})
+	}
+}
+
+func TestRenewalManager_Renew(t *testing.T) {
+	renewed := make(chan string, 1)
+	m := testRenewalManager(func(token string) (*api.Secret, error) {
+		renewed <- token
+		return &api.Secret{Auth: &api.SecretAuth{Renewable: true, LeaseDuration: 3600}}, nil
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	m.start(stopCh)
+
+	m.add("token", "accessor")
+	m.due("accessor")
+	select {
+	case token := <-renewed:
+		if token != "token" {
+			t.Fatalf("expected %s but received %s", "token", token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the token to be renewed")
+	}
+
+	// Wait for the worker to record the renewal
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _ := m.status("accessor")
+		if !status.LastRenewal.IsZero() {
+			if status.TTL != time.Hour {
+				t.Fatalf("expected a TTL of %s but received %s", time.Hour, status.TTL)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the renewal to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.stop("accessor")
+	if _, ok := m.status("accessor"); ok {
+		t.Fatal("expected the token to no longer be renewed")
+	}
+}
+
+func TestRenewalManager_stopped(t *testing.T) {
+	failed := make(chan string, 1)
+	m := testRenewalManager(func(token string) (*api.Secret, error) {
+		if token == "revoked-token" {
+			return nil, &api.ResponseError{StatusCode: 403, Errors: []string{"permission denied"}}
+		}
+		return &api.Secret{Auth: &api.SecretAuth{Renewable: true, LeaseDuration: 3600}}, nil
+	})
+	m.failed = func(accessor string, err error) {
+		failed <- accessor
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	m.start(stopCh)
+
+	m.add("token", "accessor")
+	m.add("revoked-token", "revoked-accessor")
+	m.due("revoked-accessor")
+	select {
+	case accessor := <-failed:
+		if accessor != "revoked-accessor" {
+			t.Fatalf("expected %s but received %s", "revoked-accessor", accessor)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the revoked token to fail")
+	}
+
+	// The revoked token is no longer tracked, unlike the other one
+	m.lock.Lock()
+	_, tracked := m.tokens["revoked-accessor"]
+	n := len(m.tokens)
+	m.lock.Unlock()
+	if tracked || n != 1 {
+		t.Fatalf("expected only %d token to be tracked but received %d", 1, n)
+	}
+}
+
+func TestRenewalManager_backlog(t *testing.T) {
+	// Without workers, nothing is renewed.
+	m := testRenewalManager(nil)
+	for _, accessor := range []string{"a", "b", "c"} {
+		m.add("token", accessor)
+	}
+	m.due("a")
+	m.due("b")
+	time.Sleep(10 * time.Millisecond)
+
+	if n := m.backlog(0); n != 2 {
+		t.Fatalf("expected %d overdue renewals but received %d", 2, n)
+	}
+	if n := m.backlog(time.Minute); n != 0 {
+		t.Fatalf("expected %d overdue renewals but received %d", 0, n)
+	}
+
+	var nilManager *renewalManager
+	nilManager.add("token", "accessor")
+	if n := nilManager.backlog(0); n != 0 {
+		t.Fatalf("expected %d overdue renewals but received %d", 0, n)
+	}
+}
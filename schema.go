@@ -0,0 +1,274 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaKeywords are the JSON schema keywords parameters can be validated
+// against. Annotations are accepted but have no effect on validation.
+var schemaKeywords = map[string]bool{
+	"$schema":              true,
+	"title":                true,
+	"description":          true,
+	"default":              true,
+	"examples":             true,
+	"type":                 true,
+	"properties":           true,
+	"additionalProperties": true,
+	"required":             true,
+	"enum":                 true,
+	"minimum":              true,
+	"maximum":              true,
+	"minLength":            true,
+	"maxLength":            true,
+	"pattern":              true,
+	"items":                true,
+}
+
+// schemaTypes are the values of the "type" keyword.
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// checkSchema ensures the schema only uses keywords the broker is able to
+// validate parameters against.
+func checkSchema(schema map[string]interface{}) error {
+	for k, v := range schema {
+		if !schemaKeywords[k] {
+			return fmt.Errorf("unsupported keyword %q", k)
+		}
+		switch k {
+		case "type":
+			t, ok := v.(string)
+			if !ok || !schemaTypes[t] {
+				return fmt.Errorf("invalid type %v", v)
+			}
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("properties must be an object")
+			}
+			for name, prop := range props {
+				propSchema, ok := prop.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("property %q must be an object", name)
+				}
+				if err := checkSchema(propSchema); err != nil {
+					return fmt.Errorf("property %q: %s", name, err)
+				}
+			}
+		case "items":
+			itemSchema, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("items must be an object")
+			}
+			if err := checkSchema(itemSchema); err != nil {
+				return fmt.Errorf("items: %s", err)
+			}
+		case "additionalProperties":
+			if _, ok := v.(bool); !ok {
+				return fmt.Errorf("additionalProperties must be a boolean")
+			}
+		case "required":
+			if _, ok := stringList(v); !ok {
+				return fmt.Errorf("required must be a list of strings")
+			}
+		case "enum":
+			if _, ok := v.([]interface{}); !ok {
+				return fmt.Errorf("enum must be a list")
+			}
+		case "minimum", "maximum", "minLength", "maxLength":
+			if _, ok := toFloat(v); !ok {
+				return fmt.Errorf("%s must be a number", k)
+			}
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("pattern must be a string")
+			}
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("invalid pattern: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSchema validates the decoded JSON value against the schema. The
+// name is used to describe the value in errors.
+func validateSchema(schema map[string]interface{}, name string, v interface{}) error {
+	if t, ok := schema["type"].(string); ok && !isType(v, t) {
+		return fmt.Errorf("%s must be of type %s", name, t)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %s", name, jsonString(enum))
+		}
+	}
+
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		return validateObject(schema, name, typed)
+	case []interface{}:
+		if itemSchema, ok := schema["items"].(map[string]interface{}); ok {
+			for i, e := range typed {
+				if err := validateSchema(itemSchema, fmt.Sprintf("%s[%d]", name, i), e); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(typed))
+		if min, ok := toFloat(schema["minLength"]); ok && length < min {
+			return fmt.Errorf("%s must be at least %v characters", name, min)
+		}
+		if max, ok := toFloat(schema["maxLength"]); ok && length > max {
+			return fmt.Errorf("%s must be at most %v characters", name, max)
+		}
+		if p, ok := schema["pattern"].(string); ok && !regexp.MustCompile(p).MatchString(typed) {
+			return fmt.Errorf("%s must match %q", name, p)
+		}
+	case float64:
+		if min, ok := toFloat(schema["minimum"]); ok && typed < min {
+			return fmt.Errorf("%s must be at least %v", name, min)
+		}
+		if max, ok := toFloat(schema["maximum"]); ok && typed > max {
+			return fmt.Errorf("%s must be at most %v", name, max)
+		}
+	}
+	return nil
+}
+
+// validateObject validates the properties of an object against the schema.
+func validateObject(schema map[string]interface{}, name string, obj map[string]interface{}) error {
+	required, _ := stringList(schema["required"])
+	for _, r := range required {
+		if _, ok := obj[r]; !ok {
+			return fmt.Errorf("%s.%s is required", name, r)
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	additional, ok := schema["additionalProperties"].(bool)
+	if !ok {
+		additional = true
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		propSchema, ok := props[k].(map[string]interface{})
+		if !ok {
+			if !additional {
+				return fmt.Errorf("%s.%s is not a supported parameter", name, k)
+			}
+			continue
+		}
+		if err := validateSchema(propSchema, name+"."+k, obj[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isType returns true if the decoded JSON value is of the given schema type.
+func isType(v interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+// stringList returns the value as a list of strings.
+func stringList(v interface{}) ([]string, bool) {
+	switch typed := v.(type) {
+	case []string:
+		return typed, true
+	case []interface{}:
+		l := make([]string, len(typed))
+		for i, e := range typed {
+			s, ok := e.(string)
+			if !ok {
+				return nil, false
+			}
+			l[i] = s
+		}
+		return l, true
+	}
+	return nil, false
+}
+
+// toFloat returns the numeric value as a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch typed := v.(type) {
+	case float64:
+		return typed, true
+	case int:
+		return float64(typed), true
+	}
+	return 0, false
+}
+
+// jsonEqual returns true if both values have the same JSON encoding, so that
+// numbers compare equal regardless of their Go type.
+func jsonEqual(a, b interface{}) bool {
+	ea, erra := json.Marshal(a)
+	eb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && bytes.Equal(ea, eb)
+}
+
+// jsonString returns the JSON encoding of the value for use in errors.
+func jsonString(v interface{}) string {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return strings.TrimSpace(string(encoded))
+}
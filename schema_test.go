@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		err    bool
+	}{
+		{"empty", `{}`, false},
+		{"supported", `{"type": "object", "properties": {"a": {"type": "string", "pattern": "^a+$", "maxLength": 3}}, "required": ["a"]}`, false},
+		{"unsupported-keyword", `{"type": "object", "oneOf": []}`, true},
+		{"unsupported-nested-keyword", `{"properties": {"a": {"format": "email"}}}`, true},
+		{"unknown-type", `{"type": "thing"}`, true},
+		{"invalid-pattern", `{"properties": {"a": {"pattern": "("}}}`, true},
+		{"invalid-required", `{"required": [1]}`, true},
+		{"items", `{"type": "array", "items": {"type": "string"}}`, false},
+		{"unsupported-items-keyword", `{"type": "array", "items": {"format": "email"}}`, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			var schema map[string]interface{}
+			if err := json.Unmarshal([]byte(tc.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+			err := checkSchema(schema)
+			if (err != nil) != tc.err {
+				t.Errorf("expected error to be %t but received %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"count":   map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 3},
+			"version": map[string]interface{}{"type": "integer", "enum": []interface{}{1, 2}},
+			"name":    map[string]interface{}{"type": "string", "minLength": 2, "pattern": "^[a-z]+$"},
+			"enabled": map[string]interface{}{"type": "boolean"},
+			"keys":    map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+		"required":             []interface{}{"name"},
+		"additionalProperties": false,
+	}
+
+	cases := []struct {
+		name  string
+		value string
+		err   bool
+	}{
+		{"valid", `{"name": "abc", "count": 2, "version": 2, "enabled": true}`, false},
+		{"not-object", `"abc"`, true},
+		{"missing-required", `{"count": 2}`, true},
+		{"additional", `{"name": "abc", "other": 1}`, true},
+		{"not-integer", `{"name": "abc", "count": 1.5}`, true},
+		{"below-minimum", `{"name": "abc", "count": 0}`, true},
+		{"above-maximum", `{"name": "abc", "count": 4}`, true},
+		{"not-in-enum", `{"name": "abc", "version": 3}`, true},
+		{"too-short", `{"name": "a"}`, true},
+		{"pattern", `{"name": "ABC"}`, true},
+		{"not-boolean", `{"name": "abc", "enabled": "yes"}`, true},
+		{"items", `{"name": "abc", "keys": ["a", "b"]}`, false},
+		{"invalid-item", `{"name": "abc", "keys": ["a", 1]}`, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tc.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			err := validateSchema(schema, "parameters", value)
+			if (err != nil) != tc.err {
+				t.Errorf("expected error to be %t but received %v", tc.err, err)
+			}
+		})
+	}
+}
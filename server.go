@@ -0,0 +1,189 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+)
+
+// NewHandler returns the HTTP handler for the broker. It serves the routes of
+// brokerapi, replacing those whose responses brokerapi cannot fully express,
+// behind basic authentication and any required client certificate once the
+// broker started, and the health of the broker without them.
+func NewHandler(b *Broker, logger lager.Logger, creds brokerapi.BrokerCredentials) http.Handler {
+	router := mux.NewRouter()
+
+	// Routes are matched in the order they are added, so these take precedence
+	// over the routes of brokerapi.
+	router.HandleFunc("/v2/catalog", b.handleCatalog).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.handleProvision).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.handleGetInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.handleBind).Methods("PUT")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.handleGetBinding).Methods("GET")
+
+	brokerapi.AttachRoutes(router, b, logger)
+
+	// Orchestrators probe the health of the broker without credentials
+	root := mux.NewRouter()
+	root.HandleFunc("/health/live", b.handleLive).Methods("GET")
+	root.HandleFunc("/health/ready", b.handleReady).Methods("GET")
+	root.PathPrefix("/").Handler(b.requireClientCert(auth.NewWrapper(creds.Username, creds.Password).Wrap(b.requireStarted(router))))
+	return root
+}
+
+// catalogResponse is the catalog as advertised by the broker. brokerapi's
+// catalog types predate plan schemas and fetching instances and bindings, so
+// they are added here.
+type catalogResponse struct {
+	Services []catalogService `json:"services"`
+}
+
+type catalogService struct {
+	brokerapi.Service
+	Plans                []catalogPlan `json:"plans"`
+	InstancesRetrievable bool          `json:"instances_retrievable"`
+	BindingsRetrievable  bool          `json:"bindings_retrievable"`
+}
+
+type catalogPlan struct {
+	brokerapi.ServicePlan
+	Schemas *PlanSchemas `json:"schemas,omitempty"`
+}
+
+// handleCatalog serves the catalog of the broker, including plan schemas.
+func (b *Broker) handleCatalog(w http.ResponseWriter, r *http.Request) {
+	services := b.Services(r.Context())
+	resp := catalogResponse{
+		Services: make([]catalogService, len(services)),
+	}
+	for i, s := range services {
+		plans := make([]catalogPlan, len(s.Plans))
+		for j, p := range s.Plans {
+			plans[j] = catalogPlan{ServicePlan: p}
+			if plan, err := b.plan(p.ID); err == nil {
+				plans[j].Schemas = plan.schemas()
+			}
+		}
+		resp.Services[i] = catalogService{
+			Service:              s,
+			Plans:                plans,
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
+		}
+	}
+	b.respond(w, http.StatusOK, resp)
+}
+
+// handleProvision provisions an instance. Unlike brokerapi, it responds with
+// 200 OK when the instance already exists with the same attributes.
+func (b *Broker) handleProvision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var details brokerapi.ProvisionDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		b.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+	async, _ := strconv.ParseBool(r.URL.Query().Get("accepts_incomplete"))
+
+	spec, exists, err := b.provision(r.Context(), vars["instance_id"], details, async)
+	switch {
+	case err != nil:
+		b.respondError(w, err)
+	case exists:
+		b.respond(w, http.StatusOK, brokerapi.ProvisioningResponse{
+			DashboardURL: spec.DashboardURL,
+		})
+	case spec.IsAsync:
+		b.respond(w, http.StatusAccepted, brokerapi.ProvisioningResponse{
+			DashboardURL:  spec.DashboardURL,
+			OperationData: spec.OperationData,
+		})
+	default:
+		b.respond(w, http.StatusCreated, brokerapi.ProvisioningResponse{
+			DashboardURL: spec.DashboardURL,
+		})
+	}
+}
+
+// handleBind binds an instance. Unlike brokerapi, it responds with 200 OK when
+// the binding already exists with the same attributes. Like brokerapi, it
+// responds with 404 Not Found when the instance does not exist.
+func (b *Broker) handleBind(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var details brokerapi.BindDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		b.respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	binding, exists, err := b.bind(r.Context(), vars["instance_id"], vars["binding_id"], details)
+	switch {
+	case err == brokerapi.ErrInstanceDoesNotExist:
+		b.respond(w, http.StatusNotFound, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+	case err != nil:
+		b.respondError(w, err)
+	case exists:
+		b.respond(w, http.StatusOK, binding)
+	default:
+		b.respond(w, http.StatusCreated, binding)
+	}
+}
+
+// handleGetInstance serves an instance.
+func (b *Broker) handleGetInstance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	spec, err := b.GetInstance(r.Context(), vars["instance_id"])
+	if err != nil {
+		b.respondError(w, err)
+		return
+	}
+	b.respond(w, http.StatusOK, spec)
+}
+
+// handleGetBinding serves a binding.
+func (b *Broker) handleGetBinding(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	binding, err := b.GetBinding(r.Context(), vars["instance_id"], vars["binding_id"])
+	if err != nil {
+		b.respondError(w, err)
+		return
+	}
+	b.respond(w, http.StatusOK, binding)
+}
+
+// respond writes the given response as JSON.
+func (b *Broker) respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		b.log.Printf("[ERR] failed to encode response: %s", err)
+	}
+}
+
+// respondError writes the response for the given error, the way brokerapi
+// does.
+func (b *Broker) respondError(w http.ResponseWriter, err error) {
+	if failure, ok := err.(*brokerapi.FailureResponse); ok {
+		b.respond(w, failure.ValidatedStatusCode(nil), failure.ErrorResponse())
+		return
+	}
+	b.respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{
+		Description: err.Error(),
+	})
+}
@@ -0,0 +1,327 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var testCredentials = brokerapi.BrokerCredentials{
+	Username: "username",
+	Password: "password",
+}
+
+// serve sends the request to the broker's handler and returns the response.
+func serve(t *testing.T, env *Environment, method, path string, authenticate bool) *httptest.ResponseRecorder {
+	return serveBody(t, env, method, path, "", authenticate)
+}
+
+// serveBody sends the request with the given body to the broker's handler and
+// returns the response.
+func serveBody(t *testing.T, env *Environment, method, path, body string, authenticate bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authenticate {
+		req.SetBasicAuth(testCredentials.Username, testCredentials.Password)
+	}
+	w := httptest.NewRecorder()
+	NewHandler(env.Broker, logger, testCredentials).ServeHTTP(w, req)
+	return w
+}
+
+func TestHandler_Unauthorized(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	w := serve(t, env, "GET", "/v2/catalog", false)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d but received %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestHandler_ClientCert(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Only the health of the broker is served without a client certificate
+	env.Broker.requireClientCerts = true
+	if w := serve(t, env, "GET", "/v2/catalog", true); w.Code != http.StatusForbidden {
+		t.Fatalf("expected %d but received %d", http.StatusForbidden, w.Code)
+	}
+	if w := serve(t, env, "GET", "/health/live", false); w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestHandler_Catalog(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[1].Schemas = &PlanSchemas{
+		ServiceInstance: &ServiceInstanceSchemas{
+			Create: &InputParametersSchema{
+				Parameters: map[string]interface{}{"type": "object"},
+			},
+		},
+	}
+
+	w := serve(t, env, "GET", "/v2/catalog", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var catalog struct {
+		Services []struct {
+			ID                   string `json:"id"`
+			InstancesRetrievable bool   `json:"instances_retrievable"`
+			BindingsRetrievable  bool   `json:"bindings_retrievable"`
+			Plans                []struct {
+				ID      string                 `json:"id"`
+				Schemas map[string]interface{} `json:"schemas"`
+			} `json:"plans"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &catalog); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 1 {
+		t.Fatalf("expected 1 service but received %d", len(catalog.Services))
+	}
+	if !catalog.Services[0].InstancesRetrievable || !catalog.Services[0].BindingsRetrievable {
+		t.Fatalf("expected instances and bindings to be retrievable: %s", w.Body)
+	}
+	plans := catalog.Services[0].Plans
+	if len(plans) != 2 {
+		t.Fatalf("expected 2 plans but received %d", len(plans))
+	}
+	for _, p := range plans {
+		if _, ok := p.Schemas["service_instance"]; !ok {
+			t.Fatalf("expected instance schemas but received %+v", p.Schemas)
+		}
+	}
+	if !strings.Contains(w.Body.String(), `"kv_version"`) {
+		t.Fatalf("expected the default schema to describe kv_version: %s", w.Body)
+	}
+	if strings.Count(w.Body.String(), `"kv_version"`) != 1 {
+		t.Fatalf("expected the catalog schema to replace the default schema: %s", w.Body)
+	}
+}
+
+func TestHandler_GetInstance(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	w := serve(t, env, "GET", "/v2/service_instances/instance-id", true)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected %d but received %d: %s", http.StatusNotFound, w.Code, w.Body)
+	}
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+	w = serve(t, env, "GET", "/v2/service_instances/instance-id", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var instance map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &instance); err != nil {
+		t.Fatal(err)
+	}
+	if instance["service_id"] != env.Broker.serviceID || instance["plan_id"] != env.Broker.plans[0].ID {
+		t.Fatalf("unexpected instance %s", w.Body)
+	}
+}
+
+func TestHandler_GetBinding(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	w := serve(t, env, "GET", "/v2/service_instances/instance-id/service_bindings/binding-id", true)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected %d but received %d: %s", http.StatusNotFound, w.Code, w.Body)
+	}
+
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{AppGUID: "app-id"}); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(t, env, "GET", "/v2/service_instances/instance-id/service_bindings/binding-id", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var binding struct {
+		Credentials struct {
+			Address string                 `json:"address"`
+			Auth    map[string]interface{} `json:"auth"`
+		} `json:"credentials"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &binding); err != nil {
+		t.Fatal(err)
+	}
+	if binding.Credentials.Address != env.Broker.vaultAdvertiseAddr || binding.Credentials.Auth["token"] != "ABCD" {
+		t.Fatalf("unexpected binding %s", w.Body)
+	}
+}
+
+func TestHandler_Provision_Bind_Existing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	cases := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{
+			"provision",
+			"/v2/service_instances/instance-id",
+			`{"organization_guid": "organization-guid", "space_guid": "space-guid"}`,
+			http.StatusCreated,
+		},
+		{
+			"provision-again",
+			"/v2/service_instances/instance-id",
+			`{"organization_guid": "organization-guid", "space_guid": "space-guid"}`,
+			http.StatusOK,
+		},
+		{
+			"provision-conflict",
+			"/v2/service_instances/instance-id",
+			`{"organization_guid": "organization-guid", "space_guid": "other-space-guid"}`,
+			http.StatusConflict,
+		},
+		{
+			"bind",
+			"/v2/service_instances/instance-id/service_bindings/binding-id",
+			`{"app_guid": "app-id"}`,
+			http.StatusCreated,
+		},
+		{
+			"bind-again",
+			"/v2/service_instances/instance-id/service_bindings/binding-id",
+			`{"app_guid": "app-id"}`,
+			http.StatusOK,
+		},
+		{
+			"bind-conflict",
+			"/v2/service_instances/instance-id/service_bindings/binding-id",
+			`{"app_guid": "other-app-id"}`,
+			http.StatusConflict,
+		},
+		{
+			"bind-missing-instance",
+			"/v2/service_instances/missing-instance-id/service_bindings/binding-id",
+			`{"app_guid": "app-id"}`,
+			http.StatusNotFound,
+		},
+		{
+			"invalid-body",
+			"/v2/service_instances/instance-id/service_bindings/binding-id",
+			`{`,
+			http.StatusUnprocessableEntity,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			w := serveBody(t, env, "PUT", tc.path, tc.body, true)
+			if w.Code != tc.status {
+				t.Fatalf("expected %d but received %d: %s", tc.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestHandler_Health(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var resp readinessResponse
+	ready := func(expected int) map[string]bool {
+		w := serve(t, env, "GET", "/health/ready", false)
+		if w.Code != expected {
+			t.Fatalf("expected %d but received %d: %s", expected, w.Code, w.Body)
+		}
+		resp = readinessResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		checks := make(map[string]bool)
+		for _, c := range resp.Checks {
+			checks[c.Name] = c.Healthy
+		}
+		return checks
+	}
+
+	if w := serve(t, env, "GET", "/health/live", false); w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	// The broker is not ready until it started, nor serves other routes
+	env.Broker.startLock.Lock()
+	env.Broker.started = false
+	env.Broker.startLock.Unlock()
+	checks := ready(http.StatusServiceUnavailable)
+	expected := "map[renewals:true started:false state:true token:true]"
+	if fmt.Sprint(checks) != expected {
+		t.Fatalf("expected %s but received %v", expected, checks)
+	}
+	if w := serve(t, env, "GET", "/v2/catalog", true); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d but received %d", http.StatusServiceUnavailable, w.Code)
+	}
+	env.Broker.startLock.Lock()
+	env.Broker.started = true
+	env.Broker.startLock.Unlock()
+	ready(http.StatusOK)
+
+	// Nor while renewals are overdue
+	env.Broker.renewals = testRenewalManager(nil)
+	env.Broker.renewals.add("token", "accessor")
+	env.Broker.renewals.lock.Lock()
+	r := env.Broker.renewals.tokens["accessor"]
+	r.status.NextRenewal = time.Now().Add(-2 * renewalBacklogGrace)
+	heap.Fix(&env.Broker.renewals.queue, r.index)
+	env.Broker.renewals.lock.Unlock()
+	checks = ready(http.StatusServiceUnavailable)
+	if checks["renewals"] {
+		t.Fatal("expected the renewals check to fail")
+	}
+	env.Broker.renewals.stop("accessor")
+
+	// The errors of Vault are logged rather than served, since readiness is
+	// served without credentials
+	if err := env.Broker.vaultClient.SetAddress("http://127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	env.Broker.vaultClient.SetMaxRetries(0)
+	checks = ready(http.StatusServiceUnavailable)
+	expected = "map[renewals:true started:true state:false token:false]"
+	if fmt.Sprint(checks) != expected {
+		t.Fatalf("expected %s but received %v", expected, checks)
+	}
+	for _, c := range resp.Checks {
+		if strings.Contains(c.Error, "127.0.0.1") {
+			t.Fatalf("expected a generic error but received %q", c.Error)
+		}
+	}
+
+	// Other routes still require credentials
+	if w := serve(t, env, "GET", "/health", false); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d but received %d", http.StatusUnauthorized, w.Code)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// StateMount is the path of the KV version 2 backend where the broker
+	// stores the records of its instances at "<instance_id>" and of their
+	// bindings at "<instance_id>/<binding_id>", along with the references to
+	// shared backends under mountReferencesDir. Every write creates a new
+	// version of the record, so prior versions can be recovered.
+	StateMount = "cf/broker-state"
+
+	// LegacyStateMount is the path of the generic backend where the broker
+	// stored its records before they had a schema version. Records found
+	// there are migrated to StateMount when the broker starts.
+	LegacyStateMount = "cf/broker"
+
+	// recordKindInstance, recordKindBinding, and recordKindMount are the
+	// kinds of records.
+	recordKindInstance = "instance"
+	recordKindBinding  = "binding"
+	recordKindMount    = "mount"
+)
+
+// stateRecord is the envelope every record is stored in.
+type stateRecord struct {
+	SchemaVersion int             `json:"schema_version"`
+	Kind          string          `json:"kind"`
+	Record        json.RawMessage `json:"record"`
+}
+
+// stateUpgrades upgrade the encoded record of the kind from one schema version
+// to the next, the first from version 1 to version 2. Adding a field with a zero
+// value that preserves the old behavior does not need an upgrade.
+var stateUpgrades = []func(kind string, record json.RawMessage) (json.RawMessage, error){
+	// Version 2 no longer stores the secret IDs of AppRole bindings.
+	dropSecretID,
+}
+
+// stateSchemaVersion returns the version of the records the broker writes,
+// which every upgrade bumps. Records of older versions are upgraded as they
+// are read, and records of newer versions are refused.
+func stateSchemaVersion() int {
+	return len(stateUpgrades) + 1
+}
+
+// dropSecretID removes the secret ID from the record of an AppRole binding.
+func dropSecretID(kind string, record json.RawMessage) (json.RawMessage, error) {
+	if kind != recordKindBinding {
+		return record, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(record, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["SecretID"]; !ok {
+		return record, nil
+	}
+	delete(fields, "SecretID")
+	return json.Marshal(fields)
+}
+
+// waitForState waits for the state backend to accept requests. Vault upgrades
+// new KV version 2 backends in the background, during which they refuse
+// requests.
+func (b *Broker) waitForState() error {
+	var err error
+	for i := 0; i < 20; i++ {
+		if _, err = b.vaultClient.Logical().Read(StateMount + "/config"); err == nil {
+			return nil
+		}
+		b.log.Printf("[DEBUG] waiting for %s to be ready: %s", StateMount, err)
+		time.Sleep(500 * time.Millisecond)
+	}
+	return errors.Wrapf(err, "%s is not ready", StateMount)
+}
+
+// writeState stores the record of the given kind at the path in the state
+// backend.
+func (b *Broker) writeState(path, kind string, record interface{}) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s record", kind)
+	}
+	b.log.Printf("[DEBUG] storing %s record at %s/%s", kind, StateMount, path)
+	_, err = b.vaultClient.Logical().Write(StateMount+"/data/"+path, map[string]interface{}{
+		"data": &stateRecord{
+			SchemaVersion: stateSchemaVersion(),
+			Kind:          kind,
+			Record:        encoded,
+		},
+	})
+	return err
+}
+
+// readState decodes the record of the given kind at the path in the state
+// backend into v, upgrading it to the current schema version. It returns false
+// if there is no record at the path.
+func (b *Broker) readState(path, kind string, v interface{}) (bool, error) {
+	_, ok, err := b.readStateVersion(path, kind, v)
+	return ok, err
+}
+
+// readStateVersion is readState, which also returns the schema version the
+// record was stored with.
+func (b *Broker) readStateVersion(path, kind string, v interface{}) (int, bool, error) {
+	b.log.Printf("[DEBUG] reading %s record at %s/%s", kind, StateMount, path)
+	secret, err := b.vaultClient.Logical().Read(StateMount + "/data/" + path)
+	if err != nil {
+		return 0, false, err
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return 0, false, nil
+	}
+
+	encoded, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return 0, false, err
+	}
+	var record stateRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return 0, false, errors.Wrapf(err, "failed to decode record at %s", path)
+	}
+	if record.Kind != kind {
+		return 0, false, fmt.Errorf("record at %s is a %s record, not %s", path, record.Kind, kind)
+	}
+	current := stateSchemaVersion()
+	if record.SchemaVersion < 1 || record.SchemaVersion > current {
+		return 0, false, fmt.Errorf("record at %s has schema version %d, which this version of the broker does not support (1 to %d)",
+			path, record.SchemaVersion, current)
+	}
+	for version := record.SchemaVersion; version < current; version++ {
+		if record.Record, err = stateUpgrades[version-1](kind, record.Record); err != nil {
+			return 0, false, errors.Wrapf(err, "failed to upgrade record at %s from schema version %d", path, version)
+		}
+	}
+
+	if err := json.Unmarshal(record.Record, v); err != nil {
+		return 0, false, errors.Wrapf(err, "failed to decode %s record at %s", kind, path)
+	}
+	return record.SchemaVersion, true, nil
+}
+
+// restoreState is readState for records restored when the broker starts, which
+// stores the records of older schema versions again once they are upgraded, so
+// that every record converges on the current version.
+func (b *Broker) restoreState(path, kind string, v interface{}) (bool, error) {
+	version, ok, err := b.readStateVersion(path, kind, v)
+	if err != nil || !ok || version == stateSchemaVersion() {
+		return ok, err
+	}
+	b.log.Printf("[INFO] upgrading %s record at %s from schema version %d to %d", kind, path, version, stateSchemaVersion())
+	if err := b.writeState(path, kind, v); err != nil {
+		return false, errors.Wrapf(err, "failed to store upgraded %s record at %s", kind, path)
+	}
+	return true, nil
+}
+
+// listState lists the keys under the directory of the state backend.
+func (b *Broker) listState(dir string) ([]string, error) {
+	return b.listDir(StateMount + "/metadata/" + dir)
+}
+
+// deleteState deletes the record at the path in the state backend, along with
+// all of its versions.
+func (b *Broker) deleteState(path string) error {
+	b.log.Printf("[DEBUG] deleting record at %s/%s", StateMount, path)
+	_, err := b.vaultClient.Logical().Delete(StateMount + "/metadata/" + path)
+	return err
+}
+
+// migrateLegacyState moves the records stored in LegacyStateMount by previous
+// versions of the broker into the state backend. Each record is deleted from
+// the legacy backend once it has been stored, so an interrupted migration
+// continues where it left off the next time the broker starts.
+func (b *Broker) migrateLegacyState() error {
+	mounts, err := b.vaultClient.Sys().ListMounts()
+	if err != nil {
+		return errors.Wrap(err, "failed to list mounts")
+	}
+	legacy, ok := mounts[LegacyStateMount+"/"]
+	if !ok || mountKVVersion(legacy) != 1 {
+		return nil
+	}
+
+	keys, err := b.listDir(LegacyStateMount + "/")
+	if err != nil {
+		return errors.Wrap(err, "failed to list legacy instances")
+	}
+	instances := uniqueKeys(keys)
+	if len(instances) == 0 {
+		return nil
+	}
+	b.log.Printf("[INFO] migrating %d legacy instances from %s to %s", len(instances), LegacyStateMount, StateMount)
+
+	for _, inst := range instances {
+		keys, err := b.listDir(LegacyStateMount + "/" + inst + "/")
+		if err != nil {
+			return errors.Wrapf(err, "failed to list legacy binds for instance %q", inst)
+		}
+		for _, bind := range uniqueKeys(keys) {
+			path := inst + "/" + bind
+			if err := b.migrateLegacyRecord(path, recordKindBinding, func(data map[string]interface{}) (interface{}, error) {
+				return decodeBindingInfo(data)
+			}); err != nil {
+				return err
+			}
+		}
+
+		if err := b.migrateLegacyRecord(inst, recordKindInstance, func(data map[string]interface{}) (interface{}, error) {
+			return decodeInstanceInfo(data)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLegacyRecord moves the legacy record at the path into the state
+// backend, using decode to decode it.
+func (b *Broker) migrateLegacyRecord(path, kind string, decode func(map[string]interface{}) (interface{}, error)) error {
+	legacyPath := LegacyStateMount + "/" + path
+	secret, err := b.vaultClient.Logical().Read(legacyPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read legacy %s record at %q", kind, legacyPath)
+	}
+	if secret == nil || len(secret.Data) == 0 {
+		return nil
+	}
+
+	b.log.Printf("[INFO] migrating legacy %s record at %s", kind, legacyPath)
+	record, err := decode(secret.Data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to decode legacy %s record at %s", kind, legacyPath)
+	}
+	if err := b.writeState(path, kind, record); err != nil {
+		return errors.Wrapf(err, "failed to store migrated %s record for %s", kind, path)
+	}
+	if _, err := b.vaultClient.Logical().Delete(legacyPath); err != nil {
+		return errors.Wrapf(err, "failed to delete legacy %s record at %s", kind, legacyPath)
+	}
+	return nil
+}
+
+// uniqueKeys trims the trailing slash from listed keys, which appear twice
+// when they are both a record and a directory, and removes the duplicates.
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	unique := make([]string, 0, len(keys))
+	for _, k := range keys {
+		k = strings.Trim(k, "/")
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		unique = append(unique, k)
+	}
+	return unique
+}
@@ -0,0 +1,171 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBroker_Start_MigratesLegacyState(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	if err := env.Broker.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer env.Broker.Stop()
+
+	if !env.Requested("POST /v1/sys/mounts/cf/broker-state") {
+		t.Fatal("expected the state backend to be mounted")
+	}
+	for path, kind := range map[string]string{
+		"foo":     recordKindInstance,
+		"foo/foo": recordKindBinding,
+	} {
+		record := env.State(path)
+		if record == nil {
+			t.Fatalf("expected a record at %s", path)
+		}
+		if record.Kind != kind || record.SchemaVersion != stateSchemaVersion() {
+			t.Fatalf("expected a version %d %s record but received %+v", stateSchemaVersion(), kind, record)
+		}
+		if !env.Requested("DELETE /v1/cf/broker/" + path) {
+			t.Fatalf("expected the legacy record at %s to be deleted", path)
+		}
+	}
+
+	env.Broker.instancesLock.Lock()
+	instance, ok := env.Broker.instances["foo"]
+	env.Broker.instancesLock.Unlock()
+	if !ok {
+		t.Fatal("expected the migrated instance to be restored")
+	}
+	if instance.OrganizationGUID != "organization-guid" {
+		t.Fatalf("expected %s but received %s", "organization-guid", instance.OrganizationGUID)
+	}
+}
+
+func TestBroker_readState(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.state["current"] = json.RawMessage(`{"schema_version": 1, "kind": "instance", "record": {"SpaceGUID": "space-guid"}}`)
+	env.state["newer"] = json.RawMessage(fmt.Sprintf(`{"schema_version": %d, "kind": "instance", "record": {}}`, stateSchemaVersion()+1))
+
+	var info instanceInfo
+	ok, err := env.Broker.readState("current", recordKindInstance, &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || info.SpaceGUID != "space-guid" {
+		t.Fatalf("expected the record to be read but received %t, %+v", ok, info)
+	}
+
+	if ok, err := env.Broker.readState("missing", recordKindInstance, &info); ok || err != nil {
+		t.Fatalf("expected no record but received %t, %v", ok, err)
+	}
+	if _, err := env.Broker.readState("current", recordKindBinding, &info); err == nil {
+		t.Fatal("expected an error reading a record of another kind")
+	}
+	if _, err := env.Broker.readState("newer", recordKindInstance, &info); err == nil {
+		t.Fatal("expected an error reading a record of a newer schema version")
+	}
+}
+
+func TestBroker_restoreState(t *testing.T) {
+	// Version 2 of the schema renamed the space of instances.
+	defer func(upgrades []func(string, json.RawMessage) (json.RawMessage, error)) {
+		stateUpgrades = upgrades
+	}(stateUpgrades)
+	stateUpgrades = append(stateUpgrades[:len(stateUpgrades):len(stateUpgrades)], func(kind string, record json.RawMessage) (json.RawMessage, error) {
+		if kind != recordKindInstance {
+			return record, nil
+		}
+		return json.RawMessage(strings.Replace(string(record), `"Space"`, `"SpaceGUID"`, 1)), nil
+	})
+	version := stateSchemaVersion()
+
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.state["older"] = json.RawMessage(`{"schema_version": 1, "kind": "instance", "record": {"Space": "space-guid"}}`)
+	if err := env.Broker.restoreInstance("older"); err != nil {
+		t.Fatal(err)
+	}
+	env.Broker.instancesLock.Lock()
+	info := env.Broker.instances["older"]
+	env.Broker.instancesLock.Unlock()
+	if info == nil || info.SpaceGUID != "space-guid" {
+		t.Fatalf("expected the upgraded instance to be restored but received %+v", info)
+	}
+	record := env.State("older")
+	if record == nil || record.SchemaVersion != version {
+		t.Fatalf("expected the record to be stored at version %d but received %+v", version, record)
+	}
+	var stored instanceInfo
+	if err := json.Unmarshal(record.Record, &stored); err != nil || stored.SpaceGUID != "space-guid" {
+		t.Fatalf("expected the upgraded record to be stored but received %s", record.Record)
+	}
+
+	env.state["newer"] = json.RawMessage(fmt.Sprintf(`{"schema_version": %d, "kind": "instance", "record": {}}`, version+1))
+	err := env.Broker.restoreInstance("newer")
+	if err == nil || !strings.Contains(err.Error(), "schema version") {
+		t.Fatalf("expected an error restoring a record of a newer schema version but received %v", err)
+	}
+	if record := env.State("newer"); record == nil || record.SchemaVersion != version+1 {
+		t.Fatalf("expected the newer record to be left alone but received %+v", record)
+	}
+}
+
+func TestBroker_restoreBind_dropsSecretID(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.state["instance-id/approle"] = json.RawMessage(`{
+		"schema_version": 1,
+		"kind": "binding",
+		"record": {"Binding": "approle", "Mode": "approle", "RoleID": "role-id", "SecretID": "secret-id"}
+	}`)
+	if err := env.Broker.restoreBind("instance-id", "approle"); err != nil {
+		t.Fatal(err)
+	}
+	record := env.State("instance-id/approle")
+	if record == nil || record.SchemaVersion != stateSchemaVersion() {
+		t.Fatalf("expected the record to be upgraded but received %+v", record)
+	}
+	if strings.Contains(string(record.Record), "secret-id") || !strings.Contains(string(record.Record), "role-id") {
+		t.Fatalf("expected only the secret ID to be dropped but received %s", record.Record)
+	}
+}
+
+func TestBroker_writeState_deleteState(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	info := &instanceInfo{OrganizationGUID: "organization-guid"}
+	if err := env.Broker.writeState("instance", recordKindInstance, info); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := env.Broker.listState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, k := range keys {
+		found = found || k == "instance"
+	}
+	if !found {
+		t.Fatalf("expected the record to be listed but received %v", keys)
+	}
+
+	if err := env.Broker.deleteState("instance"); err != nil {
+		t.Fatal(err)
+	}
+	if record := env.State("instance"); record != nil {
+		t.Fatalf("expected the record to be deleted but received %+v", record)
+	}
+}
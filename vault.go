@@ -15,36 +15,80 @@ const (
 path "cf/{{ .InstanceID }}" {
   capabilities = ["list"]
 }
-
+{{ if eq .InstanceKVVersion 2 }}{{ range .Engines }}{{ if ne . "secret" }}
+path "cf/{{ $.InstanceID }}/{{ . }}/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+{{ end }}{{ end }}{{ template "kv2" (printf "cf/%s/secret" .InstanceID) }}{{ else }}
 path "cf/{{ .InstanceID }}/*" {
 	capabilities = ["create", "read", "update", "delete", "list"]
 }
-
+{{ end }}
 path "cf/{{ .SpaceID }}" {
   capabilities = ["list"]
 }
-
+{{ if eq .SpaceKVVersion 2 }}{{ template "kv2" (printf "cf/%s/secret" .SpaceID) }}{{ else }}
 path "cf/{{ .SpaceID }}/*" {
   capabilities = ["create", "read", "update", "delete", "list"]
 }
-
+{{ end }}
 path "cf/{{ .OrgID }}" {
   capabilities = ["list"]
 }
-
+{{ if eq .OrgKVVersion 2 }}{{ template "kv2-read" (printf "cf/%s/secret" .OrgID) }}{{ else }}
 path "cf/{{ .OrgID }}/*" {
   capabilities = ["read", "list"]
 }
-{{ if ne .ApplicationID "" }}
+{{ end }}{{ if ne .ApplicationID "" }}
 path "cf/{{ .ApplicationID }}" {
   capabilities = ["list"]
 }
-
+{{ if eq .ApplicationKVVersion 2 }}{{ range .Engines }}{{ if ne . "secret" }}
+path "cf/{{ $.ApplicationID }}/{{ . }}/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+{{ end }}{{ end }}{{ template "kv2" (printf "cf/%s/secret" .ApplicationID) }}{{ else }}
 path "cf/{{ .ApplicationID }}/*" {
   capabilities = ["create", "read", "update", "delete", "list"]
 }
-{{ end -}}
+{{ end }}{{ end -}}
 `
+
+	// kv2PolicyTemplates are the paths ServicePolicyTemplate grants on a
+	// version 2 KV secrets engine in place of a wildcard over the mount, read
+	// and write by "kv2" and read only by "kv2-read". Both are executed with
+	// the path of the mount.
+	kv2PolicyTemplates string = `
+{{- define "kv2" }}
+path "{{ . }}/data/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+
+path "{{ . }}/metadata/*" {
+  capabilities = ["read", "delete", "list"]
+}
+
+path "{{ . }}/delete/*" {
+  capabilities = ["update"]
+}
+
+path "{{ . }}/undelete/*" {
+  capabilities = ["update"]
+}
+
+path "{{ . }}/destroy/*" {
+  capabilities = ["update"]
+}
+{{ end }}
+{{- define "kv2-read" }}
+path "{{ . }}/data/*" {
+  capabilities = ["read"]
+}
+
+path "{{ . }}/metadata/*" {
+  capabilities = ["read", "list"]
+}
+{{ end }}`
 )
 
 // ServicePolicyTemplateInput is used as input to the ServicePolicyTemplate.
@@ -60,6 +104,20 @@ type ServicePolicyTemplateInput struct {
 
 	// ApplicationID is the unique ID of the service.
 	ApplicationID string
+
+	// Engines are the engines mounted for the instance, and for the
+	// application.
+	Engines []string
+
+	// InstanceKVVersion, SpaceKVVersion, OrgKVVersion, and
+	// ApplicationKVVersion are the versions of the KV secrets engine mounted
+	// at "cf/<id>/secret" for each ID. A version 2 engine is granted its
+	// sub-paths, and the other engines of the ID their own mounts, rather
+	// than everything under "cf/<id>".
+	InstanceKVVersion    int
+	SpaceKVVersion       int
+	OrgKVVersion         int
+	ApplicationKVVersion int
 }
 
 // GeneratePolicy takes an io.Writer object and template input and renders the
@@ -69,5 +127,8 @@ func GeneratePolicy(w io.Writer, info *ServicePolicyTemplateInput) error {
 	if err != nil {
 		return err
 	}
+	if tmpl, err = tmpl.Parse(kv2PolicyTemplates); err != nil {
+		return err
+	}
 	return tmpl.Execute(w, info)
 }
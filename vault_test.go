@@ -93,3 +93,102 @@ path "cf/application-id/*" {
   capabilities = ["create", "read", "update", "delete", "list"]
 }
 `
+
+func TestGeneratePolicy_KVVersion2(t *testing.T) {
+	w := new(bytes.Buffer)
+	info := &ServicePolicyTemplateInput{
+		OrgID:                "org-id",
+		SpaceID:              "space-id",
+		InstanceID:           "service-instance-id",
+		ApplicationID:        "application-id",
+		Engines:              []string{EngineSecret, EngineTransit},
+		InstanceKVVersion:    2,
+		OrgKVVersion:         2,
+		ApplicationKVVersion: 2,
+	}
+	if err := GeneratePolicy(w, info); err != nil {
+		t.Fatal(err)
+	}
+	result := w.String()
+	if result != expectedKVVersion2 {
+		t.Fatalf("received unexpected policy of %s", result)
+	}
+}
+
+var expectedKVVersion2 = `
+path "cf/service-instance-id" {
+  capabilities = ["list"]
+}
+
+path "cf/service-instance-id/transit/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+
+path "cf/service-instance-id/secret/data/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+
+path "cf/service-instance-id/secret/metadata/*" {
+  capabilities = ["read", "delete", "list"]
+}
+
+path "cf/service-instance-id/secret/delete/*" {
+  capabilities = ["update"]
+}
+
+path "cf/service-instance-id/secret/undelete/*" {
+  capabilities = ["update"]
+}
+
+path "cf/service-instance-id/secret/destroy/*" {
+  capabilities = ["update"]
+}
+
+path "cf/space-id" {
+  capabilities = ["list"]
+}
+
+path "cf/space-id/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+
+path "cf/org-id" {
+  capabilities = ["list"]
+}
+
+path "cf/org-id/secret/data/*" {
+  capabilities = ["read"]
+}
+
+path "cf/org-id/secret/metadata/*" {
+  capabilities = ["read", "list"]
+}
+
+path "cf/application-id" {
+  capabilities = ["list"]
+}
+
+path "cf/application-id/transit/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+
+path "cf/application-id/secret/data/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+
+path "cf/application-id/secret/metadata/*" {
+  capabilities = ["read", "delete", "list"]
+}
+
+path "cf/application-id/secret/delete/*" {
+  capabilities = ["update"]
+}
+
+path "cf/application-id/secret/undelete/*" {
+  capabilities = ["update"]
+}
+
+path "cf/application-id/secret/destroy/*" {
+  capabilities = ["update"]
+}
+`